@@ -0,0 +1,131 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/14 20:31
+// @Desc 条件写入和原子计数，检查和写入在同一把锁下完成
+package kv_projects
+
+import (
+	"bytes"
+	"kv-projects/data"
+	"math"
+	"strconv"
+)
+
+// CompareAndSwap 当 key 当前的值等于 oldValue 时写入 newValue，返回是否写入成功
+// oldValue 为 nil 表示期望 key 不存在
+func (db *DB) CompareAndSwap(key []byte, oldValue []byte, newValue []byte) (bool, error) {
+	var swapped bool
+	err := db.conditionalWrite(key, func(value []byte, exists bool) (*data.LogRecord, error) {
+		if oldValue == nil && exists || oldValue != nil && (!exists || !bytes.Equal(value, oldValue)) {
+			return nil, nil
+		}
+		swapped = true
+		return &data.LogRecord{Key: key, Value: newValue, Type: data.LogRecordNormal}, nil
+	})
+	return swapped && err == nil, err
+}
+
+// PutIfAbsent 当 key 不存在时写入 value，返回是否写入成功
+func (db *DB) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	var written bool
+	err := db.conditionalWrite(key, func(_ []byte, exists bool) (*data.LogRecord, error) {
+		if exists {
+			return nil, nil
+		}
+		written = true
+		return &data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal}, nil
+	})
+	return written && err == nil, err
+}
+
+// DeleteIfEquals 当 key 当前的值等于 value 时删除 key，返回是否删除成功
+func (db *DB) DeleteIfEquals(key []byte, value []byte) (bool, error) {
+	var deleted bool
+	err := db.conditionalWrite(key, func(old []byte, exists bool) (*data.LogRecord, error) {
+		if !exists || !bytes.Equal(old, value) {
+			return nil, nil
+		}
+		deleted = true
+		return &data.LogRecord{Key: key, Type: data.LogRecordDeleted}, nil
+	})
+	return deleted && err == nil, err
+}
+
+// Incr 对 key 对应的 int64 计数器原子地加上 delta，返回相加之后的值
+// 计数器以十进制字符串的形式存储，key 不存在时视为 0
+func (db *DB) Incr(key []byte, delta int64) (int64, error) {
+	var result int64
+	err := db.conditionalWrite(key, func(value []byte, exists bool) (*data.LogRecord, error) {
+		var n int64
+		if exists {
+			var err error
+			if n, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+				return nil, ErrValueNotInteger
+			}
+		}
+		if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+			return nil, ErrIncrOverflow
+		}
+		result = n + delta
+		return &data.LogRecord{
+			Key:   key,
+			Value: []byte(strconv.FormatInt(result, 10)),
+			Type:  data.LogRecordNormal,
+		}, nil
+	})
+	return result, err
+}
+
+// conditionalWrite 在 db.mu 的保护下读取 key 当前的值，根据 fn 的返回决定写入什么
+// fn 返回 nil 表示不需要写入，索引的检查、追加写和索引的更新都在同一把锁下完成
+func (db *DB) conditionalWrite(key []byte, fn func(value []byte, exists bool) (*data.LogRecord, error)) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	// 和 Update 中的读-改-写互斥
+	unlock := db.keyLocks.lockKey(key)
+	defer unlock()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 取出 key 当前的值
+	var value []byte
+	var exists bool
+	if pos := db.index.Get(key); pos != nil {
+		var err error
+		value, err = db.getValueByPosition(pos)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		exists = err == nil
+	}
+
+	logRecord, err := fn(value, exists)
+	if err != nil || logRecord == nil {
+		return err
+	}
+
+	// 二级索引的记录和数据在同一个批次中写入
+	deleted := logRecord.Type == data.LogRecordDeleted
+	indexRecords := db.secondaryIndexRecords(key, value, exists, logRecord.Value, !deleted)
+
+	// 追加写入到当前活跃数据文件当中
+	positions, err := db.appendLogRecords(append([]*data.LogRecord{logRecord}, indexRecords...))
+	if err != nil {
+		return err
+	}
+	// 更新内存索引
+	var ok bool
+	if deleted {
+		ok = db.index.Delete(key)
+	} else {
+		db.addToBloomFilter(key)
+		ok = db.index.Put(key, positions[0])
+	}
+	if !ok {
+		return ErrIndexUpdateFailed
+	}
+	return db.applySecondaryIndexRecords(indexRecords, positions[1:])
+}
@@ -0,0 +1,174 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/14 20:31
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cas")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.key 不存在时，期望值为 nil 可以写入
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), nil, []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// 2.期望值不匹配
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v0"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), nil, []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 3.期望值匹配
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 4.key 为空
+	_, err = db.CompareAndSwap(nil, nil, []byte("v"))
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	// 5.并发 CAS，同一个期望值只有一个能成功
+	var success int
+	var mu sync.Mutex
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := db.CompareAndSwap(utils.GetTestKey(1), []byte("v2"), []byte(strconv.Itoa(i)))
+			assert.Nil(t, err)
+			if ok {
+				mu.Lock()
+				success++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, success)
+}
+
+func TestDB_PutIfAbsent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-if-absent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ok, err := db.PutIfAbsent(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	ok, err = db.PutIfAbsent(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 删除之后可以重新写入
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	ok, err = db.PutIfAbsent(utils.GetTestKey(1), []byte("v3"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+}
+
+func TestDB_DeleteIfEquals(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-if-equals")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.key 不存在
+	ok, err := db.DeleteIfEquals(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 2.值不相等
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// 3.值相等
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Incr(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-incr")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.key 不存在时从 0 开始
+	n, err := db.Incr(utils.GetTestKey(1), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+	n, err = db.Incr(utils.GetTestKey(1), -7)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-2), n)
+
+	// 2.并发递增
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, err := db.Incr(utils.GetTestKey(2), 1)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	val, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1000"), val)
+
+	// 3.值不是整数
+	err = db.Put(utils.GetTestKey(3), []byte("abc"))
+	assert.Nil(t, err)
+	_, err = db.Incr(utils.GetTestKey(3), 1)
+	assert.Equal(t, ErrValueNotInteger, err)
+
+	// 4.溢出
+	_, err = db.Incr(utils.GetTestKey(4), math.MaxInt64)
+	assert.Nil(t, err)
+	_, err = db.Incr(utils.GetTestKey(4), 1)
+	assert.Equal(t, ErrIncrOverflow, err)
+}
@@ -0,0 +1,76 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/28 20:30
+// @Desc 备份数据库，将所有的数据文件和值日志文件复制到指定的目录
+package kv_projects
+
+import (
+	"io"
+	"kv-projects/data"
+	"os"
+	"path/filepath"
+)
+
+// Backup 将数据库当前的内容备份到 dir 中，dir 不存在时会被创建，已经存在时必须是空的目录，备份的目录可以直接通过 Open 打开
+// 备份期间持有读锁，写入会被阻塞，读取不受影响。文件都是追加写入的，只需要复制到备份开始时的长度
+func (db *DB) Backup(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	// 目录中残留的其他文件会在打开时一起被加载
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrBackupDirNotEmpty
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+
+	for fid, dataFile := range *db.dataFiles.Load() {
+		if err := copyDataFile(dataFile, filepath.Join(dir, filepath.Base(data.GetDataFileName("", fid)))); err != nil {
+			return err
+		}
+	}
+	for fid, dataFile := range *db.valueLog.files.Load() {
+		if err := copyDataFile(dataFile, filepath.Join(dir, filepath.Base(data.GetValueLogFileName("", fid)))); err != nil {
+			return err
+		}
+	}
+	// 备份的目录需要使用同样的比较器打开，空的数据库不需要记录
+	if len(*db.dataFiles.Load()) == 0 {
+		return nil
+	}
+	return writeComparatorFile(dir, db.options.Comparator.Name())
+}
+
+// copyDataFile 将数据文件当前的内容复制到 dst 中并持久化
+func copyDataFile(dataFile *data.DataFile, dst string) error {
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 64*1024)
+	for offset := int64(0); offset < size; {
+		n := min(int64(len(buf)), size-offset)
+		if _, err := dataFile.IoManager.Read(buf[:n], offset); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := file.Write(buf[:n]); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return file.Sync()
+}
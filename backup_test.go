@@ -0,0 +1,67 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/28 20:30
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_Backup(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.ValueThreshold = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.空的数据库也可以备份
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dst")
+	defer os.RemoveAll(backupDir)
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	// 2.备份多个数据文件和值日志文件，备份之后的写入不影响备份
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(i%128 + 1)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("after backup"))
+	assert.Nil(t, err)
+
+	// 3.不能备份到非空的目录
+	err = db.Backup(backupDir)
+	assert.Equal(t, ErrBackupDirNotEmpty, err)
+
+	// 4.备份的目录可以直接打开
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backup, err := Open(backupOpts)
+	assert.Nil(t, err)
+	defer backup.Close()
+	_, err = backup.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < 200; i++ {
+		val, err := backup.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+
+	// 5.关闭之后不能备份
+	err = db.Close()
+	assert.Nil(t, err)
+	err = db.Backup(t.TempDir())
+	assert.Equal(t, ErrDBClosed, err)
+}
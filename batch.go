@@ -0,0 +1,262 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/4 20:40
+// @Desc 原子批次，多条记录要么全部生效，要么全部不生效
+package kv_projects
+
+import (
+	"context"
+	"encoding/binary"
+	"kv-projects/data"
+)
+
+// pendingRecord 加载索引时读取到的还没有提交的批次中的记录
+type pendingRecord struct {
+	logRecord *data.LogRecord
+	pos       *data.LogRecordPos
+}
+
+// appendLogRecordsWithLock 加锁后原子地追加写入一批记录，和单条记录的写入一样通过组提交合并
+func (db *DB) appendLogRecordsWithLock(logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	return db.appendLogRecordsWithContext(context.Background(), logRecords)
+}
+
+// appendLogRecordsWithContext 和 appendLogRecordsWithLock 相同，在组提交中等待期间 ctx 结束时放弃写入
+func (db *DB) appendLogRecordsWithContext(ctx context.Context, logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	// 压缩放在加锁之前，不占用写锁的时间
+	for _, logRecord := range logRecords {
+		if err := db.compressLogRecord(logRecord); err != nil {
+			return nil, err
+		}
+	}
+	return db.groupCommit.commit(ctx, db, logRecords)
+}
+
+// appendLogRecords 原子地追加写入一批记录，并根据配置决定是否持久化，调用方需要持有 db.mu
+func (db *DB) appendLogRecords(logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	for _, logRecord := range logRecords {
+		if err := db.compressLogRecord(logRecord); err != nil {
+			return nil, err
+		}
+	}
+	positions, err := db.writeLogRecords(logRecords)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.syncAfterWrite(context.Background()); err != nil {
+		return nil, err
+	}
+	for i, logRecord := range logRecords {
+		db.notifyWatchers(logRecord, positions[i])
+	}
+	db.publishCommitted()
+	return positions, nil
+}
+
+// writeLogRecords 写入一批记录，不做持久化，调用方需要持有 db.mu
+// 多于一条记录时，前后分别写入批次的开始和提交记录，持有 db.mu 保证批次中的记录在数据文件中是连续的。
+// 提交记录中带有批次中记录的数量，回放时数量一致才更新索引
+func (db *DB) writeLogRecords(logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	if len(logRecords) == 1 {
+		pos, err := db.writeLogRecord(logRecords[0])
+		if err != nil {
+			return nil, err
+		}
+		db.metrics.recordWrites(logRecords)
+		return []*data.LogRecordPos{pos}, nil
+	}
+
+	if _, err := db.writeLogRecord(&data.LogRecord{Type: data.LogRecordBatchBegin}); err != nil {
+		return nil, err
+	}
+	positions := make([]*data.LogRecordPos, len(logRecords))
+	for i, logRecord := range logRecords {
+		pos, err := db.writeLogRecord(logRecord)
+		if err != nil {
+			// 已经写入的记录不能和之后的写入混在一起，写入一个数量不一致的提交记录放弃这个批次
+			_ = db.abortBatch()
+			return nil, err
+		}
+		positions[i] = pos
+	}
+	if _, err := db.writeLogRecord(newBatchCommitRecord(len(logRecords))); err != nil {
+		return nil, err
+	}
+	db.metrics.recordWrites(logRecords)
+	return positions, nil
+}
+
+// abortBatch 放弃没有写完的批次，批次中的记录都不为空，数量为 0 的提交记录一定和批次不一致，调用方需要持有 db.mu
+func (db *DB) abortBatch() error {
+	_, err := db.writeLogRecord(newBatchCommitRecord(0))
+	return err
+}
+
+// newBatchCommitRecord 批次中有 count 条记录的提交记录
+func newBatchCommitRecord(count int) *data.LogRecord {
+	return &data.LogRecord{
+		Type:  data.LogRecordBatchCommit,
+		Value: binary.AppendUvarint(nil, uint64(count)),
+	}
+}
+
+// replayLogRecord 加载索引时处理一条记录，批次中的记录先暂存，读取到数量一致的提交记录之后再依次更新索引
+// 暂存的记录保存在 db 中，批次跨越数据文件或者从节点分多次读取时仍然可以继续
+func (db *DB) replayLogRecord(logRecord *data.LogRecord, pos *data.LogRecordPos) error {
+	switch logRecord.Type {
+	case data.LogRecordBatchBegin:
+		db.batching, db.pendingBatch = true, nil
+		return nil
+	case data.LogRecordBatchCommit:
+		pending, batching := db.pendingBatch, db.batching
+		db.batching, db.pendingBatch = false, nil
+		count, n := binary.Uvarint(logRecord.Value)
+		// 没有开始记录的提交记录来自已经被合并清理的批次，其中的记录已经作为普通记录处理过了
+		if !batching || n <= 0 || count != uint64(len(pending)) {
+			return nil
+		}
+		for _, record := range pending {
+			if err := db.indexLogRecord(record.logRecord, record.pos); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if db.batching {
+		db.pendingBatch = append(db.pendingBatch, pendingRecord{logRecord: logRecord, pos: pos})
+		return nil
+	}
+	return db.indexLogRecord(logRecord, pos)
+}
+
+// abortPendingBatch 启动时数据文件以没有提交的批次结尾（写入期间崩溃），写入提交记录放弃这个批次，
+// 否则之后的写入在回放时会被当作批次中的记录
+func (db *DB) abortPendingBatch() error {
+	if !db.batching || db.readOnly {
+		return nil
+	}
+	db.batching, db.pendingBatch = false, nil
+	if err := db.abortBatch(); err != nil {
+		return err
+	}
+	return db.syncActiveFiles()
+}
+
+// hasDroppedNamespace 记录中是否有属于已经删除的命名空间的记录，调用方需要持有 db.mu
+func (db *DB) hasDroppedNamespace(logRecords []*data.LogRecord) bool {
+	for _, logRecord := range logRecords {
+		if ns := logRecord.Namespace; ns != 0 && ns != systemNamespace && db.namespaceIds[ns] == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteBatch 原子写入的批次，Put 和 Delete 只在内存中暂存，Commit 时在一个批次中写入，
+// 所有的写入要么全部生效，要么全部不生效，并且只持久化一次。WriteBatch 不是并发安全的
+type WriteBatch struct {
+	db         *DB
+	logRecords []*data.LogRecord
+	keys       map[string]int // key 在 logRecords 中的下标，同一个 key 只保留最后一次写入
+}
+
+// NewWriteBatch 新建原子写入的批次
+func (db *DB) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: db, keys: make(map[string]int)}
+}
+
+// Put 暂存一条写入
+func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	wb.add(&data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal})
+	return nil
+}
+
+// Delete 暂存一条删除
+func (wb *WriteBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	wb.add(&data.LogRecord{Key: key, Type: data.LogRecordDeleted})
+	return nil
+}
+
+// add 暂存一条记录，覆盖同一个 key 之前暂存的记录
+func (wb *WriteBatch) add(logRecord *data.LogRecord) {
+	if i, ok := wb.keys[string(logRecord.Key)]; ok {
+		wb.logRecords[i] = logRecord
+		return
+	}
+	wb.keys[string(logRecord.Key)] = len(wb.logRecords)
+	wb.logRecords = append(wb.logRecords, logRecord)
+}
+
+// Commit 写入暂存的所有记录并更新索引，成功之后清空批次
+// 写入期间持有所有 key 对应的分段锁，和单条记录的写入一样生成二级索引的记录
+func (wb *WriteBatch) Commit() error {
+	if len(wb.logRecords) == 0 {
+		return nil
+	}
+	db := wb.db
+	keys := make([][]byte, 0, len(wb.logRecords))
+	for _, logRecord := range wb.logRecords {
+		keys = append(keys, logRecord.Key)
+	}
+	unlock := db.keyLocks.lockKeys(keys)
+	defer unlock()
+
+	// 每个 key 的记录之后是它的二级索引记录，不存在的 key 的删除不需要写入
+	var logRecords []*data.LogRecord
+	var records []*data.LogRecord
+	var indexCounts []int
+	for _, staged := range wb.logRecords {
+		exists := staged.Type == data.LogRecordNormal
+		if !exists && db.index.Get(staged.Key) == nil {
+			continue
+		}
+		indexRecords, err := db.secondaryIndexRecordsOf(staged.Key, staged.Value, exists)
+		if err != nil {
+			return err
+		}
+		// 写入时会压缩记录的 value，复制一份，失败之后再次提交时暂存的记录不变
+		logRecord := *staged
+		records = append(records, &logRecord)
+		indexCounts = append(indexCounts, len(indexRecords))
+		logRecords = append(append(logRecords, &logRecord), indexRecords...)
+	}
+	if len(logRecords) > 0 {
+		positions, err := db.appendLogRecordsWithLock(logRecords)
+		if err != nil {
+			return err
+		}
+		// 更新内存索引
+		var i int
+		for j, logRecord := range records {
+			var ok bool
+			if logRecord.Type == data.LogRecordDeleted {
+				ok = db.index.Delete(logRecord.Key)
+			} else {
+				db.addToBloomFilter(logRecord.Key)
+				ok = db.index.Put(logRecord.Key, positions[i])
+			}
+			if !ok {
+				return ErrIndexUpdateFailed
+			}
+			n := indexCounts[j]
+			if err := db.applySecondaryIndexRecords(logRecords[i+1:i+1+n], positions[i+1:i+1+n]); err != nil {
+				return err
+			}
+			i += 1 + n
+		}
+	}
+	wb.logRecords, wb.keys = nil, make(map[string]int)
+	return nil
+}
@@ -0,0 +1,159 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/4 20:40
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_AppendLogRecords(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.批次中的记录连续写入，跨越多个数据文件
+	var logRecords []*data.LogRecord
+	for i := 0; i < 100; i++ {
+		logRecords = append(logRecords, &data.LogRecord{
+			Key:   utils.GetTestKey(i),
+			Value: utils.RandomValue(64),
+			Type:  data.LogRecordNormal,
+		})
+	}
+	positions, err := db.appendLogRecordsWithLock(logRecords)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(positions))
+	assert.Greater(t, positions[99].Fid, positions[0].Fid)
+	for i, pos := range positions {
+		assert.True(t, db.index.Put(logRecords[i].Key, pos))
+	}
+
+	// 2.重启之后批次中的记录都生效
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, db.index.Size())
+	val, err := db.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 3.订阅中没有批次的开始和提交记录
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	var count int
+	for {
+		event, err := sub.readNext()
+		assert.Nil(t, err)
+		if event == nil {
+			break
+		}
+		assert.Equal(t, utils.GetTestKey(count), event.Key)
+		count++
+	}
+	assert.Equal(t, 100, count)
+}
+
+func TestDB_AppendLogRecords_Torn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-torn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Put([]byte("before"), []byte("value"))
+	assert.Nil(t, err)
+
+	// 1.模拟写入批次期间崩溃，只写入了开始记录和部分记录
+	db.mu.Lock()
+	_, err = db.writeLogRecord(&data.LogRecord{Type: data.LogRecordBatchBegin})
+	assert.Nil(t, err)
+	_, err = db.writeLogRecord(&data.LogRecord{Key: []byte("torn-1"), Value: []byte("value")})
+	assert.Nil(t, err)
+	_, err = db.writeLogRecord(&data.LogRecord{Key: []byte("torn-2"), Value: []byte("value")})
+	assert.Nil(t, err)
+	db.mu.Unlock()
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 2.重启之后没有提交的批次被放弃
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("torn-1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get([]byte("before"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// 3.之后的写入不会被当作批次中的记录
+	err = db.Put([]byte("after"), []byte("value"))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("after"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	_, err = db.Get([]byte("torn-2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_WriteBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-write-batch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.空的批次和空的 key
+	wb := db.NewWriteBatch()
+	assert.Nil(t, wb.Commit())
+	assert.Equal(t, ErrKeyIsEmpty, wb.Put(nil, []byte("v")))
+	assert.Equal(t, ErrKeyIsEmpty, wb.Delete(nil))
+
+	// 2.提交之前不可见，提交之后全部可见，同一个 key 以最后一次写入为准
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("old")))
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("updated")))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(100)))
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, wb.Commit())
+	check := func(db *DB) {
+		_, err := db.Get(utils.GetTestKey(0))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("updated"), val)
+		for i := 2; i <= 10; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+	}
+	check(db)
+
+	// 3.提交之后批次被清空，重启之后数据仍然正确
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	assert.Nil(t, db2.Close())
+}
@@ -0,0 +1,35 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/24 20:45
+// @Desc 布隆过滤器，不存在的 key 不需要查询索引和读取数据文件
+package kv_projects
+
+import "kv-projects/index"
+
+// rebuildBloomFilter 根据索引中所有的 key 重新构建布隆过滤器，调用方需要保证没有并发的写入
+// 删除的 key 无法从布隆过滤器中移除，启动和合并时重新构建，清理这部分误判
+func (db *DB) rebuildBloomFilter() {
+	if db.options.BloomFilterFPRate <= 0 {
+		return
+	}
+	bloom := index.NewBloomFilter(db.index.Size()*2, db.options.BloomFilterFPRate)
+	iter := db.index.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		bloom.Add(iter.Key())
+	}
+	db.bloom.Store(bloom)
+}
+
+// addToBloomFilter 写入 key 到布隆过滤器中，需要在更新索引之前调用，保证索引中的 key 一定可以通过过滤
+func (db *DB) addToBloomFilter(key []byte) {
+	if bloom := db.bloom.Load(); bloom != nil {
+		bloom.Add(key)
+	}
+}
+
+// mayContain key 是否可能存在，没有开启布隆过滤器时总是返回 true
+func (db *DB) mayContain(key []byte) bool {
+	bloom := db.bloom.Load()
+	return bloom == nil || bloom.MayContain(key)
+}
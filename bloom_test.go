@@ -0,0 +1,76 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/24 20:45
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_BloomFilter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+	opts.DirPath = dir
+	opts.BloomFilterFPRate = 0.01
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入的 key 一定可以通过过滤，大部分不存在的 key 被直接过滤
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.PutIfAbsent(utils.GetTestKey(5000), []byte("cas"))
+	assert.Nil(t, err)
+	var passed int
+	for i := 0; i < 10000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i <= 5000 {
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+			continue
+		}
+		assert.Equal(t, ErrKeyNotFound, err)
+		if db.mayContain(utils.GetTestKey(i)) {
+			passed++
+		}
+	}
+	assert.True(t, passed < 200, passed)
+
+	// 2.删除之后仍然可以通过过滤，合并之后重新构建
+	for i := 0; i < 2500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, db.mayContain(utils.GetTestKey(0)))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	passed = 0
+	for i := 0; i < 2500; i++ {
+		if db.mayContain(utils.GetTestKey(i)) {
+			passed++
+		}
+	}
+	assert.True(t, passed < 100, passed)
+
+	// 3.重启之后根据索引构建
+	assert.Nil(t, db.activeFile.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 2500; i <= 5000; i++ {
+		assert.True(t, db2.mayContain(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db2.activeFile.Close())
+
+	// 4.非法的误判率
+	opts.BloomFilterFPRate = 1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
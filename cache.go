@@ -0,0 +1,185 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/23 21:20
+// @Desc 热点日志记录的缓存，避免重复读取磁盘
+package kv_projects
+
+import (
+	"bytes"
+	"container/list"
+	"kv-projects/data"
+	"sync"
+	"sync/atomic"
+)
+
+// cacheShards 缓存的分片数量，每个分片有独立的锁和 LRU 链表
+const cacheShards = 16
+
+// cacheEntryOverhead 每个缓存项除了 key 和 value 之外的大致内存占用
+const cacheEntryOverhead = 64
+
+// CacheStats 缓存的统计信息
+type CacheStats struct {
+	Hits    uint64 // 命中的次数
+	Misses  uint64 // 未命中的次数
+	Entries int    // 缓存的记录数量
+	Bytes   int64  // 缓存的记录占用的字节数
+}
+
+// cacheKey 日志记录在磁盘上的位置，数据文件和值日志文件的 id 相互独立
+type cacheKey struct {
+	valueLog bool
+	fid      uint32
+	offset   int64
+}
+
+// cacheEntry LRU 链表中的一项
+type cacheEntry struct {
+	key    cacheKey
+	record *data.LogRecord
+	size   int64
+}
+
+// cacheShard 缓存的一个分片
+type cacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	items    map[cacheKey]*list.Element
+	lru      *list.List // 链表头部是最近访问的
+}
+
+// recordCache 按位置缓存解码之后的日志记录
+// 日志记录写入之后不会被修改，文件 id 也不会被复用，因此不需要在写入时更新缓存，
+// 合并和值日志的垃圾回收之后删除的文件对应的缓存会被清理
+type recordCache struct {
+	shards [cacheShards]*cacheShard
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// newRecordCache 新建缓存，capacity 为所有分片总的字节数，不大于 0 时返回 nil，表示不开启缓存
+func newRecordCache(capacity int64) *recordCache {
+	if capacity <= 0 {
+		return nil
+	}
+	c := &recordCache{}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			capacity: capacity / cacheShards,
+			items:    make(map[cacheKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
+
+// shardOf 计算位置所在的分片
+func (c *recordCache) shardOf(key cacheKey) *cacheShard {
+	h := uint64(key.fid)<<32 ^ uint64(key.offset)
+	if key.valueLog {
+		h = ^h
+	}
+	h *= 0x9E3779B97F4A7C15
+	return c.shards[h>>60]
+}
+
+// get 读取缓存的日志记录，返回的是副本，调用方可以修改
+func (c *recordCache) get(key cacheKey) (*data.LogRecord, bool) {
+	if c == nil {
+		return nil, false
+	}
+	shard := c.shardOf(key)
+	shard.mu.Lock()
+	elem, ok := shard.items[key]
+	if ok {
+		shard.lru.MoveToFront(elem)
+	}
+	shard.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return cloneLogRecord(elem.Value.(*cacheEntry).record), true
+}
+
+// put 缓存日志记录的副本，超过分片容量的记录不缓存
+func (c *recordCache) put(key cacheKey, record *data.LogRecord) {
+	if c == nil {
+		return
+	}
+	shard := c.shardOf(key)
+	size := int64(len(record.Key)+len(record.Value)) + cacheEntryOverhead
+	if size > shard.capacity {
+		return
+	}
+	record = cloneLogRecord(record)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.items[key]; ok {
+		return
+	}
+	shard.items[key] = shard.lru.PushFront(&cacheEntry{key: key, record: record, size: size})
+	shard.size += size
+	// 淘汰最久没有访问的记录
+	for shard.size > shard.capacity {
+		shard.removeElement(shard.lru.Back())
+	}
+}
+
+// purge 清理指定文件中的所有记录
+func (c *recordCache) purge(valueLog bool, fids map[uint32]struct{}) {
+	if c == nil || len(fids) == 0 {
+		return
+	}
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for key, elem := range shard.items {
+			if _, ok := fids[key.fid]; ok && key.valueLog == valueLog {
+				shard.removeElement(elem)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// stats 缓存的统计信息
+func (c *recordCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	stats := CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		stats.Entries += len(shard.items)
+		stats.Bytes += shard.size
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// removeElement 从分片中删除一项，调用方需要持有分片的锁
+func (s *cacheShard) removeElement(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.items, entry.key)
+	s.size -= entry.size
+}
+
+// cloneLogRecord 复制日志记录，缓存中的记录不能被调用方修改
+func cloneLogRecord(record *data.LogRecord) *data.LogRecord {
+	return &data.LogRecord{
+		Key:       bytes.Clone(record.Key),
+		Value:     bytes.Clone(record.Value),
+		Type:      record.Type,
+		Codec:     record.Codec,
+		Namespace: record.Namespace,
+	}
+}
+
+// CacheStats 日志记录缓存的命中统计，没有开启缓存时都为 0
+func (db *DB) CacheStats() CacheStats {
+	return db.cache.stats()
+}
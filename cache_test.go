@@ -0,0 +1,130 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/23 21:20
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func TestRecordCache(t *testing.T) {
+	// 1.没有开启缓存
+	var nilCache *recordCache
+	assert.Nil(t, newRecordCache(0))
+	nilCache.put(cacheKey{}, &data.LogRecord{})
+	_, ok := nilCache.get(cacheKey{})
+	assert.False(t, ok)
+	assert.Equal(t, CacheStats{}, nilCache.stats())
+
+	// 2.读取的是副本，修改不影响缓存
+	c := newRecordCache(cacheShards * 1024)
+	key := cacheKey{fid: 1, offset: 32}
+	record := &data.LogRecord{Key: []byte("name"), Value: []byte("bitcask"), Namespace: 7}
+	c.put(key, record)
+	record.Value[0] = 'x'
+	res, ok := c.get(key)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("bitcask"), res.Value)
+	assert.Equal(t, uint32(7), res.Namespace)
+	res.Value[0] = 'x'
+	res, ok = c.get(key)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("bitcask"), res.Value)
+	_, ok = c.get(cacheKey{valueLog: true, fid: 1, offset: 32})
+	assert.False(t, ok)
+	stats := c.stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+
+	// 3.超过容量之后淘汰最久没有访问的记录，总大小不超过容量
+	for i := 0; i < 10000; i++ {
+		c.put(cacheKey{fid: 2, offset: int64(i)}, &data.LogRecord{Value: bytes.Repeat([]byte("v"), 100)})
+	}
+	stats = c.stats()
+	assert.True(t, stats.Bytes <= cacheShards*1024)
+	assert.True(t, stats.Entries < 10000)
+	_, ok = c.get(cacheKey{fid: 2, offset: 9999})
+	assert.True(t, ok)
+	_, ok = c.get(cacheKey{fid: 2, offset: 0})
+	assert.False(t, ok)
+
+	// 4.超过分片容量的记录不缓存
+	c.put(cacheKey{fid: 3}, &data.LogRecord{Value: make([]byte, 2048)})
+	_, ok = c.get(cacheKey{fid: 3})
+	assert.False(t, ok)
+
+	// 5.清理指定文件中的记录
+	c.purge(false, map[uint32]struct{}{2: {}})
+	_, ok = c.get(cacheKey{fid: 2, offset: 9999})
+	assert.False(t, ok)
+}
+
+func TestDB_BlockCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-cache")
+	opts.DirPath = dir
+	opts.BlockCacheSize = 1 << 20
+	opts.ValueThreshold = 128
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	bigValue := bytes.Repeat([]byte("v"), 256)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Put(utils.GetTestKey(100), bigValue)
+	assert.Nil(t, err)
+
+	// 1.第一次读取未命中，之后命中
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 100; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+	}
+	stats := db.CacheStats()
+	assert.Equal(t, uint64(100), stats.Misses)
+	assert.Equal(t, uint64(200), stats.Hits)
+
+	// 2.修改返回的 value 不影响缓存
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val[0] = 'x'
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+
+	// 3.值日志中的记录也会被缓存
+	for n := 0; n < 2; n++ {
+		val, err := db.Get(utils.GetTestKey(100))
+		assert.Nil(t, err)
+		assert.Equal(t, bigValue, val)
+	}
+	assert.Equal(t, uint64(102), db.CacheStats().Misses)
+
+	// 4.覆盖写入之后读取到新的值，合并之后清理旧文件的缓存
+	err = db.Put(utils.GetTestKey(1), []byte("new"))
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	err = db.Merge()
+	assert.Nil(t, err)
+	// 合并不会修改值日志，其中的记录仍然在缓存中
+	assert.Equal(t, 1, db.CacheStats().Entries)
+	for i := 2; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
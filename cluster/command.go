@@ -0,0 +1,61 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc 日志中记录的状态机命令
+package cluster
+
+import "encoding/binary"
+
+// commandType 命令的类型
+type commandType = byte
+
+const (
+	// commandNoop 新的 leader 在任期开始时写入的空命令
+	commandNoop commandType = iota
+	// commandPut 写入 key/value
+	commandPut
+	// commandDelete 删除 key
+	commandDelete
+)
+
+// command 状态机命令
+type command struct {
+	Type  commandType
+	Key   []byte
+	Value []byte
+}
+
+// encodeCommand 对命令进行编码
+//
+//	+--------+-------------+------+-------+
+//	|  type  |  key size   |  key | value |
+//	+--------+-------------+------+-------+
+//	 1 字节    变长（最大5）
+func encodeCommand(cmd *command) []byte {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen32+len(cmd.Key)+len(cmd.Value))
+	buf = append(buf, cmd.Type)
+	buf = binary.AppendUvarint(buf, uint64(len(cmd.Key)))
+	buf = append(buf, cmd.Key...)
+	return append(buf, cmd.Value...)
+}
+
+// decodeCommand 对命令进行解码
+func decodeCommand(buf []byte) (*command, error) {
+	if len(buf) == 0 {
+		return nil, ErrInvalidCommand
+	}
+	cmd := &command{Type: buf[0]}
+	if cmd.Type > commandDelete {
+		return nil, ErrInvalidCommand
+	}
+	keySize, n := binary.Uvarint(buf[1:])
+	if n <= 0 || uint64(len(buf)-1-n) < keySize {
+		return nil, ErrInvalidCommand
+	}
+	index := 1 + n
+	cmd.Key = buf[index : index+int(keySize)]
+	if value := buf[index+int(keySize):]; len(value) > 0 {
+		cmd.Value = value
+	}
+	return cmd, nil
+}
@@ -0,0 +1,36 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc
+package cluster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeCommand(t *testing.T) {
+	// 1.正常的编码和解码
+	cmds := []*command{
+		{Type: commandNoop},
+		{Type: commandPut, Key: []byte("name"), Value: []byte("bitcask")},
+		{Type: commandPut, Key: []byte("empty")},
+		{Type: commandDelete, Key: []byte("name")},
+	}
+	for _, cmd := range cmds {
+		decoded, err := decodeCommand(encodeCommand(cmd))
+		assert.Nil(t, err)
+		assert.Equal(t, cmd.Type, decoded.Type)
+		assert.Equal(t, len(cmd.Key), len(decoded.Key))
+		assert.Equal(t, cmd.Value, decoded.Value)
+	}
+
+	// 2.不完整或者未知的命令
+	_, err := decodeCommand(nil)
+	assert.Equal(t, ErrInvalidCommand, err)
+	_, err = decodeCommand([]byte{9})
+	assert.Equal(t, ErrInvalidCommand, err)
+	buf := encodeCommand(&command{Type: commandPut, Key: []byte("name")})
+	_, err = decodeCommand(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidCommand, err)
+}
@@ -0,0 +1,21 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc 集群相关的错误枚举
+package cluster
+
+import "errors"
+
+var (
+	ErrNotLeader        = errors.New("the node is not the leader")
+	ErrLeadershipLost   = errors.New("leadership was lost before the command was applied, the outcome is unknown")
+	ErrUnreachable      = errors.New("the target node is unreachable")
+	ErrNodeClosed       = errors.New("the node is closed")
+	ErrInvalidCommand   = errors.New("invalid command, log entry maybe corrupted")
+	ErrInvalidLogEntry  = errors.New("invalid log entry, raft log maybe corrupted")
+	ErrInvalidPeers     = errors.New("the peers must contain the node itself")
+	ErrInvalidTimeouts  = errors.New("the heartbeat interval must be shorter than the election timeout")
+	ErrSnapshotNotFound = errors.New("the snapshot is not found")
+	ErrInvalidSnapshot  = errors.New("invalid snapshot file name")
+	ErrSnapshotChunk    = errors.New("snapshot chunk does not follow the received data")
+)
@@ -0,0 +1,133 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc 持久化 raft 的状态和日志，直接使用存储引擎保存
+package cluster
+
+import (
+	"encoding/binary"
+	bitcask "kv-projects"
+)
+
+var (
+	stateKey    = []byte("meta/state")    // 当前任期和投票给的节点
+	snapshotKey = []byte("meta/snapshot") // 最近一次快照包含的最后一条日志的位置和任期
+	entryPrefix = []byte("log/")          // 日志记录的前缀，之后是 8 字节大端的位置
+)
+
+// logStore raft 的持久化存储
+type logStore struct {
+	db *bitcask.DB
+}
+
+// openLogStore 打开 dir 中的持久化存储
+// 任期、投票和日志必须在回复其他节点之前落盘，否则崩溃之后可能重复投票或者丢失已经提交的日志，
+// 因此总是同步写入，和状态机数据库的配置无关
+func openLogStore(dir string) (*logStore, error) {
+	opts := bitcask.DefaultOptions
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := bitcask.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{db: db}, nil
+}
+
+// entryKey 日志记录的 key，大端编码保证按照位置排序
+func entryKey(index uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), entryPrefix...), index)
+}
+
+// saveState 保存当前任期和投票给的节点，两者在一次写入中保存
+func (s *logStore) saveState(term uint64, votedFor string) error {
+	buf := binary.BigEndian.AppendUint64(nil, term)
+	return s.db.Put(stateKey, append(buf, votedFor...))
+}
+
+// loadState 读取当前任期和投票给的节点，没有保存过时都为零值
+func (s *logStore) loadState() (uint64, string, error) {
+	buf, err := s.db.Get(stateKey)
+	if err == bitcask.ErrKeyNotFound {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if len(buf) < 8 {
+		return 0, "", ErrInvalidLogEntry
+	}
+	return binary.BigEndian.Uint64(buf), string(buf[8:]), nil
+}
+
+// saveSnapshotMeta 保存最近一次快照包含的最后一条日志的位置和任期
+func (s *logStore) saveSnapshotMeta(index, term uint64) error {
+	buf := binary.BigEndian.AppendUint64(nil, index)
+	return s.db.Put(snapshotKey, binary.BigEndian.AppendUint64(buf, term))
+}
+
+// loadSnapshotMeta 读取最近一次快照的位置和任期，没有快照时都为 0
+func (s *logStore) loadSnapshotMeta() (uint64, uint64, error) {
+	buf, err := s.db.Get(snapshotKey)
+	if err == bitcask.ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(buf) != 16 {
+		return 0, 0, ErrInvalidLogEntry
+	}
+	return binary.BigEndian.Uint64(buf), binary.BigEndian.Uint64(buf[8:]), nil
+}
+
+// appendEntries 保存日志记录，一次追加的所有日志在一个批次中写入，只持久化一次
+func (s *logStore) appendEntries(entries []Entry) error {
+	wb := s.db.NewWriteBatch()
+	for _, entry := range entries {
+		buf := binary.BigEndian.AppendUint64(nil, entry.Term)
+		if err := wb.Put(entryKey(entry.Index), append(buf, entry.Command...)); err != nil {
+			return err
+		}
+	}
+	return wb.Commit()
+}
+
+// loadEntries 从 from 开始依次读取日志记录，直到第一个不存在的位置
+func (s *logStore) loadEntries(from uint64) ([]Entry, error) {
+	var entries []Entry
+	for index := from; ; index++ {
+		buf, err := s.db.Get(entryKey(index))
+		if err == bitcask.ErrKeyNotFound {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) < 8 {
+			return nil, ErrInvalidLogEntry
+		}
+		entries = append(entries, Entry{Index: index, Term: binary.BigEndian.Uint64(buf), Command: buf[8:]})
+	}
+}
+
+// deleteEntries 从后向前删除 [from, to] 之间的日志记录
+// 中途崩溃时剩下的仍然是连续的日志，重启时不会越过空洞读到更早写入的记录
+func (s *logStore) deleteEntries(from, to uint64) error {
+	for index := to; index >= from && index > 0; index-- {
+		if err := s.db.Delete(entryKey(index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compact 合并数据文件，清理快照之前已经删除的日志记录
+func (s *logStore) compact() error {
+	return s.db.Merge()
+}
+
+// close 关闭存储
+func (s *logStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,75 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc
+package cluster
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestLogStore(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-raft-log")
+	defer os.RemoveAll(dir)
+	store, err := openLogStore(dir)
+	assert.Nil(t, err)
+
+	// 1.没有保存过时都是零值
+	term, votedFor, err := store.loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), term)
+	assert.Equal(t, "", votedFor)
+	index, snapshotTerm, err := store.loadSnapshotMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), index)
+	assert.Equal(t, uint64(0), snapshotTerm)
+
+	// 2.保存状态和日志
+	err = store.saveState(3, "node-1")
+	assert.Nil(t, err)
+	var entries []Entry
+	for i := uint64(1); i <= 10; i++ {
+		entries = append(entries, Entry{Index: i, Term: i / 4, Command: []byte{byte(i)}})
+	}
+	fsyncs := store.db.Metrics().Fsync.Count
+	err = store.appendEntries(entries)
+	assert.Nil(t, err)
+	// 一次追加只持久化一次
+	assert.Equal(t, fsyncs+1, store.db.Metrics().Fsync.Count)
+
+	// 3.截断之后只能读到连续的日志
+	err = store.deleteEntries(8, 10)
+	assert.Nil(t, err)
+	loaded, err := store.loadEntries(1)
+	assert.Nil(t, err)
+	assert.Equal(t, entries[:7], loaded)
+
+	// 4.重新打开之后恢复
+	err = store.saveSnapshotMeta(4, 1)
+	assert.Nil(t, err)
+	err = store.close()
+	assert.Nil(t, err)
+	store, err = openLogStore(dir)
+	assert.Nil(t, err)
+	defer store.close()
+	term, votedFor, err = store.loadState()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), term)
+	assert.Equal(t, "node-1", votedFor)
+	index, snapshotTerm, err = store.loadSnapshotMeta()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), index)
+	assert.Equal(t, uint64(1), snapshotTerm)
+	loaded, err = store.loadEntries(5)
+	assert.Nil(t, err)
+	assert.Equal(t, entries[4:7], loaded)
+
+	// 5.合并之后日志仍然可以读取
+	err = store.compact()
+	assert.Nil(t, err)
+	loaded, err = store.loadEntries(5)
+	assert.Nil(t, err)
+	assert.Equal(t, entries[4:7], loaded)
+}
@@ -0,0 +1,908 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc 基于 raft 的复制状态机，使用存储引擎作为状态机，写入经过共识，读取是线性一致的
+package cluster
+
+import (
+	"context"
+	bitcask "kv-projects"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElectionTimeout   = 300 * time.Millisecond
+	defaultHeartbeatInterval = 50 * time.Millisecond
+	defaultSnapshotThreshold = 8192
+	maxEntriesPerAppend      = 256 // 一次复制最多发送的日志数量
+)
+
+// Config 节点的配置
+type Config struct {
+	ID        string          // 节点 id
+	Peers     []string        // 集群中所有节点的 id，包括自己
+	Dir       string          // 数据目录，保存 raft 日志、快照和状态机
+	Transport Transport       // 向其他节点发送 RPC
+	Options   bitcask.Options // 状态机数据库的配置，DirPath 会被替换为数据目录中的子目录，raft 日志总是同步写入
+
+	ElectionTimeout   time.Duration // 选举超时，实际的超时在 [ElectionTimeout, 2*ElectionTimeout) 之间随机
+	HeartbeatInterval time.Duration // leader 发送心跳的间隔，需要小于选举超时
+	SnapshotThreshold uint64        // 快照之后应用的日志超过这个数量时生成新的快照并截断日志
+}
+
+// role 节点的角色
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// proposal 等待应用的写入
+type proposal struct {
+	term uint64
+	done chan error
+}
+
+// Node raft 集群中的一个节点
+// 状态机是一个存储引擎实例，日志提交之后按顺序应用到状态机中。快照是状态机数据库的备份，
+// 快照之前的日志被截断，落后太多的节点通过安装快照追上。
+type Node struct {
+	id        string
+	peers     []string // 除了自己之外的节点
+	cfg       Config
+	transport Transport
+	store     *logStore
+
+	mu               sync.Mutex
+	role             role
+	currentTerm      uint64
+	votedFor         string
+	leaderID         string
+	log              []Entry // log[0] 是快照包含的最后一条日志，只有位置和任期
+	commitIndex      uint64
+	lastApplied      uint64
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	lastAck          map[string]time.Time // leader 最近一次收到节点响应的时间
+	replicating      map[string]bool      // 是否有正在向节点复制的协程
+	pendingReplicate map[string]bool      // 复制期间是否有新的日志需要复制
+	proposals        map[uint64]*proposal
+	electionDeadline time.Time
+	lastContact      time.Time // 最近一次收到 leader 消息的时间
+	lastHeartbeat    time.Time
+	closed           bool
+
+	applyCh chan struct{} // 提交的位置前进时通知应用协程
+	applied notifier      // 应用的位置前进时通知等待的读取
+
+	smMu sync.RWMutex // 保护状态机，安装快照时替换状态机需要写锁
+	sm   *bitcask.DB
+
+	snapMu    sync.Mutex        // 保护正在接收的快照
+	receiving *snapshotReceiver // 正在接收的快照，没有时为 nil
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewNode 打开节点，从数据目录中恢复 raft 的状态，状态机从最近的快照恢复，之后的日志提交之后重新应用
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	if cfg.HeartbeatInterval >= cfg.ElectionTimeout {
+		return nil, ErrInvalidTimeouts
+	}
+	if !slices.Contains(cfg.Peers, cfg.ID) {
+		return nil, ErrInvalidPeers
+	}
+	if err := os.MkdirAll(cfg.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	store, err := openLogStore(filepath.Join(cfg.Dir, "raft"))
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:               cfg.ID,
+		cfg:              cfg,
+		transport:        cfg.Transport,
+		store:            store,
+		nextIndex:        make(map[string]uint64),
+		matchIndex:       make(map[string]uint64),
+		lastAck:          make(map[string]time.Time),
+		replicating:      make(map[string]bool),
+		pendingReplicate: make(map[string]bool),
+		proposals:        make(map[uint64]*proposal),
+		applyCh:          make(chan struct{}, 1),
+		done:             make(chan struct{}),
+	}
+	for _, peer := range cfg.Peers {
+		if peer != cfg.ID {
+			n.peers = append(n.peers, peer)
+		}
+	}
+	if err := n.recover(); err != nil {
+		_ = store.close()
+		return nil, err
+	}
+
+	n.resetElectionTimer()
+	n.wg.Add(2)
+	go n.runTicker()
+	go n.runApplier()
+	return n, nil
+}
+
+// recover 恢复持久化的状态、日志和状态机
+func (n *Node) recover() error {
+	var err error
+	if n.currentTerm, n.votedFor, err = n.store.loadState(); err != nil {
+		return err
+	}
+	snapshotIndex, snapshotTerm, err := n.store.loadSnapshotMeta()
+	if err != nil {
+		return err
+	}
+	entries, err := n.store.loadEntries(snapshotIndex + 1)
+	if err != nil {
+		return err
+	}
+	n.log = append([]Entry{{Index: snapshotIndex, Term: snapshotTerm}}, entries...)
+	n.commitIndex, n.lastApplied = snapshotIndex, snapshotIndex
+	return n.restoreStateMachine(snapshotIndex)
+}
+
+// ID 节点 id
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader 当前已知的 leader，未知时为空
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderID
+}
+
+// IsLeader 节点是否认为自己是 leader
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Term 当前任期
+func (n *Node) Term() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.currentTerm
+}
+
+// Put 通过共识写入 key/value，应用到状态机之后返回，只能在 leader 上调用
+func (n *Node) Put(ctx context.Context, key []byte, value []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	return n.propose(ctx, &command{Type: commandPut, Key: key, Value: value})
+}
+
+// Delete 通过共识删除 key，应用到状态机之后返回，只能在 leader 上调用
+func (n *Node) Delete(ctx context.Context, key []byte) error {
+	if len(key) == 0 {
+		return bitcask.ErrKeyIsEmpty
+	}
+	return n.propose(ctx, &command{Type: commandDelete, Key: key})
+}
+
+// Get 线性一致的读取，只能在 leader 上调用
+// 记录当前的提交位置，通过一轮心跳确认仍然是 leader，等待状态机应用到这个位置之后再读取
+func (n *Node) Get(ctx context.Context, key []byte) ([]byte, error) {
+	readIndex, err := n.readIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.waitApplied(ctx, readIndex); err != nil {
+		return nil, err
+	}
+	n.smMu.RLock()
+	defer n.smMu.RUnlock()
+	return n.sm.Get(key)
+}
+
+// Close 关闭节点，等待中的写入返回 ErrNodeClosed
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.role = follower
+	n.failProposals(ErrNodeClosed)
+	close(n.done)
+	n.mu.Unlock()
+	n.applied.broadcast()
+	n.wg.Wait()
+
+	n.snapMu.Lock()
+	_ = n.abortSnapshotLocked()
+	n.snapMu.Unlock()
+
+	n.smMu.Lock()
+	defer n.smMu.Unlock()
+	if err := n.sm.Close(); err != nil {
+		return err
+	}
+	return n.store.close()
+}
+
+// propose 追加命令到 leader 的日志中并等待应用
+func (n *Node) propose(ctx context.Context, cmd *command) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrNodeClosed
+	}
+	if n.role != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	index, err := n.appendLocked(encodeCommand(cmd))
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	p := &proposal{term: n.currentTerm, done: make(chan error, 1)}
+	n.proposals[index] = p
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	select {
+	case err := <-p.done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.proposals, index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// readIndex 获取线性一致读取的位置
+func (n *Node) readIndex(ctx context.Context) (uint64, error) {
+	for {
+		n.mu.Lock()
+		if n.closed {
+			n.mu.Unlock()
+			return 0, ErrNodeClosed
+		}
+		if n.role != leader {
+			n.mu.Unlock()
+			return 0, ErrNotLeader
+		}
+		// 当前任期的日志提交之前，leader 不知道之前任期的日志提交到了哪里
+		term := n.currentTerm
+		if n.termAt(n.commitIndex) == term {
+			readIndex := n.commitIndex
+			n.mu.Unlock()
+			if !n.confirmLeadership(term) {
+				return 0, ErrNotLeader
+			}
+			return readIndex, nil
+		}
+		wait := n.applied.wait()
+		n.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// confirmLeadership 向所有节点发送一轮心跳，多数节点仍然认可当前任期时返回 true
+func (n *Node) confirmLeadership(term uint64) bool {
+	acks := make(chan bool, len(n.peers))
+	for _, peer := range n.peers {
+		go func(peer string) {
+			acks <- n.replicateTo(peer)
+		}(peer)
+	}
+	count := 1
+	for i := 0; i < len(n.peers) && !n.isQuorum(count); i++ {
+		if <-acks {
+			count++
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.isQuorum(count) && n.role == leader && n.currentTerm == term
+}
+
+// waitApplied 等待状态机应用到 index
+func (n *Node) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		wait := n.applied.wait()
+		n.mu.Lock()
+		lastApplied, closed := n.lastApplied, n.closed
+		n.mu.Unlock()
+		if lastApplied >= index {
+			return nil
+		}
+		if closed {
+			return ErrNodeClosed
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runTicker 驱动选举超时和心跳
+func (n *Node) runTicker() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+
+		n.mu.Lock()
+		now := time.Now()
+		switch {
+		case n.role == leader:
+			// leader 在一个选举超时内没有收到多数节点的响应，说明可能已经被分区，主动退位
+			if !n.hasQuorumContact(now) {
+				_ = n.becomeFollower(n.currentTerm)
+				break
+			}
+			if now.Sub(n.lastHeartbeat) >= n.cfg.HeartbeatInterval {
+				n.lastHeartbeat = now
+				n.broadcastLocked()
+			}
+		case now.After(n.electionDeadline):
+			n.resetElectionTimer()
+			go n.campaign(true)
+		}
+		n.mu.Unlock()
+	}
+}
+
+// hasQuorumContact leader 最近一个选举超时内是否收到了多数节点的响应，调用方需要持有 n.mu
+func (n *Node) hasQuorumContact(now time.Time) bool {
+	count := 1
+	for _, peer := range n.peers {
+		if now.Sub(n.lastAck[peer]) < n.cfg.ElectionTimeout {
+			count++
+		}
+	}
+	return n.isQuorum(count)
+}
+
+// campaign 发起选举。先进行预投票，确认可以赢得选举之后才增加任期，
+// 被分区的节点不会不断增加任期，恢复之后也不会打断正常的 leader
+func (n *Node) campaign(preVote bool) {
+	n.mu.Lock()
+	if n.closed || n.role == leader {
+		n.mu.Unlock()
+		return
+	}
+	term := n.currentTerm + 1
+	if !preVote {
+		n.role = candidate
+		n.currentTerm = term
+		n.votedFor = n.id
+		n.leaderID = ""
+		if err := n.persistState(); err != nil {
+			n.role = follower
+			n.mu.Unlock()
+			return
+		}
+	}
+	req := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+		PreVote:      preVote,
+	}
+	// 统计得到的票数，调用方需要持有 n.mu
+	votes, won := 0, false
+	onVote := func() {
+		votes++
+		if won || !n.isQuorum(votes) {
+			return
+		}
+		won = true
+		if preVote {
+			if !n.closed && n.role != leader && n.currentTerm+1 == term {
+				go n.campaign(false)
+			}
+			return
+		}
+		if n.role == candidate && n.currentTerm == term {
+			n.becomeLeader()
+		}
+	}
+	// 自己的一票，单节点的集群直接赢得选举
+	onVote()
+	n.mu.Unlock()
+
+	for _, peer := range n.peers {
+		go func(peer string) {
+			resp, err := n.transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.currentTerm {
+				_ = n.becomeFollower(resp.Term)
+				return
+			}
+			if resp.VoteGranted {
+				onVote()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader 成为 leader，调用方需要持有 n.mu
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leaderID = n.id
+	now := time.Now()
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.lastAck[peer] = now
+	}
+	// 新的任期先写入一条空的命令，提交之后之前任期的日志也随之提交，线性一致的读取也依赖于此
+	if _, err := n.appendLocked(encodeCommand(&command{Type: commandNoop})); err != nil {
+		_ = n.becomeFollower(n.currentTerm)
+		return
+	}
+	n.lastHeartbeat = now
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+}
+
+// becomeFollower 成为 follower，任期更大时更新任期并清空投票，调用方需要持有 n.mu
+func (n *Node) becomeFollower(term uint64) error {
+	if n.role == leader {
+		n.failProposals(ErrLeadershipLost)
+	}
+	n.role = follower
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.leaderID = ""
+		return n.persistState()
+	}
+	return nil
+}
+
+// failProposals 让所有等待中的写入返回 err，调用方需要持有 n.mu
+func (n *Node) failProposals(err error) {
+	for index, p := range n.proposals {
+		p.done <- err
+		delete(n.proposals, index)
+	}
+}
+
+// HandleRequestVote 处理投票请求
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrNodeClosed
+	}
+
+	resp := &RequestVoteResponse{Term: n.currentTerm}
+	upToDate := req.LastLogTerm > n.lastTerm() || (req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if req.PreVote {
+		// 还能收到 leader 的消息时不支持新的选举
+		resp.VoteGranted = req.Term > n.currentTerm && upToDate && !n.hasLeader()
+		return resp, nil
+	}
+
+	if req.Term < n.currentTerm {
+		return resp, nil
+	}
+	if req.Term > n.currentTerm {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return nil, err
+		}
+		resp.Term = n.currentTerm
+	}
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		if err := n.persistState(); err != nil {
+			return nil, err
+		}
+		n.resetElectionTimer()
+		resp.VoteGranted = true
+	}
+	return resp, nil
+}
+
+// hasLeader 是否仍然有正常的 leader，调用方需要持有 n.mu
+func (n *Node) hasLeader() bool {
+	return n.role == leader || (n.leaderID != "" && time.Since(n.lastContact) < n.cfg.ElectionTimeout)
+}
+
+// HandleAppendEntries 处理复制日志的请求
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrNodeClosed
+	}
+
+	resp := &AppendEntriesResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		return resp, nil
+	}
+	if err := n.followLeader(req.Term, req.LeaderID); err != nil {
+		return nil, err
+	}
+	resp.Term = n.currentTerm
+
+	prevIndex, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	base := n.log[0].Index
+	if prevIndex < base {
+		// 快照之前的日志都已经提交，跳过这部分
+		skip := base - prevIndex
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prevIndex, prevTerm = base, n.log[0].Term
+	}
+	if prevIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if conflictTerm := n.termAt(prevIndex); conflictTerm != prevTerm {
+		// 跳过冲突的整个任期，减少来回的次数
+		index := prevIndex
+		for index > base+1 && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		resp.ConflictIndex = index
+		return resp, nil
+	}
+
+	// 跳过已经存在的日志，从第一条冲突的日志开始截断并追加
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			if err := n.truncateLocked(entry.Index); err != nil {
+				return nil, err
+			}
+		}
+		if err := n.appendEntriesLocked(entries[i:]); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if lastNew := prevIndex + uint64(len(entries)); req.LeaderCommit > n.commitIndex && lastNew > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, lastNew)
+		n.signalApply()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// followLeader 收到当前任期 leader 的消息，调用方需要持有 n.mu
+func (n *Node) followLeader(term uint64, leaderID string) error {
+	if term > n.currentTerm || n.role != follower {
+		if err := n.becomeFollower(term); err != nil {
+			return err
+		}
+	}
+	n.leaderID = leaderID
+	n.lastContact = time.Now()
+	n.resetElectionTimer()
+	return nil
+}
+
+// broadcastLocked 向所有节点复制日志，每个节点最多只有一个复制协程，调用方需要持有 n.mu
+func (n *Node) broadcastLocked() {
+	for _, peer := range n.peers {
+		if n.replicating[peer] {
+			n.pendingReplicate[peer] = true
+			continue
+		}
+		n.replicating[peer] = true
+		n.wg.Add(1)
+		go n.replicateLoop(peer)
+	}
+}
+
+// replicateLoop 向节点复制日志，直到没有需要复制的日志
+func (n *Node) replicateLoop(peer string) {
+	defer n.wg.Done()
+	for {
+		n.replicateTo(peer)
+		n.mu.Lock()
+		if n.pendingReplicate[peer] && n.role == leader {
+			n.pendingReplicate[peer] = false
+			n.mu.Unlock()
+			continue
+		}
+		n.pendingReplicate[peer] = false
+		n.replicating[peer] = false
+		n.mu.Unlock()
+		return
+	}
+}
+
+// replicateTo 向节点发送一次复制日志或者安装快照的请求，节点仍然认可当前任期时返回 true
+func (n *Node) replicateTo(peer string) bool {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return false
+	}
+	term := n.currentTerm
+	next := n.nextIndex[peer]
+	base := n.log[0].Index
+	if next <= base {
+		// 需要的日志已经被快照截断，发送快照
+		snapshotIndex, snapshotTerm := base, n.log[0].Term
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term, snapshotIndex, snapshotTerm)
+	}
+	end := min(n.lastIndex(), next+maxEntriesPerAppend-1)
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      slices.Clone(n.log[next-base : end-base+1]),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	resp, err := n.transport.AppendEntries(peer, req)
+	if err != nil {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.currentTerm {
+		_ = n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != leader || n.currentTerm != term {
+		return false
+	}
+	n.lastAck[peer] = time.Now()
+	if resp.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		n.matchIndex[peer] = max(n.matchIndex[peer], match)
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+		n.advanceCommitLocked()
+		if n.nextIndex[peer] <= n.lastIndex() {
+			n.pendingReplicate[peer] = true
+		}
+	} else {
+		// ConflictIndex 一定小于发送的位置，每次失败都会向前移动
+		if next := max(resp.ConflictIndex, n.matchIndex[peer]+1); next < n.nextIndex[peer] {
+			n.nextIndex[peer] = next
+		}
+		n.pendingReplicate[peer] = true
+	}
+	return true
+}
+
+// advanceCommitLocked 多数节点都已经复制的当前任期的日志可以提交，调用方需要持有 n.mu
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		// 之前任期的日志只能随着当前任期的日志一起提交
+		if n.termAt(index) != n.currentTerm {
+			return
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if n.isQuorum(count) {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+// runApplier 将提交的日志按顺序应用到状态机
+func (n *Node) runApplier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.applyCh:
+		case <-n.done:
+			return
+		}
+		n.applyCommitted()
+	}
+}
+
+// applyCommitted 应用所有已经提交但还没有应用的日志，应用之后根据配置生成快照
+func (n *Node) applyCommitted() {
+	n.smMu.RLock()
+	defer n.smMu.RUnlock()
+
+	n.mu.Lock()
+	base := n.log[0].Index
+	start, end := n.lastApplied+1, n.commitIndex
+	if start > end {
+		n.mu.Unlock()
+		return
+	}
+	entries := slices.Clone(n.log[start-base : end-base+1])
+	n.mu.Unlock()
+
+	results := make([]error, len(entries))
+	for i, entry := range entries {
+		results[i] = n.applyEntry(entry)
+	}
+
+	n.mu.Lock()
+	n.lastApplied = end
+	for i, entry := range entries {
+		p := n.proposals[entry.Index]
+		if p == nil {
+			continue
+		}
+		delete(n.proposals, entry.Index)
+		// 同一个位置的日志被其他 leader 覆盖了
+		if p.term != entry.Term {
+			p.done <- ErrLeadershipLost
+		} else {
+			p.done <- results[i]
+		}
+	}
+	snapshot := n.lastApplied-n.log[0].Index >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+	n.applied.broadcast()
+
+	if snapshot {
+		_ = n.takeSnapshot()
+	}
+}
+
+// applyEntry 将一条日志中的命令应用到状态机，调用方需要持有 n.smMu
+func (n *Node) applyEntry(entry Entry) error {
+	cmd, err := decodeCommand(entry.Command)
+	if err != nil {
+		return err
+	}
+	switch cmd.Type {
+	case commandPut:
+		return n.sm.Put(cmd.Key, cmd.Value)
+	case commandDelete:
+		return n.sm.Delete(cmd.Key)
+	}
+	return nil
+}
+
+// appendLocked leader 追加一条当前任期的日志，返回日志的位置，调用方需要持有 n.mu
+func (n *Node) appendLocked(cmd []byte) (uint64, error) {
+	entry := Entry{Index: n.lastIndex() + 1, Term: n.currentTerm, Command: cmd}
+	if err := n.appendEntriesLocked([]Entry{entry}); err != nil {
+		return 0, err
+	}
+	return entry.Index, nil
+}
+
+// appendEntriesLocked 持久化并追加日志，调用方需要持有 n.mu
+func (n *Node) appendEntriesLocked(entries []Entry) error {
+	if err := n.store.appendEntries(entries); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	return nil
+}
+
+// truncateLocked 删除 from 及之后的日志，调用方需要持有 n.mu
+func (n *Node) truncateLocked(from uint64) error {
+	if err := n.store.deleteEntries(from, n.lastIndex()); err != nil {
+		return err
+	}
+	n.log = n.log[:from-n.log[0].Index]
+	return nil
+}
+
+// persistState 持久化任期和投票，调用方需要持有 n.mu
+func (n *Node) persistState() error {
+	return n.store.saveState(n.currentTerm, n.votedFor)
+}
+
+// resetElectionTimer 重新随机选举超时，调用方需要持有 n.mu
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + rand.N(n.cfg.ElectionTimeout)
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// signalApply 通知应用协程
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// isQuorum count 个节点是否构成多数
+func (n *Node) isQuorum(count int) bool {
+	return count > (len(n.peers)+1)/2
+}
+
+// lastIndex 最后一条日志的位置，调用方需要持有 n.mu
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+// lastTerm 最后一条日志的任期，调用方需要持有 n.mu
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// termAt 指定位置的日志的任期，位置不能在快照之前，调用方需要持有 n.mu
+func (n *Node) termAt(index uint64) uint64 {
+	return n.log[index-n.log[0].Index].Term
+}
+
+// notifier 通知等待者某个位置已经前进
+type notifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait 获取下一次通知时会被关闭的 channel
+func (nf *notifier) wait() <-chan struct{} {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+	if nf.ch == nil {
+		nf.ch = make(chan struct{})
+	}
+	return nf.ch
+}
+
+// broadcast 唤醒所有的等待者
+func (nf *notifier) broadcast() {
+	nf.mu.Lock()
+	defer nf.mu.Unlock()
+	if nf.ch != nil {
+		close(nf.ch)
+		nf.ch = nil
+	}
+}
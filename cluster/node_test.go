@@ -0,0 +1,354 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	bitcask "kv-projects"
+	"kv-projects/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCluster 进程内网络上的测试集群
+type testCluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	nodes   map[string]*Node
+	configs map[string]Config
+}
+
+// newTestCluster 新建 size 个节点的集群
+func newTestCluster(t *testing.T, size int, snapshotThreshold uint64) *testCluster {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cluster")
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	c := &testCluster{t: t, network: NewInmemNetwork(), nodes: make(map[string]*Node), configs: make(map[string]Config)}
+	var peers []string
+	for i := 0; i < size; i++ {
+		peers = append(peers, fmt.Sprintf("node-%d", i))
+	}
+	for _, id := range peers {
+		c.configs[id] = Config{
+			ID:                id,
+			Peers:             peers,
+			Dir:               filepath.Join(dir, id),
+			Transport:         c.network.Transport(id),
+			Options:           bitcask.DefaultOptions,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+		}
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			_ = node.Close()
+		}
+	})
+	return c
+}
+
+// start 打开节点并注册到网络中
+func (c *testCluster) start(id string) *Node {
+	node, err := NewNode(c.configs[id])
+	assert.Nil(c.t, err)
+	c.network.Register(node)
+	c.nodes[id] = node
+	return node
+}
+
+// waitLeader 等待 ids 中的节点选出唯一的 leader
+func (c *testCluster) waitLeader(ids ...string) *Node {
+	if len(ids) == 0 {
+		for id := range c.nodes {
+			ids = append(ids, id)
+		}
+	}
+	var leaderNode *Node
+	assert.Eventually(c.t, func() bool {
+		leaderNode = nil
+		for _, id := range ids {
+			if node := c.nodes[id]; node.IsLeader() {
+				if leaderNode != nil {
+					return false
+				}
+				leaderNode = node
+			}
+		}
+		return leaderNode != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	return leaderNode
+}
+
+// others ids 之外的节点
+func (c *testCluster) others(ids ...string) []string {
+	var others []string
+	for id := range c.nodes {
+		excluded := false
+		for _, other := range ids {
+			excluded = excluded || id == other
+		}
+		if !excluded {
+			others = append(others, id)
+		}
+	}
+	return others
+}
+
+// waitValue 等待节点的状态机中 key 的值为 value，value 为 nil 表示 key 不存在
+func waitValue(t *testing.T, node *Node, key []byte, value []byte) {
+	assert.Eventually(t, func() bool {
+		node.smMu.RLock()
+		defer node.smMu.RUnlock()
+		val, err := node.sm.Get(key)
+		if value == nil {
+			return err == bitcask.ErrKeyNotFound
+		}
+		return err == nil && string(val) == string(value)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func testContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 5*time.Second)
+}
+
+func TestNewNode(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cluster-node")
+	defer os.RemoveAll(dir)
+
+	// 1.节点必须在集群中
+	_, err := NewNode(Config{ID: "a", Peers: []string{"b"}, Dir: dir, Options: bitcask.DefaultOptions})
+	assert.Equal(t, ErrInvalidPeers, err)
+
+	// 2.心跳间隔必须小于选举超时
+	_, err = NewNode(Config{ID: "a", Peers: []string{"a"}, Dir: dir, Options: bitcask.DefaultOptions,
+		ElectionTimeout: time.Millisecond, HeartbeatInterval: time.Second})
+	assert.Equal(t, ErrInvalidTimeouts, err)
+}
+
+func TestNode_SingleNode(t *testing.T) {
+	c := newTestCluster(t, 1, 0)
+	node := c.waitLeader()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	// 1.单节点的集群自己就是多数
+	err := node.Put(ctx, []byte("name"), []byte("bitcask"))
+	assert.Nil(t, err)
+	val, err := node.Get(ctx, []byte("name"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask"), val)
+
+	// 2.删除
+	err = node.Delete(ctx, []byte("name"))
+	assert.Nil(t, err)
+	_, err = node.Get(ctx, []byte("name"))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	err = node.Put(ctx, nil, []byte("value"))
+	assert.Equal(t, bitcask.ErrKeyIsEmpty, err)
+}
+
+func TestNode_Replication(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leaderNode := c.waitLeader()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	// 1.所有节点认可同一个 leader
+	assert.Eventually(t, func() bool {
+		for _, node := range c.nodes {
+			if node.Leader() != leaderNode.ID() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 2.写入经过共识之后复制到所有节点
+	for i := 0; i < 100; i++ {
+		err := leaderNode.Put(ctx, utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err := leaderNode.Delete(ctx, utils.GetTestKey(0))
+	assert.Nil(t, err)
+	val, err := leaderNode.Get(ctx, utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(99), val)
+	for _, node := range c.nodes {
+		waitValue(t, node, utils.GetTestKey(99), utils.GetTestKey(99))
+		waitValue(t, node, utils.GetTestKey(0), nil)
+	}
+
+	// 3.follower 不能写入，也不能线性一致地读取
+	follower := c.nodes[c.others(leaderNode.ID())[0]]
+	err = follower.Put(ctx, []byte("key"), []byte("value"))
+	assert.Equal(t, ErrNotLeader, err)
+	_, err = follower.Get(ctx, []byte("key"))
+	assert.Equal(t, ErrNotLeader, err)
+}
+
+func TestNode_Partition(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	oldLeader := c.waitLeader()
+	ctx, cancel := testContext()
+	defer cancel()
+	err := oldLeader.Put(ctx, []byte("key"), []byte("v1"))
+	assert.Nil(t, err)
+
+	// 1.leader 被分区之后，多数派选出新的 leader
+	majority := c.others(oldLeader.ID())
+	c.network.Partition([]string{oldLeader.ID()}, majority)
+	newLeader := c.waitLeader(majority...)
+	assert.True(t, newLeader.Term() > oldLeader.Term())
+
+	// 2.少数派中的旧 leader 不能提交写入，也不能线性一致地读取
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	err = oldLeader.Put(shortCtx, []byte("key"), []byte("lost"))
+	shortCancel()
+	assert.NotNil(t, err)
+	_, err = oldLeader.Get(ctx, []byte("key"))
+	assert.Equal(t, ErrNotLeader, err)
+	assert.Eventually(t, func() bool { return !oldLeader.IsLeader() }, 5*time.Second, 10*time.Millisecond)
+
+	// 3.多数派继续写入
+	err = newLeader.Put(ctx, []byte("key"), []byte("v2"))
+	assert.Nil(t, err)
+
+	// 4.恢复之后旧 leader 丢弃没有提交的写入，追上新的 leader，预投票保证不会打断新的 leader
+	c.network.Heal()
+	waitValue(t, oldLeader, []byte("key"), []byte("v2"))
+	assert.True(t, newLeader.IsLeader())
+	val, err := newLeader.Get(ctx, []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+}
+
+func TestNode_Snapshot(t *testing.T) {
+	// 快照分成很多块发送，在所有节点关闭之后恢复
+	chunkSize := snapshotChunkSize
+	snapshotChunkSize = 256
+	t.Cleanup(func() { snapshotChunkSize = chunkSize })
+	c := newTestCluster(t, 3, 16)
+	leaderNode := c.waitLeader()
+	ctx, cancel := testContext()
+	defer cancel()
+
+	// 1.一个 follower 被分区期间，leader 生成快照并截断日志
+	lagging := c.others(leaderNode.ID())[0]
+	c.network.Partition([]string{lagging}, c.others(lagging))
+	for i := 0; i < 100; i++ {
+		err := leaderNode.Put(ctx, utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	leaderNode.mu.Lock()
+	snapshotIndex := leaderNode.log[0].Index
+	leaderNode.mu.Unlock()
+	assert.True(t, snapshotIndex > 0)
+	_, err := os.Stat(leaderNode.snapshotDir(snapshotIndex))
+	assert.Nil(t, err)
+
+	// 2.恢复之后落后的节点通过安装快照追上
+	c.network.Heal()
+	for i := 0; i < 100; i++ {
+		waitValue(t, c.nodes[lagging], utils.GetTestKey(i), utils.GetTestKey(i))
+	}
+	c.nodes[lagging].mu.Lock()
+	assert.True(t, c.nodes[lagging].log[0].Index > 0)
+	c.nodes[lagging].mu.Unlock()
+
+	// 3.安装快照之后继续复制新的日志
+	err = leaderNode.Put(ctx, []byte("after"), []byte("snapshot"))
+	assert.Nil(t, err)
+	waitValue(t, c.nodes[lagging], []byte("after"), []byte("snapshot"))
+}
+
+func TestNode_ReceiveSnapshotChunk(t *testing.T) {
+	c := newTestCluster(t, 1, 16)
+	node := c.nodes["node-0"]
+	chunk := func(file string, offset int64, data string, done bool) *InstallSnapshotRequest {
+		return &InstallSnapshotRequest{LastIncludedIndex: 10, File: file, Offset: offset, Data: []byte(data), Done: done}
+	}
+
+	// 1.不允许目录之外的文件
+	_, err := node.receiveSnapshotChunk(chunk("../a", 0, "x", false))
+	assert.Equal(t, ErrInvalidSnapshot, err)
+	_, err = node.receiveSnapshotChunk(chunk("..", 0, "x", false))
+	assert.Equal(t, ErrInvalidSnapshot, err)
+
+	// 2.块需要紧接着上一块
+	_, err = node.receiveSnapshotChunk(chunk("a", 3, "x", false))
+	assert.Equal(t, ErrSnapshotChunk, err)
+	done, err := node.receiveSnapshotChunk(chunk("a", 0, "abc", false))
+	assert.Nil(t, err)
+	assert.False(t, done)
+	_, err = node.receiveSnapshotChunk(chunk("a", 4, "x", false))
+	assert.Equal(t, ErrSnapshotChunk, err)
+	_, err = node.receiveSnapshotChunk(chunk("b", 3, "x", false))
+	assert.Equal(t, ErrSnapshotChunk, err)
+
+	// 3.重新从头发送时覆盖之前收到的数据
+	_, err = node.receiveSnapshotChunk(chunk("a", 0, "ab", false))
+	assert.Nil(t, err)
+	_, err = node.receiveSnapshotChunk(chunk("a", 2, "cd", false))
+	assert.Nil(t, err)
+	done, err = node.receiveSnapshotChunk(chunk("b", 0, "", true))
+	assert.Nil(t, err)
+	assert.True(t, done)
+	tmpDir := node.snapshotDir(10) + ".tmp"
+	buf, err := os.ReadFile(filepath.Join(tmpDir, "a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcd"), buf)
+	buf, err = os.ReadFile(filepath.Join(tmpDir, "b"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(buf))
+}
+
+func TestNode_Restart(t *testing.T) {
+	c := newTestCluster(t, 3, 32)
+	leaderNode := c.waitLeader()
+	ctx, cancel := testContext()
+	defer cancel()
+	for i := 0; i < 100; i++ {
+		err := leaderNode.Put(ctx, utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 1.重启所有节点，从快照和日志中恢复
+	var terms []uint64
+	for _, node := range c.nodes {
+		waitValue(t, node, utils.GetTestKey(99), utils.GetTestKey(99))
+	}
+	for id, node := range c.nodes {
+		terms = append(terms, node.Term())
+		assert.Nil(t, node.Close())
+		delete(c.nodes, id)
+	}
+	for id := range c.configs {
+		c.start(id)
+	}
+	leaderNode = c.waitLeader()
+	for _, term := range terms {
+		assert.True(t, leaderNode.Term() > term)
+	}
+
+	// 2.新的 leader 提交日志之后，所有节点重新应用快照之后的日志
+	for i := 0; i < 100; i++ {
+		val, err := leaderNode.Get(ctx, utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	err := leaderNode.Put(ctx, []byte("after"), []byte("restart"))
+	assert.Nil(t, err)
+	for _, node := range c.nodes {
+		waitValue(t, node, utils.GetTestKey(50), utils.GetTestKey(50))
+		waitValue(t, node, []byte("after"), []byte("restart"))
+	}
+}
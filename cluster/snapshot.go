@@ -0,0 +1,410 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc 快照，通过状态机数据库的备份生成，用于截断日志和让落后的节点追上
+package cluster
+
+import (
+	"fmt"
+	"io"
+	bitcask "kv-projects"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotChunkSize 发送快照时每一块的最大长度
+var snapshotChunkSize = 1 << 20
+
+// snapshotDir 包含到 index 为止的日志的快照目录
+func (n *Node) snapshotDir(index uint64) string {
+	return filepath.Join(n.cfg.Dir, fmt.Sprintf("snapshot-%020d", index))
+}
+
+// stateDir 状态机数据库的目录
+func (n *Node) stateDir() string {
+	return filepath.Join(n.cfg.Dir, "state")
+}
+
+// restoreStateMachine 从快照恢复状态机，index 为 0 表示没有快照，从空的状态机开始
+// 状态机中可能已经应用了快照之后的日志，因此总是丢弃之后重新从快照复制
+func (n *Node) restoreStateMachine(index uint64) error {
+	stateDir := n.stateDir()
+	if err := os.RemoveAll(stateDir); err != nil {
+		return err
+	}
+	if index > 0 {
+		if err := copyDir(n.snapshotDir(index), stateDir); err != nil {
+			return err
+		}
+	}
+	opts := n.cfg.Options
+	opts.DirPath = stateDir
+	sm, err := bitcask.Open(opts)
+	if err != nil {
+		return err
+	}
+	n.sm = sm
+	return nil
+}
+
+// takeSnapshot 备份状态机生成快照，并截断快照之前的日志，只在应用协程中调用，调用方需要持有 n.smMu 的读锁
+func (n *Node) takeSnapshot() error {
+	n.mu.Lock()
+	index, oldIndex := n.lastApplied, n.log[0].Index
+	term := n.termAt(index)
+	n.mu.Unlock()
+
+	// 先写到临时目录，完整之后再重命名，崩溃时不会留下不完整的快照
+	dir := n.snapshotDir(index)
+	tmpDir := dir + ".tmp"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := n.sm.Backup(tmpDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if err := n.store.saveSnapshotMeta(index, term); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.log = append([]Entry{{Index: index, Term: term}}, n.log[index-oldIndex+1:]...)
+	n.mu.Unlock()
+
+	// 快照已经持久化，之前的日志和快照都不再需要
+	if err := n.store.deleteEntries(oldIndex+1, index); err != nil {
+		return err
+	}
+	if oldIndex > 0 {
+		if err := os.RemoveAll(n.snapshotDir(oldIndex)); err != nil {
+			return err
+		}
+	}
+	return n.store.compact()
+}
+
+// sendSnapshot 向节点分块发送快照，节点仍然认可当前任期时返回 true
+// 快照目录中的文件生成之后不会再修改，发送期间快照可能被更新的快照替换并删除，
+// 已经打开的文件仍然可以完整地读取，还没有打开的文件打开失败，下一次复制时重新发送
+func (n *Node) sendSnapshot(peer string, term, index, snapshotTerm uint64) bool {
+	dir := n.snapshotDir(index)
+	names, err := snapshotFiles(dir)
+	if err != nil {
+		return false
+	}
+	send := func(name string, offset int64, data []byte, done bool) bool {
+		resp, err := n.transport.InstallSnapshot(peer, &InstallSnapshotRequest{
+			Term:              term,
+			LeaderID:          n.id,
+			LastIncludedIndex: index,
+			LastIncludedTerm:  snapshotTerm,
+			File:              name,
+			Offset:            offset,
+			Data:              data,
+			Done:              done,
+		})
+		if err != nil {
+			return false
+		}
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if resp.Term > n.currentTerm {
+			_ = n.becomeFollower(resp.Term)
+			return false
+		}
+		if n.role != leader || n.currentTerm != term {
+			return false
+		}
+		n.lastAck[peer] = time.Now()
+		return true
+	}
+	// 空的快照只发送一个结束的请求
+	if len(names) == 0 && !send("", 0, nil, true) {
+		return false
+	}
+	for i, name := range names {
+		if !n.sendSnapshotFile(filepath.Join(dir, name), i == len(names)-1, func(offset int64, data []byte, done bool) bool {
+			return send(name, offset, data, done)
+		}) {
+			return false
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != leader || n.currentTerm != term {
+		return false
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], index)
+	n.nextIndex[peer] = max(n.nextIndex[peer], index+1)
+	n.advanceCommitLocked()
+	n.pendingReplicate[peer] = true
+	return true
+}
+
+// sendSnapshotFile 按块读取快照中的一个文件并发送，内存中最多只有一个块，last 表示是否是快照的最后一个文件
+func (n *Node) sendSnapshotFile(path string, last bool, send func(offset int64, data []byte, done bool) bool) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	// 空文件也需要发送一次，接收方才会创建这个文件
+	size := info.Size()
+	for offset := int64(0); ; {
+		data := make([]byte, min(int64(snapshotChunkSize), size-offset))
+		if _, err := io.ReadFull(file, data); err != nil {
+			return false
+		}
+		next := offset + int64(len(data))
+		if !send(offset, data, last && next == size) {
+			return false
+		}
+		if offset = next; offset >= size {
+			return true
+		}
+	}
+}
+
+// snapshotReceiver 正在接收的快照，块按照顺序写入到临时目录中
+type snapshotReceiver struct {
+	index  uint64
+	name   string   // 正在写入的文件名
+	file   *os.File // 正在写入的文件
+	offset int64    // 下一块在文件中的位置
+}
+
+// closeFile 持久化并关闭正在写入的文件
+func (r *snapshotReceiver) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	file := r.file
+	r.file = nil
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// receiveSnapshotChunk 将一块快照写入到临时目录中，收到最后一块时返回 true
+// 偏移为 0 的块新建（或者截断）文件，leader 重新发送快照时从第一个文件开始覆盖之前收到的数据，
+// 其他的块需要紧接着上一块，否则返回 ErrSnapshotChunk，leader 在下一次复制时重新发送
+func (n *Node) receiveSnapshotChunk(req *InstallSnapshotRequest) (bool, error) {
+	n.snapMu.Lock()
+	defer n.snapMu.Unlock()
+	// 文件名来自其他节点，只允许目录中的文件，空的文件名只出现在空的快照中
+	if req.File != "" && (req.File != filepath.Base(req.File) || req.File == "." || req.File == "..") {
+		return false, ErrInvalidSnapshot
+	}
+	tmpDir := n.snapshotDir(req.LastIncludedIndex) + ".tmp"
+	r := n.receiving
+	if r == nil || r.index != req.LastIncludedIndex {
+		if req.Offset != 0 {
+			return false, ErrSnapshotChunk
+		}
+		if err := n.abortSnapshotLocked(); err != nil {
+			return false, err
+		}
+		if err := os.RemoveAll(tmpDir); err != nil {
+			return false, err
+		}
+		if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+			return false, err
+		}
+		r = &snapshotReceiver{index: req.LastIncludedIndex}
+		n.receiving = r
+	}
+
+	if req.File != "" {
+		if req.Offset == 0 {
+			if err := r.closeFile(); err != nil {
+				return false, err
+			}
+			file, err := os.Create(filepath.Join(tmpDir, req.File))
+			if err != nil {
+				return false, err
+			}
+			r.name, r.file, r.offset = req.File, file, 0
+		} else if r.file == nil || req.File != r.name || req.Offset != r.offset {
+			return false, ErrSnapshotChunk
+		}
+		if _, err := r.file.Write(req.Data); err != nil {
+			return false, err
+		}
+		r.offset += int64(len(req.Data))
+	}
+	if !req.Done {
+		return false, nil
+	}
+	n.receiving = nil
+	return true, r.closeFile()
+}
+
+// abortSnapshotLocked 放弃正在接收的快照，调用方需要持有 n.snapMu
+func (n *Node) abortSnapshotLocked() error {
+	r := n.receiving
+	if r == nil {
+		return nil
+	}
+	n.receiving = nil
+	if r.file != nil {
+		_ = r.file.Close()
+	}
+	return os.RemoveAll(n.snapshotDir(r.index) + ".tmp")
+}
+
+// HandleInstallSnapshot 处理安装快照的请求，收到所有的块之后用快照替换状态机，并丢弃快照包含的日志
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil, ErrNodeClosed
+	}
+	resp := &InstallSnapshotResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.followLeader(req.Term, req.LeaderID); err != nil {
+		n.mu.Unlock()
+		return nil, err
+	}
+	resp.Term = n.currentTerm
+	// 已经应用了快照中的所有日志
+	if req.LastIncludedIndex <= n.lastApplied {
+		n.mu.Unlock()
+		return resp, nil
+	}
+	n.mu.Unlock()
+
+	done, err := n.receiveSnapshotChunk(req)
+	if err != nil || !done {
+		return resp, err
+	}
+
+	// 安装期间没有日志被应用，也没有读取，同时只有一个安装
+	n.smMu.Lock()
+	defer n.smMu.Unlock()
+	n.mu.Lock()
+	installed := n.closed || req.LastIncludedIndex <= n.lastApplied
+	n.mu.Unlock()
+	dir := n.snapshotDir(req.LastIncludedIndex)
+	tmpDir := dir + ".tmp"
+	if installed {
+		return resp, os.RemoveAll(tmpDir)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// 保留快照之后和 leader 一致的日志，否则丢弃所有的日志
+	oldIndex, lastIndex := n.log[0].Index, n.lastIndex()
+	snapshot := Entry{Index: req.LastIncludedIndex, Term: req.LastIncludedTerm}
+	if req.LastIncludedIndex <= lastIndex && n.termAt(req.LastIncludedIndex) == req.LastIncludedTerm {
+		n.log = append([]Entry{snapshot}, n.log[req.LastIncludedIndex-oldIndex+1:]...)
+	} else {
+		if err := n.store.deleteEntries(req.LastIncludedIndex+1, lastIndex); err != nil {
+			return nil, err
+		}
+		n.log = []Entry{snapshot}
+	}
+	if err := n.store.saveSnapshotMeta(req.LastIncludedIndex, req.LastIncludedTerm); err != nil {
+		return nil, err
+	}
+	if err := n.store.deleteEntries(oldIndex+1, min(req.LastIncludedIndex, lastIndex)); err != nil {
+		return nil, err
+	}
+
+	if err := n.sm.Close(); err != nil {
+		return nil, err
+	}
+	if err := n.restoreStateMachine(req.LastIncludedIndex); err != nil {
+		return nil, err
+	}
+	n.commitIndex = max(n.commitIndex, req.LastIncludedIndex)
+	n.lastApplied = req.LastIncludedIndex
+	n.applied.broadcast()
+	if oldIndex > 0 {
+		if err := os.RemoveAll(n.snapshotDir(oldIndex)); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// snapshotFiles 快照目录中所有文件的名称，按照名称排序
+func snapshotFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// copyDir 复制目录中的所有文件并持久化，目标目录已经存在时先删除
+func copyDir(src, dst string) error {
+	names, err := snapshotFiles(src)
+	if os.IsNotExist(err) {
+		return ErrSnapshotNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile 复制一个文件并持久化
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,163 @@
+// Package cluster
+// @Author NuyoahCh
+// @Date 2025/2/28 21:00
+// @Desc 节点之间的 RPC 和进程内的传输实现，可以模拟网络分区
+package cluster
+
+import "sync"
+
+// Entry raft 日志中的一条记录
+type Entry struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+}
+
+// RequestVoteRequest 请求投票，PreVote 为 true 时只是询问是否会投票，不改变接收者的状态
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	PreVote      bool
+}
+
+// RequestVoteResponse 投票的结果
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest leader 复制日志，没有日志时作为心跳
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesResponse 复制日志的结果，失败时 ConflictIndex 是 leader 下一次应该发送的位置
+type AppendEntriesResponse struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest 需要的日志已经被快照截断时，leader 分块发送快照
+// 快照目录中的文件（即状态机数据库的备份）按照文件名的顺序依次发送，每个请求是文件 File 中从 Offset 开始的 Data，
+// Done 表示这是快照的最后一块，接收方收到之后安装快照
+type InstallSnapshotRequest struct {
+	Term              uint64
+	LeaderID          string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	File              string
+	Offset            int64
+	Data              []byte
+	Done              bool
+}
+
+// InstallSnapshotResponse 安装快照的结果
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Transport 向其他节点发送 RPC，接收方通过 Node 的 Handle 方法处理
+type Transport interface {
+	RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// InmemNetwork 进程内的网络，RPC 直接调用目标节点的处理方法，用于测试
+// 通过 Partition 把节点划分到不同的分区，不同分区之间的 RPC 返回 ErrUnreachable
+type InmemNetwork struct {
+	mu     sync.RWMutex
+	nodes  map[string]*Node
+	groups map[string]int // 节点所在的分区，为 nil 表示没有分区
+}
+
+// NewInmemNetwork 新建进程内的网络
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{nodes: make(map[string]*Node)}
+}
+
+// Transport 获取节点 id 使用的传输
+func (nw *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{network: nw, from: id}
+}
+
+// Register 注册节点，重新打开的节点注册之后替换之前的节点
+func (nw *InmemNetwork) Register(node *Node) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[node.ID()] = node
+}
+
+// Partition 将节点划分为多个分区，只有同一个分区中的节点可以通信，没有列出的节点和所有节点都不能通信
+func (nw *InmemNetwork) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, id := range group {
+			nw.groups[id] = i + 1
+		}
+	}
+}
+
+// Heal 恢复所有节点之间的通信
+func (nw *InmemNetwork) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.groups = nil
+}
+
+// route 找到可以从 from 访问的目标节点
+func (nw *InmemNetwork) route(from, to string) (*Node, error) {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	node := nw.nodes[to]
+	if node == nil {
+		return nil, ErrUnreachable
+	}
+	if nw.groups != nil {
+		group, ok := nw.groups[from]
+		if !ok || group != nw.groups[to] {
+			return nil, ErrUnreachable
+		}
+	}
+	return node, nil
+}
+
+// inmemTransport 一个节点在进程内网络中的传输
+type inmemTransport struct {
+	network *InmemNetwork
+	from    string
+}
+
+func (t *inmemTransport) RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	node, err := t.network.route(t.from, target)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleRequestVote(req)
+}
+
+func (t *inmemTransport) AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	node, err := t.network.route(t.from, target)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleAppendEntries(req)
+}
+
+func (t *inmemTransport) InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	node, err := t.network.route(t.from, target)
+	if err != nil {
+		return nil, err
+	}
+	return node.HandleInstallSnapshot(req)
+}
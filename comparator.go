@@ -0,0 +1,88 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/9 20:40
+// @Desc 在数据目录中记录比较器的名称，防止使用不同的比较器打开同一个数据库
+package kv_projects
+
+import (
+	"errors"
+	"kv-projects/index"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// comparatorFileName 数据目录中记录比较器名称的文件
+const comparatorFileName = "COMPARATOR"
+
+// checkComparator 检查数据目录中记录的比较器和配置的比较器是否一致，目录中还没有记录时写入配置的比较器
+// 没有记录但是已经有数据文件的目录是在支持比较器之前创建的，其中的 key 按照字节序组织
+func (db *DB) checkComparator() error {
+	name := db.options.Comparator.Name()
+	content, err := os.ReadFile(filepath.Join(db.options.DirPath, comparatorFileName))
+	if err == nil {
+		if strings.TrimSpace(string(content)) != name {
+			return ErrComparatorMismatch
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if len(db.fileIds) > 0 && name != index.BytewiseComparator.Name() {
+		return ErrComparatorMismatch
+	}
+	// 从节点同样需要记录，之后复制过来的数据文件按照这个比较器组织
+	return writeComparatorFile(db.options.DirPath, name)
+}
+
+// writeComparatorFile 写入比较器的名称，先写临时文件再重命名，崩溃时不会留下不完整的记录
+func writeComparatorFile(dirPath, name string) error {
+	path := filepath.Join(dirPath, comparatorFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(name + "\n"); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// 持久化目录项，保证重命名在崩溃之后仍然有效
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// bytewise 是否按照字节序比较 key，只有这时前缀相同的 key 在索引中是连续的
+func (db *DB) bytewise() bool {
+	return isBytewise(db.options.Comparator)
+}
+
+// checkIndexComparator 检查索引类型和比较器是否匹配
+// 分片索引按照 key 的字节计算分片，比较结果为 0 的不同 key 可能在不同的分片上，只能按照字节序比较
+func checkIndexComparator(typ IndexerType, cmp index.Comparator) error {
+	if typ == ShardedBTree && !isBytewise(cmp) {
+		return errors.New("sharded index requires the bytewise comparator")
+	}
+	return nil
+}
+
+// isBytewise 比较器是否按照字节序比较，nil 表示默认的字节序
+// 只有这时比较结果为 0 的 key 的字节一定相同，按照字节计算哈希的结构（布隆过滤器、分片索引）才能正确地找到 key
+func isBytewise(cmp index.Comparator) bool {
+	return cmp == nil || cmp.Name() == index.BytewiseComparator.Name()
+}
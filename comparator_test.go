@@ -0,0 +1,167 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/9 20:40
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reverseComparator 和字节序相反的比较器
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string { return "reverse" }
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+// caseInsensitiveComparator 不区分大小写的比较器，字节不同的 key 可能相等
+type caseInsensitiveComparator struct{}
+
+func (caseInsensitiveComparator) Name() string { return "case-insensitive" }
+
+func (caseInsensitiveComparator) Compare(a, b []byte) int {
+	return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+}
+
+// iteratorKeys 按照迭代器的顺序取出所有的 key
+func iteratorKeys(iter *Iterator) []string {
+	defer iter.Close()
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return keys
+}
+
+func TestDB_Comparator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-comparator")
+	opts.DirPath = dir
+	opts.Comparator = reverseComparator{}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"b", "a", "d", "c", "e"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("value")))
+	}
+
+	// 1.迭代器按照比较器的顺序遍历
+	assert.Equal(t, []string{"e", "d", "c", "b", "a"}, iteratorKeys(db.NewIterator(DefaultIteratorOptions)))
+
+	// 2.范围删除按照比较器的顺序，前缀删除不可用
+	err = db.DeleteRange([]byte("d"), []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e", "b", "a"}, iteratorKeys(db.NewIterator(DefaultIteratorOptions)))
+	err = db.DeletePrefix([]byte("a"))
+	assert.Equal(t, ErrPrefixUnordered, err)
+
+	// 3.前缀迭代按照字节匹配，扫描整个索引
+	for _, key := range []string{"ab", "ba", "aa"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("value")))
+	}
+	assert.Equal(t, []string{"ab", "aa", "a"}, iteratorKeys(db.NewIterator(IteratorOptions{Prefix: []byte("a")})))
+	for _, key := range []string{"ab", "ba", "aa"} {
+		assert.Nil(t, db.Delete([]byte(key)))
+	}
+
+	// 4.命名空间使用同样的比较器
+	ns, err := db.Namespace("users")
+	assert.Nil(t, err)
+	for _, key := range []string{"x", "z", "y"} {
+		assert.Nil(t, ns.Put([]byte(key), []byte("value")))
+	}
+	assert.Equal(t, []string{"z", "y", "x"}, iteratorKeys(ns.NewIterator(DefaultIteratorOptions)))
+
+	// 5.使用同样的比较器重新打开
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e", "b", "a"}, iteratorKeys(db.NewIterator(DefaultIteratorOptions)))
+
+	// 6.备份的目录记录了比较器
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-comparator-backup")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, os.Remove(backupDir))
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(filepath.Join(backupDir, comparatorFileName))
+	assert.Nil(t, err)
+	assert.Equal(t, "reverse\n", string(content))
+}
+
+func TestDB_ComparatorMismatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-comparator-mismatch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("a"), []byte("value")))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 1.使用不同的比较器打开
+	reverseOpts := opts
+	reverseOpts.Comparator = reverseComparator{}
+	_, err = Open(reverseOpts)
+	assert.Equal(t, ErrComparatorMismatch, err)
+
+	// 2.没有记录比较器的旧目录按照字节序处理
+	assert.Nil(t, os.Remove(filepath.Join(dir, comparatorFileName)))
+	_, err = Open(reverseOpts)
+	assert.Equal(t, ErrComparatorMismatch, err)
+	db, err = Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, comparatorFileName))
+	assert.Nil(t, err)
+}
+
+func TestDB_ComparatorOptions(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-comparator-options")
+	opts.DirPath = dir
+	opts.Comparator = caseInsensitiveComparator{}
+
+	// 1.布隆过滤器按照字节计算哈希，不能和其他的比较器一起使用
+	bloomOpts := opts
+	bloomOpts.BloomFilterFPRate = 0.01
+	_, err := Open(bloomOpts)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "bloom filter"))
+
+	// 2.分片索引按照字节计算分片，同样不能使用
+	shardedOpts := opts
+	shardedOpts.IndexType = ShardedBTree
+	shardedOpts.IndexShards = 10
+	_, err = Open(shardedOpts)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "sharded index"))
+
+	// 3.比较结果为 0 的 key 是同一个 key
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("hello"), []byte("value")))
+	val, err := db.Get([]byte("HELLO"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// 4.命名空间同样不能使用分片索引
+	_, err = db.NamespaceWithOptions("sharded", NamespaceOptions{IndexType: ShardedBTree, IndexShards: 10})
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "sharded index"))
+	ns, err := db.NamespaceWithOptions("btree", NamespaceOptions{IndexType: BTree})
+	assert.Nil(t, err)
+	assert.Nil(t, ns.Put([]byte("hello"), []byte("value")))
+	val, err = ns.Get([]byte("HELLO"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
@@ -0,0 +1,64 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/20 20:52
+// @Desc 日志记录的校验算法
+package data
+
+import (
+	"hash/crc32"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// ChecksumType 校验算法，记录在数据文件头中，同一个目录下不同的文件可以使用不同的算法
+type ChecksumType = byte
+
+const (
+	// ChecksumCRC32 CRC32-IEEE，4 字节，旧版本的数据文件都使用这个算法
+	ChecksumCRC32 ChecksumType = iota
+
+	// ChecksumCRC32C CRC32-Castagnoli，4 字节，在 amd64 和 arm64 上有硬件加速
+	ChecksumCRC32C
+
+	// ChecksumXXHash64 xxhash64，8 字节，适合很大的 value
+	ChecksumXXHash64
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumSize 校验值占用的字节数
+func checksumSize(typ ChecksumType) int {
+	if typ == ChecksumXXHash64 {
+		return 8
+	}
+	return crc32.Size
+}
+
+// validChecksum 是否是支持的校验算法
+func validChecksum(typ ChecksumType) bool {
+	return typ <= ChecksumXXHash64
+}
+
+// computeChecksum 依次对所有的字节数组计算校验值
+func computeChecksum(typ ChecksumType, parts ...[]byte) uint64 {
+	switch typ {
+	case ChecksumCRC32C:
+		var crc uint32
+		for _, p := range parts {
+			crc = crc32.Update(crc, castagnoliTable, p)
+		}
+		return uint64(crc)
+	case ChecksumXXHash64:
+		d := xxhash.New()
+		for _, p := range parts {
+			_, _ = d.Write(p)
+		}
+		return d.Sum64()
+	default:
+		var crc uint32
+		for _, p := range parts {
+			crc = crc32.Update(crc, crc32.IEEETable, p)
+		}
+		return uint64(crc)
+	}
+}
@@ -0,0 +1,92 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/20 20:52
+// @Desc
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestComputeChecksum(t *testing.T) {
+	buf := []byte("bitcask-kv checksum")
+
+	// 1.分段计算和整体计算的结果一致
+	for _, typ := range []ChecksumType{ChecksumCRC32, ChecksumCRC32C, ChecksumXXHash64} {
+		assert.Equal(t, computeChecksum(typ, buf), computeChecksum(typ, buf[:7], nil, buf[7:]))
+	}
+
+	// 2.和标准库的结果一致
+	assert.Equal(t, uint64(crc32.ChecksumIEEE(buf)), computeChecksum(ChecksumCRC32, buf))
+	assert.Equal(t, uint64(crc32.Checksum(buf, castagnoliTable)), computeChecksum(ChecksumCRC32C, buf))
+
+	// 3.校验值的长度
+	assert.Equal(t, 4, checksumSize(ChecksumCRC32))
+	assert.Equal(t, 4, checksumSize(ChecksumCRC32C))
+	assert.Equal(t, 8, checksumSize(ChecksumXXHash64))
+	assert.False(t, validChecksum(ChecksumXXHash64+1))
+}
+
+func TestDataFile_Checksum(t *testing.T) {
+	kr, err := NewKeyRing(bytes.Repeat([]byte("a"), 16))
+	assert.Nil(t, err)
+
+	for _, typ := range []ChecksumType{ChecksumCRC32, ChecksumCRC32C, ChecksumXXHash64} {
+		for _, keyRing := range []*KeyRing{nil, kr} {
+			dir, _ := os.MkdirTemp("", "bitcask-go-checksum")
+			opts := FileOptions{KeyRing: keyRing, Checksum: typ}
+			dataFile, err := OpenDataFileWithOptions(dir, 1, opts)
+			assert.Nil(t, err)
+			assert.Equal(t, typ, dataFile.Checksum())
+			assert.True(t, dataFile.MatchesOptions(opts))
+
+			// 1.写入之后可以读取
+			var offsets []int64
+			records := []*LogRecord{
+				{Key: []byte("name"), Value: []byte("bitcask-kv")},
+				{Key: []byte("name"), Type: LogRecordDeleted},
+				{Key: []byte("big"), Value: bytes.Repeat([]byte("v"), 4096)},
+			}
+			for _, rec := range records {
+				offsets = append(offsets, dataFile.WriteOff)
+				enc, _ := dataFile.EncodeLogRecord(rec)
+				assert.Nil(t, dataFile.Write(enc))
+			}
+			assert.Nil(t, dataFile.Close())
+
+			// 2.重新打开之后使用文件头中记录的算法，与配置无关
+			dataFile, err = OpenDataFile(dir, 1)
+			if keyRing != nil {
+				assert.Equal(t, ErrWrongEncryptionKey, err)
+				dataFile, err = OpenDataFileWithOptions(dir, 1, FileOptions{KeyRing: keyRing})
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, typ, dataFile.Checksum())
+			assert.Equal(t, typ == ChecksumCRC32, dataFile.MatchesOptions(FileOptions{KeyRing: keyRing}))
+			for i, rec := range records {
+				readRec, _, err := dataFile.ReadLogRecord(offsets[i])
+				assert.Nil(t, err)
+				assert.Equal(t, rec.Key, readRec.Key)
+				assert.Equal(t, rec.Type, readRec.Type)
+				assert.Equal(t, len(rec.Value), len(readRec.Value))
+			}
+
+			// 3.数据损坏时校验失败
+			assert.Nil(t, dataFile.Close())
+			content, err := os.ReadFile(GetDataFileName(dir, 1))
+			assert.Nil(t, err)
+			content[len(content)-1] ^= 0xff
+			assert.Nil(t, os.WriteFile(GetDataFileName(dir, 1), content, 0644))
+			dataFile, err = OpenDataFileWithOptions(dir, 1, FileOptions{KeyRing: keyRing})
+			assert.Nil(t, err)
+			_, _, err = dataFile.ReadLogRecord(offsets[2])
+			assert.Equal(t, ErrInvalidCRC, err)
+			assert.Nil(t, dataFile.Close())
+			_ = os.RemoveAll(dir)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/22 20:35
+// @Desc 分块写入的大 value 的清单
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrInvalidChunkManifest = errors.New("invalid chunk manifest, log record maybe corrupted")
+)
+
+// ChunkManifest 分块写入的 value 的清单，所有的块写入并持久化之后才写入清单
+// 没有清单的块不会被索引引用，重启之后不可见，值日志的垃圾回收时会被清理
+//
+//	+---------+-----------+-----------+-----------------+
+//	|   id    | value 长度 |  块的数量  | 每个块的指针...   |
+//	+---------+-----------+-----------+-----------------+
+//	   8字节     变长         变长         变长
+type ChunkManifest struct {
+	Id     uint64          // value 的唯一标识，垃圾回收移动块的位置之后保持不变
+	Size   int64           // value 的总长度
+	Chunks []*ValuePointer // 按顺序排列的每个块在值日志中的位置
+}
+
+// EncodeChunkManifest 对 ChunkManifest 进行编码
+func EncodeChunkManifest(manifest *ChunkManifest) []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, manifest.Id)
+	buf = binary.AppendVarint(buf, manifest.Size)
+	buf = binary.AppendUvarint(buf, uint64(len(manifest.Chunks)))
+	for _, vp := range manifest.Chunks {
+		buf = appendValuePointer(buf, vp)
+	}
+	return buf
+}
+
+// DecodeChunkManifest 对 ChunkManifest 进行解码
+func DecodeChunkManifest(buf []byte) (*ChunkManifest, error) {
+	if len(buf) < 8 {
+		return nil, ErrInvalidChunkManifest
+	}
+	manifest := &ChunkManifest{Id: binary.LittleEndian.Uint64(buf[:8])}
+	var index = 8
+	size, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, ErrInvalidChunkManifest
+	}
+	manifest.Size = size
+	index += n
+	count, n := binary.Uvarint(buf[index:])
+	// 每个块的指针至少占用 3 个字节
+	if n <= 0 || count > uint64(len(buf)) {
+		return nil, ErrInvalidChunkManifest
+	}
+	index += n
+	manifest.Chunks = make([]*ValuePointer, 0, count)
+	for i := uint64(0); i < count; i++ {
+		vp, n := readValuePointer(buf[index:])
+		if n <= 0 {
+			return nil, ErrInvalidChunkManifest
+		}
+		manifest.Chunks = append(manifest.Chunks, vp)
+		index += n
+	}
+	if index != len(buf) {
+		return nil, ErrInvalidChunkManifest
+	}
+	return manifest, nil
+}
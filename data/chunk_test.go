@@ -0,0 +1,40 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/22 20:35
+// @Desc
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeChunkManifest(t *testing.T) {
+	// 1.正常编码解码
+	manifest := &ChunkManifest{
+		Id:   0x1234567890,
+		Size: 3<<20 + 12,
+		Chunks: []*ValuePointer{
+			{Fid: 0, Offset: 32, Size: 1<<20 + 20},
+			{Fid: 1, Offset: 32, Size: 1<<20 + 20},
+			{Fid: 2, Offset: 1<<20 + 52, Size: 40},
+		},
+	}
+	buf := EncodeChunkManifest(manifest)
+	res, err := DecodeChunkManifest(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, res)
+
+	// 2.没有任何块
+	res2, err := DecodeChunkManifest(EncodeChunkManifest(&ChunkManifest{Id: 1}))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(res2.Chunks))
+
+	// 3.不完整或者多余的数据
+	_, err = DecodeChunkManifest(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidChunkManifest, err)
+	_, err = DecodeChunkManifest(append(buf, 0))
+	assert.Equal(t, ErrInvalidChunkManifest, err)
+	_, err = DecodeChunkManifest(buf[:4])
+	assert.Equal(t, ErrInvalidChunkManifest, err)
+}
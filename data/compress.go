@@ -0,0 +1,93 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/17 20:46
+// @Desc value 压缩算法的抽象和内置实现
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	ErrUnknownCodec = errors.New("unknown compression codec, log record can not be decompressed")
+)
+
+// CodecType 压缩算法的编号，存储在每条日志记录的 type 字节的高 4 位，取值范围为 0~15
+type CodecType = byte
+
+const (
+	// NoCompression 没有压缩
+	NoCompression CodecType = iota
+
+	// FlateCodec 标准库 compress/flate 压缩
+	FlateCodec
+
+	// MaxCodec 压缩算法编号的最大值，自定义的压缩算法建议从 8 开始编号，避免和内置的冲突
+	MaxCodec CodecType = 15
+)
+
+// Compressor 压缩算法的抽象接口，可以接入 snappy、zstd 等不同的实现
+type Compressor interface {
+	// Codec 压缩算法的编号，写入到日志记录中，解压时根据编号找到对应的实现
+	Codec() CodecType
+
+	// Compress 压缩数据
+	Compress(src []byte) ([]byte, error)
+
+	// Decompress 解压数据
+	Decompress(src []byte) ([]byte, error)
+}
+
+// FlateCompressor 基于标准库 compress/flate 的压缩实现
+type FlateCompressor struct {
+	level   int
+	writers sync.Pool // 复用 flate.Writer，避免每次压缩都分配内部的缓冲区
+}
+
+// NewFlateCompressor 新建 flate 压缩实现，level 的取值同 compress/flate
+func NewFlateCompressor(level int) (*FlateCompressor, error) {
+	// 提前校验压缩级别
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return &FlateCompressor{level: level}, nil
+}
+
+// Codec 压缩算法的编号
+func (fc *FlateCompressor) Codec() CodecType {
+	return FlateCodec
+}
+
+// Compress 压缩数据
+func (fc *FlateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := fc.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, fc.level); err != nil {
+			return nil, err
+		}
+	}
+	defer fc.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress 解压数据
+func (fc *FlateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
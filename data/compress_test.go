@@ -0,0 +1,60 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/17 20:46
+// @Desc
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestFlateCompressor(t *testing.T) {
+	fc, err := NewFlateCompressor(flate.BestSpeed)
+	assert.Nil(t, err)
+	assert.Equal(t, FlateCodec, fc.Codec())
+
+	// 1.可压缩的数据
+	src := bytes.Repeat([]byte(`{"name":"bitcask","kind":"kv"}`), 100)
+	compressed, err := fc.Compress(src)
+	assert.Nil(t, err)
+	assert.Less(t, len(compressed), len(src))
+	res, err := fc.Decompress(compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, src, res)
+
+	// 2.复用 writer 之后仍然正确
+	compressed2, err := fc.Compress([]byte("bitcask"))
+	assert.Nil(t, err)
+	res2, err := fc.Decompress(compressed2)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask"), res2)
+
+	// 3.非法的压缩级别
+	_, err = NewFlateCompressor(100)
+	assert.NotNil(t, err)
+}
+
+func TestLogRecord_Codec(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-codec")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+	defer dataFile.Close()
+
+	// 压缩算法编号写入到 type 字节的高 4 位，解码之后类型和压缩算法都能还原
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("compressed"), Type: LogRecordDeleted, Codec: FlateCodec}
+	buf, size := EncodeLogRecord(rec)
+	assert.Equal(t, LogRecordDeleted|FlateCodec<<codecShift, buf[4])
+	err = dataFile.Write(buf)
+	assert.Nil(t, err)
+
+	readRec, readSize, err := dataFile.ReadLogRecord(dataFile.HeaderSize())
+	assert.Nil(t, err)
+	assert.Equal(t, rec, readRec)
+	assert.Equal(t, size, readSize)
+}
@@ -5,9 +5,9 @@
 package data
 
 import (
+	"crypto/cipher"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"kv-projects/fio"
 	"path/filepath"
@@ -24,23 +24,147 @@ type DataFile struct {
 	FileId    uint32        // 文件 id
 	WriteOff  int64         // 文件写到了哪个位置
 	IoManager fio.IOManager // io 读写管理
+
+	header *fileHeader // 文件头
+	aead   cipher.AEAD // 加密使用的密钥，为 nil 表示没有加密
+}
+
+// FileOptions 新建数据文件时使用的配置，打开已有的文件时以文件头中记录的为准
+type FileOptions struct {
+	KeyRing  *KeyRing     // 加密的密钥环，当前密钥为空表示不加密
+	Checksum ChecksumType // 日志记录的校验算法
+}
+
+// GetDataFileName 获取数据文件的完整路径
+func GetDataFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
 // OpenDataFile 打开新的数据文件
 func OpenDataFile(dirPath string, fileId uint32) (*DataFile, error) {
+	return OpenDataFileWithOptions(dirPath, fileId, FileOptions{})
+}
+
+// OpenDataFileWithOptions 打开数据文件，新建的文件根据配置写入文件头，
+// 已有的文件读取文件头，加密的文件根据文件头中的密钥 id 找到对应的密钥，找不到时返回 ErrWrongEncryptionKey
+func OpenDataFileWithOptions(dirPath string, fileId uint32, options FileOptions) (*DataFile, error) {
 	// 文件名称，指定特定的分离器将其分开
-	fileName := filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
+	fileName := GetDataFileName(dirPath, fileId)
+	return openDataFile(fileName, fileId, options)
+}
+
+// openDataFile 根据完整的文件路径打开数据文件
+func openDataFile(fileName string, fileId uint32, options FileOptions) (*DataFile, error) {
 	// 初始化 IOManager 管理器接口
 	ioManager, err := fio.NewIOManager(fileName)
 	if err != nil {
 		return nil, err
 	}
 	// 初始化数据文件
-	return &DataFile{
+	dataFile := &DataFile{
 		FileId:    fileId,
 		WriteOff:  0,
 		IoManager: ioManager,
-	}, nil
+	}
+	if err := dataFile.initHeader(options); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	return dataFile, nil
+}
+
+// initHeader 新建的文件写入文件头，已有的文件读取文件头
+func (df *DataFile) initHeader(options FileOptions) error {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return err
+	}
+
+	var header *fileHeader
+	if fileSize == 0 {
+		// 新建的文件，写入当前版本的文件头
+		if header, err = newFileHeader(options); err != nil {
+			return err
+		}
+		if err := df.Write(header.encode()); err != nil {
+			return err
+		}
+	} else {
+		// 已有的文件，读取文件开头的字节进行解码
+		n := int64(fileHeaderSize)
+		if fileSize < n {
+			n = fileSize
+		}
+		buf, err := df.readNBytes(n, 0)
+		if err != nil {
+			return err
+		}
+		if header, err = decodeFileHeader(buf); err != nil {
+			return err
+		}
+		df.WriteOff = header.size
+	}
+
+	// 找到加密使用的密钥
+	if header.keyId != 0 {
+		aead, ok := options.KeyRing.cipherOf(header.keyId)
+		if !ok {
+			return ErrWrongEncryptionKey
+		}
+		df.aead = aead
+	}
+	df.header = header
+	return nil
+}
+
+// HeaderSize 文件头的长度，日志记录从这个位置开始
+func (df *DataFile) HeaderSize() int64 {
+	return df.header.size
+}
+
+// Version 数据文件的格式版本
+func (df *DataFile) Version() uint16 {
+	return df.header.version
+}
+
+// KeyId 文件加密使用的密钥 id，为 0 表示没有加密
+func (df *DataFile) KeyId() uint64 {
+	return df.header.keyId
+}
+
+// Checksum 文件中日志记录使用的校验算法
+func (df *DataFile) Checksum() ChecksumType {
+	return df.header.checksum
+}
+
+// MatchesOptions 文件是否是当前版本，并且和配置一致，不一致的文件不再写入新的数据，合并之后会被重写
+func (df *DataFile) MatchesOptions(options FileOptions) bool {
+	return df.header.version == FileVersionCurrent &&
+		df.header.keyId == options.KeyRing.CurrentId() &&
+		df.header.checksum == options.Checksum
+}
+
+// EncodeLogRecord 对将要写入到文件末尾的 LogRecord 进行编码，返回字节数组及长度
+// 加密的文件中，key 和 value 使用文件的密钥加密，header 作为附加数据参与认证，crc 校验的是密文
+func (df *DataFile) EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	if df.aead == nil {
+		return encodeLogRecord(logRecord, df.header.checksum)
+	}
+
+	sumSize := checksumSize(df.header.checksum)
+	header := make([]byte, maxHeaderSize(sumSize))
+	index := encodeLogRecordHeader(logRecord, header, sumSize)
+	plain := make([]byte, 0, len(logRecord.Key)+len(logRecord.Value))
+	plain = append(append(plain, logRecord.Key...), logRecord.Value...)
+
+	encBytes := make([]byte, index, index+len(plain)+df.aead.Overhead())
+	copy(encBytes, header[:index])
+	nonce := recordNonce(df.header.noncePrefix, df.WriteOff)
+	// 附加数据不能和输出的字节数组重叠，使用单独的 header 数组
+	encBytes = df.aead.Seal(encBytes, nonce, plain, header[sumSize:index])
+
+	putChecksum(encBytes[:sumSize], computeChecksum(df.header.checksum, encBytes[sumSize:]))
+	return encBytes, int64(len(encBytes))
 }
 
 // ReadLogRecord 根据 offset 从数据文件中读取 LogRecord
@@ -52,8 +176,9 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	// 如果读取的最大 header 长度已经超过了文件的长度，则只需要读取到文件的末尾即可
-	var headerBytes int64 = maxLogRecordHeaderSize
-	if offset+maxLogRecordHeaderSize > fileSize {
+	sumSize := checksumSize(df.header.checksum)
+	var headerBytes = maxHeaderSize(sumSize)
+	if offset+headerBytes > fileSize {
 		headerBytes = fileSize - offset
 	}
 
@@ -63,12 +188,12 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 		return nil, 0, err
 	}
 	// 解码
-	header, headerSize := decodeLogRecordHeader(headerBuf)
+	header, headerSize := decodeLogRecordHeaderWith(headerBuf, sumSize)
 	// 下面的两个条件表示读取到了文件末尾，直接返回 EOF 错误
 	if header == nil {
 		return nil, 0, io.EOF
 	}
-	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
+	if header.checksum == 0 && header.keySize == 0 && header.valueSize == 0 {
 		return nil, 0, io.EOF
 	}
 
@@ -76,7 +201,11 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
 
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{Type: header.recordType, Codec: header.codec, Namespace: header.namespace}
+	// 加密的文件单独处理
+	if df.aead != nil {
+		return df.readEncryptedLogRecord(logRecord, headerBuf[:headerSize], offset)
+	}
 	// 开始读取用户实际存储的 key/value 数据
 	if keySize > 0 || valueSize > 0 {
 		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
@@ -89,13 +218,41 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	}
 
 	// 校验数据的有效性
-	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
-	if crc != header.crc {
+	checksum := getLogRecordChecksum(df.header.checksum, logRecord, headerBuf[sumSize:headerSize])
+	if checksum != header.checksum {
 		return nil, 0, ErrInvalidCRC
 	}
 	return logRecord, recordSize, nil
 }
 
+// readEncryptedLogRecord 读取加密的 key/value 数据，校验之后解密
+func (df *DataFile) readEncryptedLogRecord(logRecord *LogRecord, headerBuf []byte, offset int64) (*LogRecord, int64, error) {
+	sumSize := checksumSize(df.header.checksum)
+	header, headerSize := decodeLogRecordHeaderWith(headerBuf, sumSize)
+	keySize := int64(header.keySize)
+	sealedSize := keySize + int64(header.valueSize) + int64(df.aead.Overhead())
+	sealed, err := df.readNBytes(sealedSize, offset+headerSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 先校验密文的有效性，再进行解密
+	if computeChecksum(df.header.checksum, headerBuf[sumSize:], sealed) != header.checksum {
+		return nil, 0, ErrInvalidCRC
+	}
+	plain, err := df.aead.Open(sealed[:0], recordNonce(df.header.noncePrefix, offset), sealed, headerBuf[sumSize:])
+	if err != nil {
+		return nil, 0, ErrDecryptFailed
+	}
+	if keySize > 0 {
+		logRecord.Key = plain[:keySize]
+	}
+	if int64(len(plain)) > keySize {
+		logRecord.Value = plain[keySize:]
+	}
+	return logRecord, headerSize + sealedSize, nil
+}
+
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
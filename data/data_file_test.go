@@ -76,9 +76,16 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_ReadLogRecord(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 6666)
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-log-record")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 6666)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
+	defer dataFile.Close()
+
+	// 新建的文件先写入文件头，日志记录从文件头之后开始
+	headerSize := dataFile.HeaderSize()
+	assert.Equal(t, int64(fileHeaderSize), headerSize)
 
 	// 只有一条 LogRecord
 	rec1 := &LogRecord{
@@ -89,7 +96,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	err = dataFile.Write(res1)
 	assert.Nil(t, err)
 
-	readRec1, readSize1, err := dataFile.ReadLogRecord(0)
+	readRec1, readSize1, err := dataFile.ReadLogRecord(headerSize)
 	assert.Nil(t, err)
 	assert.Equal(t, rec1, readRec1)
 	assert.Equal(t, size1, readSize1)
@@ -104,7 +111,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	err = dataFile.Write(res2)
 	assert.Nil(t, err)
 
-	readRec2, readSize2, err := dataFile.ReadLogRecord(size1)
+	readRec2, readSize2, err := dataFile.ReadLogRecord(headerSize + size1)
 	assert.Nil(t, err)
 	assert.Equal(t, rec2, readRec2)
 	assert.Equal(t, size2, readSize2)
@@ -119,7 +126,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	err = dataFile.Write(res3)
 	assert.Nil(t, err)
 
-	readRec3, readSize3, err := dataFile.ReadLogRecord(size1 + size2)
+	readRec3, readSize3, err := dataFile.ReadLogRecord(headerSize + size1 + size2)
 	assert.Nil(t, err)
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
@@ -138,3 +145,32 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 PASS
 ok      kv-projects/data        0.375s
 */
+
+func TestDataFile_ReadLogRecord_Namespace(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-log-record-ns")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 6666)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	// 1.默认命名空间的记录编码和之前完全一致
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go")}
+	res1, size1 := dataFile.EncodeLogRecord(rec1)
+	rec2 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go"), Type: LogRecordDeleted, Namespace: 300}
+	res2, size2 := dataFile.EncodeLogRecord(rec2)
+	assert.Equal(t, size1+2, size2)
+	assert.Equal(t, byte(LogRecordDeleted|namespaceFlag), res2[4])
+
+	// 2.读取之后得到相同的命名空间和类型
+	err = dataFile.Write(res1)
+	assert.Nil(t, err)
+	err = dataFile.Write(res2)
+	assert.Nil(t, err)
+	readRec1, _, err := dataFile.ReadLogRecord(dataFile.HeaderSize())
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec1)
+	readRec2, readSize2, err := dataFile.ReadLogRecord(dataFile.HeaderSize() + size1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, readRec2)
+	assert.Equal(t, size2, readSize2)
+}
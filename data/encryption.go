@@ -0,0 +1,95 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/18 21:02
+// @Desc 数据文件的静态加密，基于 AES-GCM 对每条日志记录加密
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrWrongEncryptionKey = errors.New("data file is encrypted with a key that is not provided")
+	ErrDecryptFailed      = errors.New("failed to decrypt log record, the encryption key maybe wrong")
+)
+
+// 加密的数据文件在文件头中记录密钥 id 和 nonce 前缀
+// 每条日志记录的 nonce 由文件的 nonce 前缀和记录在文件中的偏移组成，同一个文件中偏移不会重复，
+// 不同文件的前缀是 8 字节的随机数，文件数量很多时也不会重复，数据文件不超过 4GB，偏移只需要 4 字节
+const noncePrefixSize = 8
+
+// KeyRing 加密密钥环
+// 当前密钥用于加密新写入的数据，之前的密钥只用于解密旧的数据文件，合并之后所有数据都会使用当前密钥重新加密
+type KeyRing struct {
+	currentId uint64                 // 当前密钥的 id，为 0 表示新写入的数据不加密
+	ciphers   map[uint64]cipher.AEAD // 所有可用于解密的密钥
+}
+
+// NewKeyRing 新建密钥环，current 为空表示新写入的数据不加密，密钥的长度需要是 16、24 或 32 字节
+func NewKeyRing(current []byte, previous ...[]byte) (*KeyRing, error) {
+	kr := &KeyRing{ciphers: make(map[uint64]cipher.AEAD)}
+	for i, key := range append([][]byte{current}, previous...) {
+		if len(key) == 0 {
+			continue
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := keyId(key)
+		kr.ciphers[id] = aead
+		if i == 0 {
+			kr.currentId = id
+		}
+	}
+	return kr, nil
+}
+
+// CurrentId 当前密钥的 id，为 0 表示新写入的数据不加密
+func (kr *KeyRing) CurrentId() uint64 {
+	if kr == nil {
+		return 0
+	}
+	return kr.currentId
+}
+
+// cipherOf 根据 id 找到对应的密钥
+func (kr *KeyRing) cipherOf(id uint64) (cipher.AEAD, bool) {
+	if kr == nil {
+		return nil, false
+	}
+	aead, ok := kr.ciphers[id]
+	return aead, ok
+}
+
+// newAEAD 根据密钥创建 AES-GCM
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyId 根据密钥计算 id，写入到文件头中，用于打开文件时找到对应的密钥
+func keyId(key []byte) uint64 {
+	sum := sha256.Sum256(append([]byte("kv-projects key id:"), key...))
+	id := binary.LittleEndian.Uint64(sum[:8])
+	if id == 0 {
+		// 0 用于表示不加密
+		id = 1
+	}
+	return id
+}
+
+// recordNonce 根据文件的 nonce 前缀和记录的偏移生成 12 字节的 nonce，8 字节的前缀之后是 4 字节的偏移
+func recordNonce(prefix []byte, offset int64) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(offset))
+	return nonce
+}
@@ -0,0 +1,110 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/18 21:02
+// @Desc
+package data
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestNewKeyRing(t *testing.T) {
+	// 1.没有密钥
+	kr1, err := NewKeyRing(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), kr1.CurrentId())
+
+	// 2.当前密钥和旧的密钥都可以用于解密
+	key1, key2 := bytes.Repeat([]byte("a"), 32), bytes.Repeat([]byte("b"), 16)
+	kr2, err := NewKeyRing(key1, key2)
+	assert.Nil(t, err)
+	assert.Equal(t, keyId(key1), kr2.CurrentId())
+	_, ok := kr2.cipherOf(keyId(key2))
+	assert.True(t, ok)
+
+	// 3.非法的密钥长度
+	_, err = NewKeyRing([]byte("short"))
+	assert.NotNil(t, err)
+}
+
+func TestDataFile_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	defer os.RemoveAll(dir)
+	key1, key2 := bytes.Repeat([]byte("a"), 32), bytes.Repeat([]byte("b"), 32)
+	kr1, err := NewKeyRing(key1)
+	assert.Nil(t, err)
+
+	// 1.新建的加密文件写入文件头
+	dataFile, err := OpenDataFileWithOptions(dir, 0, FileOptions{KeyRing: kr1})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(fileHeaderSize), dataFile.HeaderSize())
+	assert.Equal(t, int64(fileHeaderSize), dataFile.WriteOff)
+	assert.Equal(t, kr1.CurrentId(), dataFile.KeyId())
+
+	// 2.写入之后可以读取，磁盘上是密文
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go"), Codec: FlateCodec}
+	offset1 := dataFile.WriteOff
+	enc1, size1 := dataFile.EncodeLogRecord(rec1)
+	assert.False(t, bytes.Contains(enc1, rec1.Value))
+	err = dataFile.Write(enc1)
+	assert.Nil(t, err)
+	rec2 := &LogRecord{Key: []byte("name"), Type: LogRecordDeleted}
+	offset2 := dataFile.WriteOff
+	enc2, size2 := dataFile.EncodeLogRecord(rec2)
+	err = dataFile.Write(enc2)
+	assert.Nil(t, err)
+
+	readRec1, readSize1, err := dataFile.ReadLogRecord(offset1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec1)
+	assert.Equal(t, size1, readSize1)
+	readRec2, readSize2, err := dataFile.ReadLogRecord(offset2)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, readRec2)
+	assert.Equal(t, size2, readSize2)
+	assert.Nil(t, dataFile.Close())
+
+	// 3.使用旧密钥重新打开
+	kr2, err := NewKeyRing(key2, key1)
+	assert.Nil(t, err)
+	dataFile2, err := OpenDataFileWithOptions(dir, 0, FileOptions{KeyRing: kr2})
+	assert.Nil(t, err)
+	assert.Equal(t, kr1.CurrentId(), dataFile2.KeyId())
+	readRec1, _, err = dataFile2.ReadLogRecord(offset1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec1)
+	assert.Nil(t, dataFile2.Close())
+
+	// 4.错误的密钥
+	kr3, err := NewKeyRing(key2)
+	assert.Nil(t, err)
+	_, err = OpenDataFileWithOptions(dir, 0, FileOptions{KeyRing: kr3})
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+	_, err = OpenDataFileWithOptions(dir, 0, FileOptions{})
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+
+	// 5.明文文件在配置了密钥之后仍然可以读取
+	plainFile, err := OpenDataFile(dir, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, plainFile.aead)
+	enc3, _ := plainFile.EncodeLogRecord(rec1)
+	err = plainFile.Write(enc3)
+	assert.Nil(t, err)
+	assert.Nil(t, plainFile.Close())
+	plainFile, err = OpenDataFileWithOptions(dir, 1, FileOptions{KeyRing: kr1})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), plainFile.KeyId())
+	readRec3, _, err := plainFile.ReadLogRecord(plainFile.HeaderSize())
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec3)
+	assert.Nil(t, plainFile.Close())
+}
+
+func TestRecordNonce(t *testing.T) {
+	// 8 字节的前缀之后是 4 字节的偏移
+	nonce := recordNonce([]byte("abcdefgh"), 0x01020304)
+	assert.Equal(t, append([]byte("abcdefgh"), 1, 2, 3, 4), nonce)
+}
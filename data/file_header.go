@@ -0,0 +1,109 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/19 21:40
+// @Desc 数据文件的文件头，记录魔数、格式版本和创建文件时的配置
+package data
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	ErrUnsupportedFileVersion = errors.New("data file format version is not supported, please upgrade the engine")
+	ErrFileHeaderCorrupted    = errors.New("data file header maybe corrupted")
+)
+
+// 数据文件的格式版本
+const (
+	// FileVersionLegacy 没有文件头的数据文件，日志记录从文件开头开始
+	FileVersionLegacy uint16 = 0
+
+	// FileVersionCurrent 当前版本，所有的数据文件都有文件头
+	FileVersionCurrent uint16 = 1
+)
+
+// 当前版本的文件头，固定 32 字节
+//
+//	+---------+---------+----------+---------+---------+-------------+----------+------------+
+//	|  magic  | version | checksum |  flags  | key id  | nonce 前缀  |   保留   | header crc |
+//	+---------+---------+----------+---------+---------+-------------+----------+------------+
+//	   4字节     2字节      1字节      1字节     8字节       8字节        4字节        4字节
+//
+// 新的创建配置使用保留的字节，或者增加版本号，旧版本的引擎拒绝打开更高版本的文件
+const (
+	fileMagic      = "KVDB"
+	fileHeaderSize = 32
+)
+
+// fileHeader 数据文件头
+type fileHeader struct {
+	version     uint16
+	checksum    ChecksumType // 日志记录的校验算法，旧版本的文件都是 CRC32
+	keyId       uint64       // 加密使用的密钥 id，为 0 表示没有加密
+	noncePrefix []byte       // 加密使用的 nonce 前缀
+	size        int64        // 文件头在文件中占用的长度
+}
+
+// newFileHeader 根据配置生成新文件的文件头
+func newFileHeader(options FileOptions) (*fileHeader, error) {
+	header := &fileHeader{
+		version:  FileVersionCurrent,
+		checksum: options.Checksum,
+		keyId:    options.KeyRing.CurrentId(),
+		size:     fileHeaderSize,
+	}
+	if header.keyId != 0 {
+		header.noncePrefix = make([]byte, noncePrefixSize)
+		if _, err := rand.Read(header.noncePrefix); err != nil {
+			return nil, err
+		}
+	}
+	return header, nil
+}
+
+// encode 对文件头进行编码
+func (h *fileHeader) encode() []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf, fileMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], h.version)
+	buf[6] = h.checksum
+	if h.keyId != 0 {
+		buf[7] |= 1
+		binary.LittleEndian.PutUint64(buf[8:16], h.keyId)
+		copy(buf[16:16+noncePrefixSize], h.noncePrefix)
+	}
+	binary.LittleEndian.PutUint32(buf[28:], crc32.ChecksumIEEE(buf[:28]))
+	return buf
+}
+
+// decodeFileHeader 解码文件开头的字节，buf 最多为 fileHeaderSize 个字节
+// 没有魔数的是旧版本的文件，魔数匹配但是版本号更高的文件无法打开
+func decodeFileHeader(buf []byte) (*fileHeader, error) {
+	// 没有文件头
+	if len(buf) < fileHeaderSize || string(buf[:4]) != fileMagic {
+		return &fileHeader{version: FileVersionLegacy}, nil
+	}
+
+	if binary.LittleEndian.Uint32(buf[28:]) != crc32.ChecksumIEEE(buf[:28]) {
+		return nil, ErrFileHeaderCorrupted
+	}
+	header := &fileHeader{
+		version: binary.LittleEndian.Uint16(buf[4:6]),
+		size:    fileHeaderSize,
+	}
+	if header.version > FileVersionCurrent {
+		return nil, ErrUnsupportedFileVersion
+	}
+	// 更高版本的引擎新增的校验算法
+	if header.checksum = buf[6]; !validChecksum(header.checksum) {
+		return nil, ErrUnsupportedFileVersion
+	}
+	if buf[7]&1 != 0 {
+		header.keyId = binary.LittleEndian.Uint64(buf[8:16])
+		header.noncePrefix = buf[16 : 16+noncePrefixSize]
+	}
+	return header, nil
+}
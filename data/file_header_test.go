@@ -0,0 +1,107 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/19 21:40
+// @Desc
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"kv-projects/fio"
+	"os"
+	"testing"
+)
+
+func TestFileHeader_EncodeDecode(t *testing.T) {
+	// 1.不加密的文件头
+	h1, err := newFileHeader(FileOptions{})
+	assert.Nil(t, err)
+	buf1 := h1.encode()
+	assert.Equal(t, fileHeaderSize, len(buf1))
+	res1, err := decodeFileHeader(buf1)
+	assert.Nil(t, err)
+	assert.Equal(t, FileVersionCurrent, res1.version)
+	assert.Equal(t, uint64(0), res1.keyId)
+	assert.Equal(t, int64(fileHeaderSize), res1.size)
+
+	// 2.加密的文件头
+	kr, err := NewKeyRing(bytes.Repeat([]byte("a"), 16))
+	assert.Nil(t, err)
+	h2, err := newFileHeader(FileOptions{KeyRing: kr})
+	assert.Nil(t, err)
+	res2, err := decodeFileHeader(h2.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, kr.CurrentId(), res2.keyId)
+	assert.Equal(t, h2.noncePrefix, res2.noncePrefix)
+	assert.Equal(t, noncePrefixSize, len(res2.noncePrefix))
+
+	// 3.没有文件头的旧文件
+	rec, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask")})
+	res3, err := decodeFileHeader(rec)
+	assert.Nil(t, err)
+	assert.Equal(t, FileVersionLegacy, res3.version)
+	assert.Equal(t, int64(0), res3.size)
+
+	// 4.更高的版本号
+	buf4 := h1.encode()
+	binary.LittleEndian.PutUint16(buf4[4:6], FileVersionCurrent+1)
+	binary.LittleEndian.PutUint32(buf4[28:], crc32.ChecksumIEEE(buf4[:28]))
+	_, err = decodeFileHeader(buf4)
+	assert.Equal(t, ErrUnsupportedFileVersion, err)
+
+	// 5.文件头损坏
+	buf5 := h1.encode()
+	buf5[6] = 0xff
+	_, err = decodeFileHeader(buf5)
+	assert.Equal(t, ErrFileHeaderCorrupted, err)
+
+	// 6.校验算法
+	h6, err := newFileHeader(FileOptions{Checksum: ChecksumXXHash64})
+	assert.Nil(t, err)
+	res6, err := decodeFileHeader(h6.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, ChecksumXXHash64, res6.checksum)
+	assert.Equal(t, ChecksumCRC32, res1.checksum)
+	assert.Equal(t, ChecksumCRC32, res3.checksum)
+
+	// 7.不支持的校验算法
+	buf7 := h1.encode()
+	buf7[6] = ChecksumXXHash64 + 1
+	binary.LittleEndian.PutUint32(buf7[28:], crc32.ChecksumIEEE(buf7[:28]))
+	_, err = decodeFileHeader(buf7)
+	assert.Equal(t, ErrUnsupportedFileVersion, err)
+}
+
+func TestOpenDataFile_LegacyVersion(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-legacy")
+	defer os.RemoveAll(dir)
+
+	// 直接写入没有文件头的旧文件
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask")}
+	enc, size := EncodeLogRecord(rec)
+	ioManager, err := fio.NewIOManager(GetDataFileName(dir, 1))
+	assert.Nil(t, err)
+	_, err = ioManager.Write(enc)
+	assert.Nil(t, err)
+	assert.Nil(t, ioManager.Close())
+
+	dataFile, err := OpenDataFile(dir, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, FileVersionLegacy, dataFile.Version())
+	assert.Equal(t, int64(0), dataFile.HeaderSize())
+	assert.False(t, dataFile.MatchesOptions(FileOptions{}))
+	readRec, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec, readRec)
+	assert.Equal(t, size, readSize)
+	assert.Nil(t, dataFile.Close())
+
+	// 新建的文件是当前版本
+	dataFile2, err := OpenDataFile(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, FileVersionCurrent, dataFile2.Version())
+	assert.True(t, dataFile2.MatchesOptions(FileOptions{}))
+	assert.Nil(t, dataFile2.Close())
+}
@@ -16,25 +16,62 @@ type LogRecordType = byte
 const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
+
+	// LogRecordValuePointer value 存储在值日志中，记录的 value 是编码之后的 ValuePointer
+	LogRecordValuePointer
+
+	// LogRecordChunk 分块写入的 value 中的一块，只存储在值日志中
+	LogRecordChunk
+
+	// LogRecordChunkManifest 分块写入的 value 的清单，记录的 value 是编码之后的 ChunkManifest
+	LogRecordChunkManifest
+
+	// LogRecordBatchBegin 原子批次的开始，之后直到提交记录之间的记录属于同一个批次
+	LogRecordBatchBegin
+
+	// LogRecordBatchCommit 原子批次的提交，记录的 value 是批次中记录的数量
+	LogRecordBatchCommit
+
+	// LogRecordRangeDeleted 范围删除，删除 [key, value) 范围内之前写入的所有 key，value 为空表示没有上界
+	LogRecordRangeDeleted
 )
 
-// crc type keySize valueSize
-// 4 +  1  +  5   +   5 = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// type 字节的低 3 位存储日志类型，第 4 位标识记录属于某个命名空间，高 4 位存储 value 的压缩算法
+// 旧的数据文件中高 4 位和命名空间标识都是 0，即没有压缩、属于默认的命名空间，因此仍然可以正常解码
+const (
+	logRecordTypeMask = 0x07
+	namespaceFlag     = 0x08
+	codecShift        = 4
+)
+
+// crc type keySize valueSize namespace
+// 4 +  1  +  5   +   5    +    5     = 20
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + 5
+
+// maxHeaderSize 校验值为 sumSize 个字节时 header 的最大长度
+func maxHeaderSize(sumSize int) int64 {
+	return int64(sumSize + 1 + binary.MaxVarintLen32*3)
+}
 
 // LogRecord 写入到数据文件的记录，之所以叫做日志，是因为数据文件中的数据是追加写入的，类型日志格式
 type LogRecord struct {
 	Key   []byte        // 键
 	Value []byte        //值
 	Type  LogRecordType // 日志类型
+	Codec CodecType     // value 的压缩算法，NoCompression 表示没有压缩
+
+	Namespace uint32 // 记录所属的命名空间，0 表示默认的命名空间
 }
 
 // LogRecord 的头部信息
 type logRecordHeader struct {
-	crc        uint32        // crc 校验值
+	crc        uint32        // crc 校验值，即 4 字节的校验值
+	checksum   uint64        // 校验值，4 字节和 8 字节的校验算法通用
 	recordType LogRecordType // 标识 LogRecord 的类型
+	codec      CodecType     // value 的压缩算法
 	keySize    uint32        // key 的长度
 	valueSize  uint32        // value 的长度
+	namespace  uint32        // 记录所属的命名空间
 }
 
 // LogRecordPos 数据内存索引，主要是描述数据在磁盘上的位置
@@ -45,21 +82,23 @@ type LogRecordPos struct {
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+//	+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |   namespace  |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+--------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）   变长（最大5）     变长           变长
+//
+// type 字节的低 3 位是日志类型，第 4 位标识是否有 namespace 字段，高 4 位是 value 的压缩算法
+// 默认命名空间的记录没有 namespace 字段，和之前的格式完全一致
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
-	// 初始化一个 header 部分的字节数组
-	header := make([]byte, maxLogRecordHeaderSize)
+	return encodeLogRecord(logRecord, ChecksumCRC32)
+}
 
-	// 第五个字节存储 Type
-	header[4] = logRecord.Type
-	var index = 5
-	// 5 字节之后，存储的是 key 和 value 的长度信息
-	// 使用变长类型，节省空间
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+// encodeLogRecord 使用指定的校验算法对 LogRecord 进行编码，8 字节的校验算法会让 header 变长 4 个字节
+func encodeLogRecord(logRecord *LogRecord, checksum ChecksumType) ([]byte, int64) {
+	sumSize := checksumSize(checksum)
+	// 初始化一个 header 部分的字节数组
+	header := make([]byte, maxHeaderSize(sumSize))
+	index := encodeLogRecordHeader(logRecord, header, sumSize)
 
 	var size = index + len(logRecord.Key) + len(logRecord.Value)
 	encBytes := make([]byte, size)
@@ -70,25 +109,50 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	copy(encBytes[index:], logRecord.Key)
 	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
 
-	// 对整个 LogRecord 的数据进行 crc 校验
-	crc := crc32.ChecksumIEEE(encBytes[4:])
-	binary.LittleEndian.PutUint32(encBytes[:4], crc)
+	// 对整个 LogRecord 的数据进行校验
+	putChecksum(encBytes[:sumSize], computeChecksum(checksum, encBytes[sumSize:]))
 
 	return encBytes, int64(size)
 }
 
+// encodeLogRecordHeader 对 LogRecord 的 Header 信息进行编码，前 sumSize 个字节的校验值留空，返回 header 的长度
+func encodeLogRecordHeader(logRecord *LogRecord, header []byte, sumSize int) int {
+	// 校验值之后的一个字节存储 Type 和压缩算法
+	header[sumSize] = logRecord.Type | logRecord.Codec<<codecShift
+	if logRecord.Namespace != 0 {
+		header[sumSize] |= namespaceFlag
+	}
+	var index = sumSize + 1
+	// 之后存储的是 key 和 value 的长度信息
+	// 使用变长类型，节省空间
+	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
+	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	if logRecord.Namespace != 0 {
+		index += binary.PutUvarint(header[index:], uint64(logRecord.Namespace))
+	}
+	return index
+}
+
 // decodeLogRecordHeader 对字节数组中的 Header 信息进行解码
 func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
-	if len(buf) <= 4 {
+	return decodeLogRecordHeaderWith(buf, crc32.Size)
+}
+
+// decodeLogRecordHeaderWith 对校验值为 sumSize 个字节的 Header 信息进行解码
+func decodeLogRecordHeaderWith(buf []byte, sumSize int) (*logRecordHeader, int64) {
+	if len(buf) <= sumSize {
 		return nil, 0
 	}
 
+	checksum := readChecksum(buf[:sumSize])
 	header := &logRecordHeader{
-		crc:        binary.LittleEndian.Uint32(buf[:4]),
-		recordType: buf[4],
+		crc:        uint32(checksum),
+		checksum:   checksum,
+		recordType: buf[sumSize] & logRecordTypeMask,
+		codec:      buf[sumSize] >> codecShift,
 	}
 
-	var index = 5
+	var index = sumSize + 1
 	// 取出实际的 key size
 	keySize, n := binary.Varint(buf[index:])
 	header.keySize = uint32(keySize)
@@ -99,6 +163,13 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	// 取出记录所属的命名空间
+	if buf[sumSize]&namespaceFlag != 0 {
+		namespace, n := binary.Uvarint(buf[index:])
+		header.namespace = uint32(namespace)
+		index += n
+	}
+
 	return header, int64(index)
 }
 
@@ -108,9 +179,29 @@ func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(header[:])
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, lr.Value)
+	crc := uint32(getLogRecordChecksum(ChecksumCRC32, lr, header))
 
 	return crc
 }
+
+// getLogRecordChecksum 使用指定的校验算法计算日志记录的校验值，header 不包含校验值本身
+func getLogRecordChecksum(checksum ChecksumType, lr *LogRecord, header []byte) uint64 {
+	return computeChecksum(checksum, header, lr.Key, lr.Value)
+}
+
+// putChecksum 根据 buf 的长度写入 4 字节或者 8 字节的校验值
+func putChecksum(buf []byte, checksum uint64) {
+	if len(buf) == 8 {
+		binary.LittleEndian.PutUint64(buf, checksum)
+		return
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(checksum))
+}
+
+// readChecksum 根据 buf 的长度读取 4 字节或者 8 字节的校验值
+func readChecksum(buf []byte) uint64 {
+	if len(buf) == 8 {
+		return binary.LittleEndian.Uint64(buf)
+	}
+	return uint64(binary.LittleEndian.Uint32(buf))
+}
@@ -0,0 +1,78 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/21 21:10
+// @Desc 键值分离的值日志文件和指向其中记录的指针
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidValuePointer = errors.New("invalid value pointer, log record maybe corrupted")
+)
+
+const ValueLogFileNameSuffix = ".vlog"
+
+// ValuePointer 指向值日志中的一条记录
+// 值日志的记录和数据文件的记录格式相同，同样包含 key，垃圾回收时根据 key 判断 value 是否仍然有效
+type ValuePointer struct {
+	Fid    uint32 // 值日志文件 id
+	Offset int64  // 记录在值日志文件中的偏移
+	Size   int64  // 记录在值日志文件中占用的长度
+}
+
+// GetValueLogFileName 获取值日志文件的完整路径
+func GetValueLogFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+ValueLogFileNameSuffix)
+}
+
+// OpenValueLogFile 打开值日志文件，值日志文件的文件头和记录格式与数据文件相同
+func OpenValueLogFile(dirPath string, fileId uint32, options FileOptions) (*DataFile, error) {
+	return openDataFile(GetValueLogFileName(dirPath, fileId), fileId, options)
+}
+
+// EncodeValuePointer 对 ValuePointer 进行编码
+func EncodeValuePointer(vp *ValuePointer) []byte {
+	return appendValuePointer(nil, vp)
+}
+
+// DecodeValuePointer 对 ValuePointer 进行解码
+func DecodeValuePointer(buf []byte) (*ValuePointer, error) {
+	vp, n := readValuePointer(buf)
+	if n <= 0 || n != len(buf) {
+		return nil, ErrInvalidValuePointer
+	}
+	return vp, nil
+}
+
+// appendValuePointer 将编码之后的 ValuePointer 追加到 buf 中
+func appendValuePointer(buf []byte, vp *ValuePointer) []byte {
+	buf = binary.AppendUvarint(buf, uint64(vp.Fid))
+	buf = binary.AppendVarint(buf, vp.Offset)
+	return binary.AppendVarint(buf, vp.Size)
+}
+
+// readValuePointer 从 buf 的开头解码 ValuePointer，返回读取的字节数，数据不完整时返回 0
+func readValuePointer(buf []byte) (*ValuePointer, int) {
+	var index = 0
+	fid, n := binary.Uvarint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	index += n
+	offset, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	index += n
+	size, n := binary.Varint(buf[index:])
+	if n <= 0 {
+		return nil, 0
+	}
+	index += n
+	return &ValuePointer{Fid: uint32(fid), Offset: offset, Size: size}, index
+}
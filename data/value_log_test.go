@@ -0,0 +1,59 @@
+// Package data
+// @Author NuyoahCh
+// @Date 2025/2/21 21:10
+// @Desc
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestEncodeValuePointer(t *testing.T) {
+	// 1.正常编码解码
+	vp := &ValuePointer{Fid: 12, Offset: 1 << 30, Size: 4096}
+	res, err := DecodeValuePointer(EncodeValuePointer(vp))
+	assert.Nil(t, err)
+	assert.Equal(t, vp, res)
+
+	// 2.零值
+	res2, err := DecodeValuePointer(EncodeValuePointer(&ValuePointer{}))
+	assert.Nil(t, err)
+	assert.Equal(t, &ValuePointer{}, res2)
+
+	// 3.不完整或者多余的数据
+	buf := EncodeValuePointer(vp)
+	_, err = DecodeValuePointer(buf[:len(buf)-1])
+	assert.Equal(t, ErrInvalidValuePointer, err)
+	_, err = DecodeValuePointer(append(buf, 0))
+	assert.Equal(t, ErrInvalidValuePointer, err)
+	_, err = DecodeValuePointer(nil)
+	assert.Equal(t, ErrInvalidValuePointer, err)
+}
+
+func TestOpenValueLogFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog")
+	defer os.RemoveAll(dir)
+
+	vlogFile, err := OpenValueLogFile(dir, 0, FileOptions{})
+	assert.Nil(t, err)
+	enc, size := vlogFile.EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask")})
+	offset := vlogFile.WriteOff
+	assert.Nil(t, vlogFile.Write(enc))
+	assert.Nil(t, vlogFile.Close())
+
+	// 值日志文件和数据文件的 id 相互独立
+	_, err = os.Stat(GetValueLogFileName(dir, 0))
+	assert.Nil(t, err)
+	_, err = os.Stat(GetDataFileName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+
+	vlogFile, err = OpenValueLogFile(dir, 0, FileOptions{})
+	assert.Nil(t, err)
+	rec, readSize, err := vlogFile.ReadLogRecord(offset)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask"), rec.Value)
+	assert.Equal(t, size, readSize)
+	assert.Nil(t, vlogFile.Close())
+}
@@ -5,6 +5,8 @@
 package kv_projects
 
 import (
+	"compress/flate"
+	"context"
 	"errors"
 	"io"
 	"kv-projects/data"
@@ -14,24 +16,66 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // DB bitcask 存储引擎实例
 type DB struct {
-	options    Options                   //文件执行的选项
-	mu         *sync.RWMutex             // 创建读写锁
-	fileIds    []int                     // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新和使用
-	activeFile *data.DataFile            // 当前的活跃数据文件，可以用于写入
-	olderFiles map[uint32]*data.DataFile // 旧的数据文件，只能用于读
-	index      index.Indexer             // 内存索引
+	options     Options                            //文件执行的选项
+	mu          *sync.RWMutex                      // 创建读写锁
+	fileIds     []int                              // 文件 id，只能在加载索引的时候使用，不能在其他的地方更新和使用
+	activeFile  *data.DataFile                     // 当前的活跃数据文件，可以用于写入
+	olderFiles  map[uint32]*data.DataFile          // 旧的数据文件，只能用于读
+	index       index.Indexer                      // 内存索引
+	keyLocks    *keyLocks                          // key 级别的分段悲观锁，和 mu 相互独立
+	groupCommit *groupCommitter                    // 组提交，合并并发的写入
+	bytesWrite  uint                               // 累计写了多少个字节，持久化之后清零
+	codecs      map[data.CodecType]data.Compressor // 可用于解压的压缩算法
+	fileOptions data.FileOptions                   // 新建数据文件时使用的配置
+	valueLog    *valueLog                          // 键值分离的值日志
+	cache       *recordCache                       // 日志记录的缓存，为 nil 表示没有开启
+	bloom       atomic.Pointer[index.BloomFilter]  // 所有 key 的布隆过滤器，为 nil 表示没有开启
+	committed   atomic.Uint64                      // 已经写入的位置，订阅者只读取这个位置之前的记录
+	mergedSeq   atomic.Uint64                      // 最近一次合并时已经写入的位置，之前的记录已经被合并
+	notifier    commitNotifier                     // 有新的写入时通知订阅者
+	watchers    *watchTrie                         // 按照前缀组织的监听者
+	closed      atomic.Bool                        // 数据库是否已经关闭
+	readOnly    bool                               // 只读的从节点，数据文件只由复制写入
+	done        chan struct{}                      // 数据库关闭时被关闭，通知监听协程退出
+	metrics     *metrics                           // 运行状态的指标
+
+	// 所有数据文件（包括活跃文件）的只读快照，写路径在持有 mu 时整体替换
+	// 读路径直接原子地读取快照，不需要获取 mu，因此读不会被写阻塞
+	dataFiles atomic.Pointer[map[uint32]*data.DataFile]
+
+	// 命名空间，修改时需要持有 mu
+	registry       index.Indexer         // 命名空间注册表的索引
+	namespaces     map[string]*Namespace // 按照名称查找命名空间
+	namespaceIds   map[uint32]*Namespace // 按照 id 查找命名空间
+	maxNamespaceId uint32                // 已经使用过的最大的命名空间 id
+
+	// 加载索引时还没有提交的批次，修改时需要持有 mu
+	batching     bool            // 是否读取到了批次的开始记录
+	pendingBatch []pendingRecord // 批次中已经读取到的记录
+
+	// 二级索引，按照名称查找，打开之后不再修改
+	secondaryIndexes map[string]*secondaryIndex
 }
 
 // Open 打开 bitcask 存储引擎实例
 func Open(options Options) (*DB, error) {
+	return open(options, false)
+}
+
+// open 打开存储引擎实例，只读时不会新建数据文件和值日志文件，所有的文件都来自主节点
+func open(options Options, readOnly bool) (*DB, error) {
 	// 对用户传入的配置项进行校验
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
+	if options.Comparator == nil {
+		options.Comparator = index.BytewiseComparator
+	}
 
 	// 判断数据目录是否存在，如果不存在的话，则创建这个目录
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
@@ -42,32 +86,162 @@ func Open(options Options) (*DB, error) {
 
 	// 初始化 DB 实例结构体
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType),
+		options:      options,
+		mu:           new(sync.RWMutex),
+		olderFiles:   make(map[uint32]*data.DataFile),
+		index:        index.NewIndexer(options.IndexType, options.IndexShards, options.Comparator),
+		registry:     index.NewBTree(),
+		namespaces:   make(map[string]*Namespace),
+		namespaceIds: make(map[uint32]*Namespace),
+		keyLocks:     newKeyLocks(),
+		groupCommit:  newGroupCommitter(),
+		codecs:       make(map[data.CodecType]data.Compressor),
+		valueLog:     newValueLog(),
+		cache:        newRecordCache(options.BlockCacheSize),
+		watchers:     newWatchTrie(),
+		done:         make(chan struct{}),
+		metrics:      newMetrics(),
+		readOnly:     readOnly,
+	}
+
+	// 内置的压缩算法总是可以用于解压
+	flateCompressor, err := data.NewFlateCompressor(flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	db.codecs[flateCompressor.Codec()] = flateCompressor
+	if options.Compression != nil {
+		db.codecs[options.Compression.Codec()] = options.Compression
+	}
+
+	// 初始化加密的密钥环
+	keyRing, err := data.NewKeyRing(options.EncryptionKey, options.PreviousEncryptionKeys...)
+	if err != nil {
+		return nil, err
 	}
+	db.fileOptions = data.FileOptions{KeyRing: keyRing, Checksum: options.Checksum}
 
 	// 加载数据文件
 	if err := db.loadDataFiles(); err != nil {
 		return nil, err
 	}
 
+	// 检查比较器和创建数据库时使用的是否一致
+	if err := db.checkComparator(); err != nil {
+		return nil, err
+	}
+
 	// 从数据文件中加载索引
 	if err := db.loadIndexFromDataFiles(); err != nil {
 		return nil, err
 	}
 
+	// 活跃文件是旧的格式版本，或者不是使用当前密钥加密的（例如刚刚轮换了密钥），新的数据写入到新的文件中
+	// 旧的文件仍然可以读取，合并之后会全部重写为当前的格式
+	if !readOnly && db.activeFile != nil && !db.activeFile.MatchesOptions(db.fileOptions) {
+		db.olderFiles[db.activeFile.FileId] = db.activeFile
+		if err := db.setActiveDataFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	// 加载值日志文件，关闭了键值分离时，之前分离的 value 仍然可以读取
+	if err := db.loadValueLogFiles(); err != nil {
+		return nil, err
+	}
+
+	// 放弃崩溃时没有写完的批次
+	if err := db.abortPendingBatch(); err != nil {
+		return nil, err
+	}
+
+	// 加载二级索引，缺少的索引根据已有的数据重新构建
+	if err := db.loadSecondaryIndexes(); err != nil {
+		return nil, err
+	}
+
+	// 根据加载的索引构建布隆过滤器
+	db.rebuildBloomFilter()
+
+	// 发布已经写入的位置，最小的文件之前的记录都已经被合并
+	if len(db.fileIds) > 0 {
+		db.mergedSeq.Store(makeSeq(uint32(db.fileIds[0]), 0))
+	}
+	db.publishCommitted()
+
 	return db, nil
 }
 
+// Close 关闭数据库，持久化并关闭所有的数据文件，等待中的订阅者会返回 ErrDBClosed，监听的 channel 会被关闭
+func (db *DB) Close() error {
+	unlock := db.keyLocks.lockAll()
+	defer unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed.Swap(true) {
+		return nil
+	}
+	defer db.notifier.broadcast()
+	close(db.done)
+
+	if err := db.syncActiveFiles(); err != nil {
+		return err
+	}
+	files := []*data.DataFile{db.activeFile, db.valueLog.activeFile}
+	for _, dataFile := range db.olderFiles {
+		files = append(files, dataFile)
+	}
+	for _, dataFile := range db.valueLog.olderFiles {
+		files = append(files, dataFile)
+	}
+	for _, dataFile := range files {
+		if dataFile == nil {
+			continue
+		}
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync 持久化活跃的数据文件和值日志文件
+func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	return db.syncActiveFiles()
+}
+
 // Put 写入 Key/Value 数据，key 不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.PutCtx(context.Background(), key, value)
+}
+
+// PutCtx 写入 Key/Value 数据，等待分段锁和组提交期间 ctx 结束时放弃写入，返回 ctx 的错误
+// 写入已经被组提交的 leader 取走之后无法撤回，仍然等待写入的结果
+func (db *DB) PutCtx(ctx context.Context, key []byte, value []byte) (err error) {
 	// 判断 key 是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	ctx, end := db.startOp(ctx, "put", key)
+	defer func() { end(err) }()
 
+	// 和 Update 中的读-改-写互斥
+	unlock, err := db.keyLocks.lockKeyCtx(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return db.put(ctx, key, value)
+}
+
+// put 写入 Key/Value 数据，调用方需要持有 key 对应的分段锁
+func (db *DB) put(ctx context.Context, key []byte, value []byte) error {
 	// 构造 LogRecord 结构体
 	logRecord := &data.LogRecord{
 		Key:   key,
@@ -75,25 +249,50 @@ func (db *DB) Put(key []byte, value []byte) error {
 		Type:  data.LogRecordNormal,
 	}
 
+	// 二级索引的记录和数据在同一个批次中写入
+	indexRecords, err := db.secondaryIndexRecordsOf(key, value, true)
+	if err != nil {
+		return err
+	}
+
 	// 追加写入到当前活跃数据文件当中
-	pos, err := db.appendLogRecord(logRecord)
+	positions, err := db.appendLogRecordsWithContext(ctx, append([]*data.LogRecord{logRecord}, indexRecords...))
 	if err != nil {
 		return err
 	}
 	// 更新内存索引
-	if ok := db.index.Put(key, pos); !ok {
+	db.addToBloomFilter(key)
+	if ok := db.index.Put(key, positions[0]); !ok {
 		return ErrIndexUpdateFailed
 	}
-	return nil
+	return db.applySecondaryIndexRecords(indexRecords, positions[1:])
 }
 
 // Delete 根据 key 删除对应的数据
 func (db *DB) Delete(key []byte) error {
+	return db.DeleteCtx(context.Background(), key)
+}
+
+// DeleteCtx 根据 key 删除对应的数据，ctx 的作用和 PutCtx 相同
+func (db *DB) DeleteCtx(ctx context.Context, key []byte) (err error) {
 	// 判断 key 的有效性
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	ctx, end := db.startOp(ctx, "delete", key)
+	defer func() { end(err) }()
+
+	// 和 Update 中的读-改-写互斥
+	unlock, err := db.keyLocks.lockKeyCtx(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return db.delete(ctx, key)
+}
 
+// delete 删除 key 对应的数据，调用方需要持有 key 对应的分段锁
+func (db *DB) delete(ctx context.Context, key []byte) error {
 	// 先检查 key 是否存在，如果不存在的话直接返回
 	if pos := db.index.Get(key); pos == nil {
 		return nil
@@ -101,10 +300,14 @@ func (db *DB) Delete(key []byte) error {
 
 	// 构造 LogRecord，标识其是被删除的
 	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	indexRecords, err := db.secondaryIndexRecordsOf(key, nil, false)
+	if err != nil {
+		return err
+	}
 	// 写入到数据文件当中
-	_, err := db.appendLogRecord(logRecord)
+	positions, err := db.appendLogRecordsWithContext(ctx, append([]*data.LogRecord{logRecord}, indexRecords...))
 	if err != nil {
-		return nil
+		return err
 	}
 
 	//	从内存索引中将对应的 key 删除
@@ -112,55 +315,142 @@ func (db *DB) Delete(key []byte) error {
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
-	return nil
+	return db.applySecondaryIndexRecords(indexRecords, positions[1:])
 }
 
 // Get 根据 key 读取数据
+// 读路径不获取 db.mu：索引自身是并发安全的，数据文件通过只读快照获取，记录写入之后不会再被修改
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.Lock()         // 操作前先加锁，保证并发安全
-	defer db.mu.Unlock() // 兜底策略，保证一定会解锁，防止死锁的现象
+	return db.GetCtx(context.Background(), key)
+}
 
+// GetCtx 根据 key 读取数据，读路径不需要等待锁，ctx 只在读取之前检查是否已经结束，并用于跟踪
+func (db *DB) GetCtx(ctx context.Context, key []byte) (value []byte, err error) {
 	// 判断 key 的有效性
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
-	// 从内存数据结构中取出 key 对应的索引信息
-	logRecordPos := db.index.Get(key)
-	// 如果 key 不在内存索引中，说明 key 不存在
-	if logRecordPos == nil {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, end := db.startOp(ctx, "get", key)
+	defer func() { end(err) }()
+
+	db.metrics.gets.Add(1)
+	// 布隆过滤器判断 key 一定不存在时直接返回
+	if !db.mayContain(key) {
 		return nil, ErrKeyNotFound
 	}
+	return db.getFromIndex(ctx, db.index, key)
+}
+
+// getFromIndex 根据 idx 中 key 的位置读取数据
+func (db *DB) getFromIndex(ctx context.Context, idx index.Indexer, key []byte) ([]byte, error) {
+	for {
+		// 从内存数据结构中取出 key 对应的索引信息
+		_, endLookup := db.startSpan(ctx, SpanIndexLookup)
+		logRecordPos := idx.Get(key)
+		endLookup(nil)
+		// 如果 key 不在内存索引中，说明 key 不存在
+		if logRecordPos == nil {
+			return nil, ErrKeyNotFound
+		}
+
+		// 根据索引信息读取对应的 value
+		_, endRead := db.startSpan(ctx, SpanDiskRead)
+		value, err := db.getValueByPosition(logRecordPos)
+		endRead(err)
+		// 合并会先更新索引，再关闭旧的数据文件，索引已经指向新的位置时重新读取即可
+		if db.isFileRetired(err) && idx.Get(key) != logRecordPos {
+			continue
+		}
+		return value, err
+	}
+}
 
-	// 根据文件 id 找到对应的数据文件
-	var dataFile *data.DataFile
-	// 活跃文件的 id 和日志记录位置 id
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
+// isFileRetired 读取失败是否是因为数据文件在合并之后被关闭了
+func (db *DB) isFileRetired(err error) bool {
+	return err == ErrDataFileNotFound || errors.Is(err, os.ErrClosed)
+}
+
+// getValueByPosition 根据索引信息读取对应的 value
+func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	logRecord, err := db.readLogRecordByPosition(logRecordPos)
+	if err != nil {
+		return nil, err
 	}
+	return db.valueOfLogRecord(logRecord)
+}
+
+// readLogRecordByPosition 根据索引信息读取数据文件中的记录
+func (db *DB) readLogRecordByPosition(logRecordPos *data.LogRecordPos) (*data.LogRecord, error) {
+	// 根据文件 id 从快照中找到对应的数据文件
+	// 索引中的位置一定是在对应文件发布到快照之后才写入的，因此快照中一定能找到
+	dataFile := (*db.dataFiles.Load())[logRecordPos.Fid]
 	// 数据文件为空
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
 	}
+	// 先从缓存中读取
+	key := cacheKey{fid: logRecordPos.Fid, offset: logRecordPos.Offset}
+	if logRecord, ok := db.cache.get(key); ok {
+		return logRecord, nil
+	}
 	// 根据偏移读取对应的数据
 	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
 	if err != nil {
 		return nil, err
 	}
-	// 日志记录类型已经被删除
-	if logRecord.Type == data.LogRecordDeleted {
+	db.cache.put(key, logRecord)
+	return logRecord, nil
+}
+
+// valueOfLogRecord 根据数据文件中的记录得到对应的 value
+func (db *DB) valueOfLogRecord(logRecord *data.LogRecord) ([]byte, error) {
+	switch logRecord.Type {
+	case data.LogRecordDeleted:
+		// 日志记录类型已经被删除
 		return nil, ErrKeyNotFound
+	case data.LogRecordValuePointer:
+		// value 存储在值日志中，根据指针读取
+		return db.readValueLog(logRecord.Value)
+	case data.LogRecordChunkManifest:
+		// 分块写入的 value，读取所有的块
+		return db.readChunkedValue(logRecord.Value)
+	}
+	// 返回日志的值，压缩过的值需要先解压
+	return db.decompressValue(logRecord)
+}
+
+// appendLogRecordWithLock 加锁后追加写数据到活跃文件中
+// 并发的写入会通过组提交合并，由一个 leader 一起写入并且只持久化一次
+func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	positions, err := db.appendLogRecordsWithLock([]*data.LogRecord{logRecord})
+	if err != nil {
+		return nil, err
 	}
-	// 返回日志的值
-	return logRecord.Value, nil
+	return positions[0], nil
 }
 
-// appendLogRecord 追加写数据到活跃文件中
+// appendLogRecord 追加写数据到活跃文件中，并根据配置决定是否持久化，调用方需要持有 db.mu
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()         // 操作前先加锁，保证并发安全
-	defer db.mu.Unlock() // 兜底策略，保证一定会解锁，防止死锁的现象
+	positions, err := db.appendLogRecords([]*data.LogRecord{logRecord})
+	if err != nil {
+		return nil, err
+	}
+	return positions[0], nil
+}
 
+// writeLogRecord 写数据到活跃文件中，不做持久化，调用方需要持有 db.mu
+func (db *DB) writeLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	// 大 value 先写入到值日志中，数据文件中只写入指针
+	if db.shouldSeparateValue(logRecord) {
+		pointer, err := db.writeValueLog(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		logRecord = pointer
+	}
 	// 判断当前活跃数据文件是否存在，因为数据库在没有写入的时候是没有文件生成的
 	// 如果为空则初始化数据文件
 	if db.activeFile == nil {
@@ -169,13 +459,14 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 	// 写入数据编码
-	encRecord, size := data.EncodeLogRecord(logRecord)
+	encRecord, size := db.activeFile.EncodeLogRecord(logRecord)
 	// 如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并且打开新的文件
 	if db.activeFile.WriteOff+size > db.options.DataFileSize {
 		// 先同步持久化数据文件，保证已有的数据持久化到磁盘当中
-		if err := db.activeFile.Sync(); err != nil {
+		if err := db.syncDataFile(db.activeFile); err != nil {
 			return nil, err
 		}
+		db.metrics.dataFileRotations.Add(1)
 		// 当前活跃文件转化为旧的数据文件
 		db.olderFiles[db.activeFile.FileId] = db.activeFile
 
@@ -183,23 +474,87 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		if err := db.setActiveDataFile(); err != nil {
 			return nil, err
 		}
+		// 加密的数据和写入的位置有关，需要重新编码
+		encRecord, size = db.activeFile.EncodeLogRecord(logRecord)
 	}
 	// 文件写入的位置
 	writeOff := db.activeFile.WriteOff
 	if err := db.activeFile.Write(encRecord); err != nil {
 		return nil, err
 	}
-	// 根据用户配置决定是否持久化
-	if db.options.SyncWrites {
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-	}
+	db.bytesWrite += uint(size)
+	db.metrics.bytesWritten.Add(uint64(size))
 	// 构造内存索引信息，确定其位置
 	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff}
 	return pos, nil
 }
 
+// syncAfterWrite 根据用户配置决定是否持久化活跃文件，调用方需要持有 db.mu
+func (db *DB) syncAfterWrite(ctx context.Context) error {
+	var needSync = db.options.SyncWrites
+	// 没有开启每次写入持久化时，累计写入的字节数达到阈值也进行持久化
+	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
+		needSync = true
+	}
+	if needSync {
+		_, end := db.startSpan(ctx, SpanFsync)
+		err := db.syncActiveFiles()
+		end(err)
+		if err != nil {
+			return err
+		}
+		// 清空累计值
+		db.bytesWrite = 0
+	}
+	return nil
+}
+
+// syncActiveFiles 持久化活跃的值日志文件和数据文件，调用方需要持有 db.mu
+// 先持久化值日志，保证数据文件中持久化的指针指向的 value 一定存在
+func (db *DB) syncActiveFiles() error {
+	if err := db.syncValueLogFile(); err != nil {
+		return err
+	}
+	if db.activeFile == nil {
+		return nil
+	}
+	return db.syncDataFile(db.activeFile)
+}
+
+// compressLogRecord 根据用户配置压缩日志记录的 value，只有压缩之后更小才使用压缩的数据
+func (db *DB) compressLogRecord(logRecord *data.LogRecord) error {
+	compressor := db.options.Compression
+	// 注册表的记录在加载索引时解码，不压缩
+	if logRecord.Namespace == systemNamespace {
+		return nil
+	}
+	if compressor == nil || logRecord.Type != data.LogRecordNormal ||
+		len(logRecord.Value) < db.options.CompressionMinSize {
+		return nil
+	}
+	compressed, err := compressor.Compress(logRecord.Value)
+	if err != nil {
+		return err
+	}
+	if len(compressed) < len(logRecord.Value) {
+		logRecord.Value = compressed
+		logRecord.Codec = compressor.Codec()
+	}
+	return nil
+}
+
+// decompressValue 根据日志记录中的压缩算法解压 value
+func (db *DB) decompressValue(logRecord *data.LogRecord) ([]byte, error) {
+	if logRecord.Codec == data.NoCompression {
+		return logRecord.Value, nil
+	}
+	compressor, ok := db.codecs[logRecord.Codec]
+	if !ok {
+		return nil, data.ErrUnknownCodec
+	}
+	return compressor.Decompress(logRecord.Value)
+}
+
 // setActiveDataFile 设置当前活跃文件，访问之前必须持有互斥锁
 func (db *DB) setActiveDataFile() error {
 	var initialFileId uint32 = 0 // 初始化文件 id
@@ -208,35 +563,75 @@ func (db *DB) setActiveDataFile() error {
 		initialFileId = db.activeFile.FileId + 1 // 更改初始文件 id
 	}
 	// 打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId)
+	dataFile, err := data.OpenDataFileWithOptions(db.options.DirPath, initialFileId, db.fileOptions)
 	if err != nil {
 		return err
 	}
 	// 新的数据文件传递给活跃文件
 	db.activeFile = dataFile
+	db.refreshDataFiles()
 	return nil
 }
 
+// refreshDataFiles 重新发布数据文件的只读快照，访问之前必须持有互斥锁
+func (db *DB) refreshDataFiles() {
+	files := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		files[fid] = dataFile
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileId] = db.activeFile
+	}
+	db.dataFiles.Store(&files)
+}
+
 // loadDataFiles 从磁盘中加载数据文件
 func (db *DB) loadDataFiles() error {
+	fileIds, err := db.scanFileIds(data.DataFileNameSuffix)
+	if err != nil {
+		return err
+	}
+	db.fileIds = fileIds // 放回到数据库中进行存储
+
+	// 遍历每个文件 id，打开对应的数据文件
+	for i, fid := range fileIds {
+		// 打开对应文件
+		dataFile, err := data.OpenDataFileWithOptions(db.options.DirPath, uint32(fid), db.fileOptions)
+		if err != nil {
+			return err
+		}
+
+		// 最后一个，id 是最大的，说明是当前的活跃文件
+		if i == len(fileIds)-1 {
+			db.activeFile = dataFile
+		} else { // 说明是旧的文件
+			db.olderFiles[uint32(fid)] = dataFile
+		}
+	}
+	db.refreshDataFiles()
+	return nil
+}
+
+// scanFileIds 找到数据目录中所有以 suffix 结尾的文件，返回从小到大排序的文件 id
+func (db *DB) scanFileIds(suffix string) ([]int, error) {
 	// 读取文件目录
 	dirEntries, err := os.ReadDir(db.options.DirPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var fileIds []int
-	// 遍历目录中的所有的文件，找到所有以 .data 结尾的文件
+	// 遍历目录中的所有的文件，找到所有以 suffix 结尾的文件
 	for _, entry := range dirEntries {
-		// 字符串是否以后缀结束 DataFileNameSuffix
-		if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+		// 字符串是否以后缀结束
+		if strings.HasSuffix(entry.Name(), suffix) {
 			// 遍历出来的所有文件都以 "." 的方式进行分割
 			spiltNames := strings.Split(entry.Name(), ".")
 			// 转化成为数字
 			fileId, err := strconv.Atoi(spiltNames[0])
 			// 数据目录有可能损坏了
 			if err != nil {
-				return ErrDataDirectoryCorrupted
+				return nil, ErrDataDirectoryCorrupted
 			}
 			// 追加到文件的 Id 上
 			fileIds = append(fileIds, fileId)
@@ -245,24 +640,7 @@ func (db *DB) loadDataFiles() error {
 
 	// 对文件 id 进行排序，从小到大一次进行加载
 	sort.Ints(fileIds)
-	db.fileIds = fileIds // 放回到数据库中进行存储
-
-	// 遍历每个文件 id，打开对应的数据文件
-	for i, fid := range fileIds {
-		// 打开对应文件
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fid))
-		if err != nil {
-			return err
-		}
-
-		// 最后一个，id 是最大的，说明是当前的活跃文件
-		if i == len(fileIds)-1 {
-			db.activeFile = dataFile
-		} else { // 说明是旧的文件
-			db.olderFiles[uint32(fid)] = dataFile
-		}
-	}
-	return nil
+	return fileIds, nil
 }
 
 // loadIndexFromDataFiles 从数据文件中加载索引，遍历文件中所有记录，更新到内存索引中
@@ -273,7 +651,7 @@ func (db *DB) loadIndexFromDataFiles() error {
 	}
 
 	// 遍历所有的文件 id，处理文件中的记录
-	for i, fid := range db.fileIds {
+	for _, fid := range db.fileIds {
 		// 文件 id
 		var fileId = uint32(fid)
 		// 数据文件
@@ -285,35 +663,62 @@ func (db *DB) loadIndexFromDataFiles() error {
 			dataFile = db.olderFiles[fileId]
 		}
 
-		var offset int64 = 0
-		for {
-			// 读取日志记录
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				// io 异常
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			// 构造内存索引并且保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset}
-			var ok bool
-			if logRecord.Type == data.LogRecordDeleted {
-				ok = db.index.Delete(logRecord.Key)
-			} else {
-				ok = db.index.Put(logRecord.Key, logRecordPos)
-			}
-			if !ok {
-				return ErrIndexUpdateFailed
+		// 跳过文件头，从第一条日志记录开始读取
+		offset, err := db.indexLogRecords(dataFile, dataFile.HeaderSize())
+		if err != nil {
+			return err
+		}
+		// 更新文件的 WriteOff，活跃文件从这里继续写入，从节点从这里继续回放
+		dataFile.WriteOff = offset
+	}
+	return nil
+}
+
+// indexLogRecords 从 offset 开始依次读取数据文件中的记录并更新内存索引，返回读取结束的位置
+func (db *DB) indexLogRecords(dataFile *data.DataFile, offset int64) (int64, error) {
+	for {
+		// 读取日志记录
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			// io 异常
+			if err == io.EOF {
+				return offset, nil
 			}
-			// 递增 offset，下一次从新的位置开始读取
-			offset += size
+			return 0, err
 		}
-		// 如果是当前活跃文件，更新这个文件的 WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		// 构造内存索引并且保存，批次中的记录在提交之后才更新索引
+		logRecordPos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset}
+		if err := db.replayLogRecord(logRecord, logRecordPos); err != nil {
+			return 0, err
 		}
+		// 递增 offset，下一次从新的位置开始读取
+		offset += size
+	}
+}
+
+// indexLogRecord 根据一条记录更新对应命名空间的内存索引
+func (db *DB) indexLogRecord(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) error {
+	// 命名空间中的记录更新各自的索引
+	if logRecord.Namespace != 0 {
+		return db.indexNamespaceRecord(logRecord, logRecordPos)
+	}
+	var ok bool
+	switch logRecord.Type {
+	case data.LogRecordDeleted:
+		// 合并按照 id 从小到大删除旧文件，中途崩溃时删除记录对应的写入可能已经随着更早的文件被删除了，
+		// 索引中没有这个 key 时删除记录不需要做任何操作
+		db.index.Delete(logRecord.Key)
+		ok = true
+	case data.LogRecordRangeDeleted:
+		// 只删除之前写入的 key，之后的写入按照顺序回放，不受影响
+		db.index.DeleteRange(logRecord.Key, rangeEnd(logRecord.Value))
+		ok = true
+	default:
+		db.addToBloomFilter(logRecord.Key)
+		ok = db.index.Put(logRecord.Key, logRecordPos)
+	}
+	if !ok {
+		return ErrIndexUpdateFailed
 	}
 	return nil
 }
@@ -326,5 +731,40 @@ func checkOptions(options Options) error {
 	if options.DataFileSize <= 0 {
 		return errors.New("database data file size must be greater than 0")
 	}
+	// 序列号的低 32 位是记录在文件中的偏移
+	if options.DataFileSize > 1<<32 {
+		return errors.New("database data file size must not be greater than 4GB")
+	}
+	if options.Compression != nil {
+		if codec := options.Compression.Codec(); codec == data.NoCompression || codec > data.MaxCodec {
+			return errors.New("compression codec must be between 1 and 15")
+		}
+	}
+	if options.Checksum > data.ChecksumXXHash64 {
+		return errors.New("unsupported checksum algorithm")
+	}
+	if options.BlockCacheSize < 0 {
+		return errors.New("block cache size must not be negative")
+	}
+	if options.BloomFilterFPRate < 0 || options.BloomFilterFPRate >= 1 {
+		return errors.New("bloom filter false positive rate must be in [0, 1)")
+	}
+	if options.BloomFilterFPRate > 0 && !isBytewise(options.Comparator) {
+		return errors.New("bloom filter requires the bytewise comparator")
+	}
+	if options.IndexType == ShardedBTree && options.IndexShards <= 0 {
+		return errors.New("the number of index shards must be greater than 0")
+	}
+	if options.Comparator != nil && options.Comparator.Name() == "" {
+		return errors.New("comparator name must not be empty")
+	}
+	if err := checkIndexComparator(options.IndexType, options.Comparator); err != nil {
+		return err
+	}
+	for name, extract := range options.SecondaryIndexes {
+		if name == "" || extract == nil {
+			return errors.New("secondary index name and extractor must not be empty")
+		}
+	}
 	return nil
 }
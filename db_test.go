@@ -5,18 +5,21 @@
 package kv_projects
 
 import (
+	"bytes"
+	"compress/flate"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
 	"kv-projects/utils"
 	"os"
+	"sync"
 	"testing"
 )
 
 // 测试完成之后销毁 DB 数据目录
 func destroyDB(db *DB) {
 	if db != nil {
-		if db.activeFile != nil {
-			_ = db.activeFile.Close() // todo 实现了 Close 方法之后，这里使用 Close 方法替代
-		}
+		_ = db.Close()
 		err := os.RemoveAll(db.options.DirPath)
 		if err != nil {
 			panic(err)
@@ -77,8 +80,7 @@ func TestDB_Put(t *testing.T) {
 	assert.Equal(t, 2, len(db.olderFiles))
 
 	// 6.重启后再 Put 数据
-	//db.Close() // todo 实现 Close 方法后这里用 Close() 替代
-	err = db.activeFile.Close()
+	err = db.Close()
 	assert.Nil(t, err)
 
 	// 重启数据库
@@ -143,8 +145,7 @@ func TestDB_Get(t *testing.T) {
 	assert.NotNil(t, val5)
 
 	// 6.重启后，前面写入的数据都能拿到
-	//db.Close() // todo 实现 Close 方法后这里用 Close() 替代
-	err = db.activeFile.Close()
+	err = db.Close()
 	assert.Nil(t, err)
 
 	// 重启数据库
@@ -203,8 +204,7 @@ func TestDB_Delete(t *testing.T) {
 	assert.Nil(t, err)
 
 	// 5.重启之后，再进行校验
-	//db.Close() // todo 实现 Close 方法后这里用 Close() 替代
-	err = db.activeFile.Close()
+	err = db.Close()
 	assert.Nil(t, err)
 
 	// 重启数据库
@@ -216,3 +216,237 @@ func TestDB_Delete(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, val1, val2)
 }
+
+// 并发读写的正确性测试，需要配合 go test -race 运行
+func TestDB_ConcurrentReadWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024 // 较小的文件，让写入过程中频繁发生文件切换
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	const writers, readers, keys, rounds = 8, 16, 200, 20
+	value := func(key []byte, round int) []byte {
+		return []byte(fmt.Sprintf("%s-value-%03d", key, round))
+	}
+
+	wg := new(sync.WaitGroup)
+	stop := make(chan struct{})
+	// 读协程：读到的值要么不存在，要么是某一轮写入的完整值
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := utils.GetTestKey(i % keys)
+				val, err := db.Get(key)
+				if err == ErrKeyNotFound {
+					continue
+				}
+				assert.Nil(t, err)
+				assert.True(t, bytes.HasPrefix(val, append(key, []byte("-value-")...)))
+			}
+		}(r)
+	}
+
+	// 写协程：每个写协程负责一部分 key，逐轮覆盖写入
+	writeWg := new(sync.WaitGroup)
+	for w := 0; w < writers; w++ {
+		writeWg.Add(1)
+		go func(w int) {
+			defer writeWg.Done()
+			for round := 0; round < rounds; round++ {
+				for i := w; i < keys; i += writers {
+					key := utils.GetTestKey(i)
+					assert.Nil(t, db.Put(key, value(key, round)))
+				}
+			}
+		}(w)
+	}
+	writeWg.Wait()
+	close(stop)
+	wg.Wait()
+
+	// 所有写入完成之后，每个 key 都是最后一轮的值
+	assert.Greater(t, len(db.olderFiles), 0)
+	for i := 0; i < keys; i++ {
+		key := utils.GetTestKey(i)
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value(key, rounds-1), val)
+	}
+}
+
+// fakeCompressor 测试使用的自定义压缩算法，去掉末尾的 x 并在最后一个字节记录去掉的个数
+type fakeCompressor struct{}
+
+func (fakeCompressor) Codec() data.CodecType { return 9 }
+
+func (fakeCompressor) Compress(src []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(src, "x")
+	return append(append([]byte{}, trimmed...), byte(len(src)-len(trimmed))), nil
+}
+
+func (fakeCompressor) Decompress(src []byte) ([]byte, error) {
+	n := int(src[len(src)-1])
+	return append(append([]byte{}, src[:len(src)-1]...), bytes.Repeat([]byte("x"), n)...), nil
+}
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	compressor, err := data.NewFlateCompressor(flate.DefaultCompression)
+	assert.Nil(t, err)
+	opts.Compression = compressor
+	opts.CompressionMinSize = 128
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.可压缩的大 value 压缩之后写入
+	bigValue := bytes.Repeat([]byte(`{"name":"bitcask","kind":"kv"}`), 100)
+	err = db.Put(utils.GetTestKey(1), bigValue)
+	assert.Nil(t, err)
+	assert.Less(t, db.activeFile.WriteOff, int64(len(bigValue)))
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, val1)
+
+	// 2.小于阈值的 value 不压缩
+	writeOff := db.activeFile.WriteOff
+	err = db.Put(utils.GetTestKey(2), []byte("small value"))
+	assert.Nil(t, err)
+	rec, _, err := db.activeFile.ReadLogRecord(writeOff)
+	assert.Nil(t, err)
+	assert.Equal(t, data.NoCompression, rec.Codec)
+
+	// 3.压缩之后没有变小的 value 存储原始数据
+	writeOff = db.activeFile.WriteOff
+	randomValue := utils.RandomValue(256)
+	err = db.Put(utils.GetTestKey(3), randomValue)
+	assert.Nil(t, err)
+	rec, _, err = db.activeFile.ReadLogRecord(writeOff)
+	assert.Nil(t, err)
+	assert.Equal(t, data.NoCompression, rec.Codec)
+	assert.Equal(t, randomValue, rec.Value)
+
+	// 4.关闭压缩之后重启，之前压缩的数据仍然可以读取
+	err = db.activeFile.Close()
+	assert.Nil(t, err)
+	opts.Compression = nil
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	val2, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, val2)
+	err = db2.activeFile.Close()
+	assert.Nil(t, err)
+
+	// 5.自定义的压缩算法
+	opts.Compression = fakeCompressor{}
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	customValue := append([]byte("custom"), bytes.Repeat([]byte("x"), 200)...)
+	err = db3.Put(utils.GetTestKey(4), customValue)
+	assert.Nil(t, err)
+	val3, err := db3.Get(utils.GetTestKey(4))
+	assert.Nil(t, err)
+	assert.Equal(t, customValue, val3)
+	err = db3.activeFile.Close()
+	assert.Nil(t, err)
+
+	// 6.没有配置自定义的压缩算法时无法解压
+	opts.Compression = nil
+	db4, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = db4.Get(utils.GetTestKey(4))
+	assert.Equal(t, data.ErrUnknownCodec, err)
+}
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.写入之后可以读取，数据文件中是密文
+	value := []byte("sensitive value in bitcask")
+	err = db.Put(utils.GetTestKey(1), value)
+	assert.Nil(t, err)
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val1)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), value)
+	assert.Nil(t, err)
+	content, err := os.ReadFile(data.GetDataFileName(dir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(content, value))
+	assert.False(t, bytes.Contains(content, utils.GetTestKey(2)))
+
+	// 2.重启之后可以读取
+	err = db.activeFile.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val2, err := db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val2)
+	err = db2.activeFile.Close()
+	assert.Nil(t, err)
+
+	// 3.错误的密钥，或者没有提供密钥
+	opts.EncryptionKey = bytes.Repeat([]byte("x"), 32)
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+	opts.EncryptionKey = nil
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+
+	// 4.非法的密钥长度
+	opts.EncryptionKey = []byte("short key")
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_Sync(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sync")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.空的数据库
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// 2.写入之后持久化
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(128))
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Nil(t, err)
+
+	// 3.关闭之后
+	err = db.Close()
+	assert.Nil(t, err)
+	err = db.Sync()
+	assert.Equal(t, ErrDBClosed, err)
+}
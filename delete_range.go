@@ -0,0 +1,101 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/6 21:15
+// @Desc 范围删除和前缀删除，只写入一条范围删除记录
+package kv_projects
+
+import (
+	"bytes"
+	"kv-projects/data"
+)
+
+// DeleteRange 删除 [start, end) 范围内所有的 key，end 为 nil 表示没有上界
+// 只写入一条范围删除记录，回放时按照顺序删除之前写入的范围内的 key，之后写入的 key 不受影响，
+// 被删除的记录在下一次合并时被清理。删除期间持有所有的分段锁，和其他的写入互斥
+func (db *DB) DeleteRange(start, end []byte) error {
+	// 空的范围
+	if end != nil && db.options.Comparator.Compare(start, end) >= 0 {
+		return nil
+	}
+
+	unlock := db.keyLocks.lockAll()
+	defer unlock()
+
+	// 二级索引中范围内的 key 对应的记录和范围删除记录在同一个批次中删除
+	indexRecords, err := db.rangeIndexRecords(start, end)
+	if err != nil {
+		return err
+	}
+	logRecord := &data.LogRecord{Key: start, Value: end, Type: data.LogRecordRangeDeleted}
+	positions, err := db.appendLogRecordsWithLock(append([]*data.LogRecord{logRecord}, indexRecords...))
+	if err != nil {
+		return err
+	}
+	db.index.DeleteRange(start, end)
+	return db.applySecondaryIndexRecords(indexRecords, positions[1:])
+}
+
+// DeletePrefix 删除前缀为 prefix 的所有 key
+// 只有按照字节序比较时前缀相同的 key 才是连续的，使用其他的比较器时返回 ErrPrefixUnordered
+func (db *DB) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if !db.bytewise() {
+		return ErrPrefixUnordered
+	}
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// rangeIndexRecords 删除 [start, end) 范围内的 key 时需要写入的二级索引记录，调用方需要持有所有的分段锁
+func (db *DB) rangeIndexRecords(start, end []byte) ([]*data.LogRecord, error) {
+	if len(db.secondaryIndexes) == 0 {
+		return nil, nil
+	}
+	var indexRecords []*data.LogRecord
+	iter := db.index.Iterator(false)
+	defer iter.Close()
+	for iter.Seek(start); iter.Valid(); iter.Next() {
+		if end != nil && db.options.Comparator.Compare(iter.Key(), end) >= 0 {
+			break
+		}
+		value, err := db.getValueByPosition(iter.Value())
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		indexRecords = append(indexRecords, db.secondaryIndexRecords(iter.Key(), value, true, nil, false)...)
+	}
+	return indexRecords, nil
+}
+
+// rangeInPrefix 范围 [start, end) 和前缀为 prefix 的 key 是否有交集，范围按照字节序比较
+func rangeInPrefix(start, end, prefix []byte) bool {
+	if end != nil && bytes.Compare(end, prefix) <= 0 {
+		return false
+	}
+	upper := prefixEnd(prefix)
+	return upper == nil || bytes.Compare(start, upper) < 0
+}
+
+// rangeEnd 范围删除记录中的上界，为空表示没有上界
+func rangeEnd(value []byte) []byte {
+	if len(value) == 0 {
+		return nil
+	}
+	return value
+}
+
+// prefixEnd 前缀为 prefix 的 key 的上界，即大于所有这些 key 的最小的 key，prefix 全部是 0xFF 时没有上界
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
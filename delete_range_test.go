@@ -0,0 +1,178 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/6 21:15
+// @Desc
+package kv_projects
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"os"
+	"testing"
+)
+
+func TestDB_DeletePrefix(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-prefix")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("user:%03d", i)), []byte("value")))
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("order:%03d", i)), []byte("value")))
+	}
+
+	// 1.删除前缀匹配的 key，其他的 key 不受影响
+	err = db.DeletePrefix([]byte("user:"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("user:001"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 100, db.index.Size())
+
+	// 2.之后写入的 key 不受影响
+	assert.Nil(t, db.Put([]byte("user:001"), []byte("new")))
+
+	// 3.重启之后按照顺序回放范围删除记录
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, db.index.Size())
+	val, err := db.Get([]byte("user:001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val)
+	_, err = db.Get([]byte("user:002"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 4.合并时清理被删除的记录
+	err = db.DeletePrefix([]byte("order:"))
+	assert.Nil(t, err)
+	size := dirSize(t, dir)
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Less(t, dirSize(t, dir), size)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.index.Size())
+
+	err = db.DeletePrefix(nil)
+	assert.Equal(t, ErrKeyIsEmpty, err)
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-range")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		assert.Nil(t, db.Put([]byte(key), []byte("value")))
+	}
+
+	// 1.不包含范围的终点
+	err = db.DeleteRange([]byte("b"), []byte("d"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("c"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("d"))
+	assert.Nil(t, err)
+
+	// 2.空的范围不做任何操作
+	err = db.DeleteRange([]byte("d"), []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, db.index.Size())
+
+	// 3.没有上界
+	err = db.DeleteRange([]byte("d"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.index.Size())
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.index.Size())
+	_, err = db.Get([]byte("a"))
+	assert.Nil(t, err)
+}
+
+func TestDB_DeleteRange_Events(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-range-events")
+	opts.DirPath = dir
+	opts.SecondaryIndexes = map[string]IndexExtractor{"city": cityIndex}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	users, err := db.Watch(ctx, []byte("user:1"))
+	assert.Nil(t, err)
+	orders, err := db.Watch(ctx, []byte("order:"))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("user:1"), []byte("alice|beijing")))
+	assert.Nil(t, db.Put([]byte("user:2"), []byte("bob|beijing")))
+
+	// 1.二级索引中的记录一起被删除
+	err = db.DeletePrefix([]byte("user:"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, queryKeys(t, db, "", ""))
+
+	// 2.前缀和范围有交集的监听者收到范围删除事件
+	err = db.Put([]byte("order:1"), []byte("value"))
+	assert.Nil(t, err)
+	event, ok := nextWatchEvent(users)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("user:1"), event.Key)
+	event, ok = nextWatchEvent(users)
+	assert.True(t, ok)
+	assert.Equal(t, data.LogRecordRangeDeleted, event.Type)
+	assert.Equal(t, []byte("user:"), event.Key)
+	assert.Equal(t, []byte("user;"), event.Value)
+	event, ok = nextWatchEvent(orders)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("order:1"), event.Key)
+
+	// 3.订阅中的范围删除事件
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	var rangeEvents int
+	for {
+		event, err := sub.readNext()
+		assert.Nil(t, err)
+		if event == nil {
+			break
+		}
+		if event.Type == data.LogRecordRangeDeleted {
+			assert.Equal(t, []byte("user:"), event.Key)
+			assert.Equal(t, []byte("user;"), event.Value)
+			rangeEvents++
+		}
+	}
+	assert.Equal(t, 1, rangeEvents)
+
+	// 4.重启之后二级索引仍然是空的
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, queryKeys(t, db, "", ""))
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("ab"), prefixEnd([]byte("aa")))
+	assert.Equal(t, []byte("b"), prefixEnd([]byte("a\xff")))
+	assert.Nil(t, prefixEnd([]byte("\xff\xff")))
+	assert.True(t, rangeInPrefix([]byte("a"), []byte("b"), []byte("a")))
+	assert.True(t, rangeInPrefix([]byte("a"), nil, []byte("b")))
+	assert.False(t, rangeInPrefix([]byte("b"), []byte("c"), []byte("a")))
+	assert.False(t, rangeInPrefix([]byte("a"), []byte("ab"), []byte("ab")))
+}
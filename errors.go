@@ -13,4 +13,28 @@ var (
 	ErrKeyNotFound            = errors.New("key not found in database")
 	ErrDataFileNotFound       = errors.New("data file is not found")
 	ErrDataDirectoryCorrupted = errors.New("the database directory maybe corrupted")
+	ErrKeyNotLocked           = errors.New("the key is not locked by this update")
+	ErrValueNotInteger        = errors.New("the value is not an integer")
+	ErrIncrOverflow           = errors.New("increment or decrement would overflow")
+	ErrInvalidDiscardRatio    = errors.New("discard ratio must be in (0, 1]")
+	ErrInvalidValueSize       = errors.New("the value size must not be negative")
+	ErrValueChanged           = errors.New("the value was overwritten or deleted while being read")
+	ErrReaderClosed           = errors.New("the value reader is closed")
+	ErrDBClosed               = errors.New("the database is closed")
+	ErrSubscriptionClosed     = errors.New("the subscription is closed")
+	ErrSeqCompacted           = errors.New("the records after the sequence number were compacted by merge")
+	ErrReadOnly               = errors.New("the database is a read only replica")
+	ErrReplicaDiverged        = errors.New("the replica's data files are not a prefix of the leader's")
+	ErrInvalidReplication     = errors.New("invalid replication stream")
+	ErrBackupDirNotEmpty      = errors.New("the backup directory is not empty")
+	ErrNamespaceNameEmpty     = errors.New("the namespace name is empty")
+	ErrNamespaceNotFound      = errors.New("namespace not found in database")
+	ErrNamespaceDropped       = errors.New("the namespace was dropped")
+	ErrNamespaceCorrupted     = errors.New("the namespace registry maybe corrupted")
+	ErrTooManyNamespaces      = errors.New("too many namespaces were created")
+	ErrNamespaceNameReserved  = errors.New("the namespace name is reserved")
+	ErrIndexNotFound          = errors.New("secondary index not found in database")
+	ErrStreamIndexed          = errors.New("values written by stream can not be indexed by secondary indexes")
+	ErrComparatorMismatch     = errors.New("the comparator does not match the one the database was created with")
+	ErrPrefixUnordered        = errors.New("keys with the same prefix are not adjacent under the comparator")
 )
@@ -3,6 +3,7 @@ module kv-projects
 go 1.22.0
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/google/btree v1.1.3
 	github.com/stretchr/testify v1.10.0
 )
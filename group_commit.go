@@ -0,0 +1,144 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/16 21:18
+// @Desc 组提交，多个并发写入者的数据由一个 leader 一起写入并只持久化一次
+package kv_projects
+
+import (
+	"context"
+	"kv-projects/data"
+	"sync"
+)
+
+// commitRequest 一次等待提交的写入，多条记录作为一个原子批次写入
+type commitRequest struct {
+	logRecords []*data.LogRecord
+	positions  []*data.LogRecordPos
+	err        error
+	lead       bool          // 被唤醒时是否成为下一批的 leader
+	wake       chan struct{} // 提交完成或者成为 leader 时被唤醒
+}
+
+// groupCommitter 组提交的写入队列
+type groupCommitter struct {
+	mu      sync.Mutex
+	queue   []*commitRequest // 等待写入的请求
+	leading bool             // 当前是否已经有 leader 在写入
+}
+
+// newGroupCommitter 新建组提交队列
+func newGroupCommitter() *groupCommitter {
+	return &groupCommitter{}
+}
+
+// commit 提交一条或者多条日志记录，返回它们写入的位置
+// 第一个进入队列的写入者成为 leader，在持有 db.mu 时写入队列中所有的记录，
+// 然后根据配置只持久化一次，最后唤醒这一批中的其他写入者。
+// leader 写入期间到达的请求组成下一批，由其中的第一个请求担任 leader。
+// 等待期间 ctx 结束时，还在队列中的请求被移出队列并返回 ctx 的错误，已经被 leader 取走的请求仍然等待写入的结果
+func (gc *groupCommitter) commit(ctx context.Context, db *DB, logRecords []*data.LogRecord) ([]*data.LogRecordPos, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	req := &commitRequest{logRecords: logRecords, wake: make(chan struct{}, 1)}
+
+	gc.mu.Lock()
+	gc.queue = append(gc.queue, req)
+	if gc.leading {
+		// 已经有 leader，等待被唤醒
+		gc.mu.Unlock()
+		select {
+		case <-req.wake:
+		case <-ctx.Done():
+			if gc.withdraw(req) {
+				return nil, ctx.Err()
+			}
+			<-req.wake
+		}
+		if !req.lead {
+			return req.positions, req.err
+		}
+		gc.mu.Lock()
+	}
+	gc.leading = true
+	// 取出当前所有等待的请求作为一批
+	batch := gc.queue
+	gc.queue = nil
+	gc.mu.Unlock()
+
+	db.writeBatch(ctx, batch)
+
+	gc.mu.Lock()
+	if len(gc.queue) > 0 {
+		// leader 写入期间有新的请求到达，交给下一批的第一个请求处理
+		next := gc.queue[0]
+		next.lead = true
+		next.wake <- struct{}{}
+	} else {
+		gc.leading = false
+	}
+	gc.mu.Unlock()
+
+	// 唤醒这一批中的其他写入者
+	for _, r := range batch {
+		if r != req {
+			r.wake <- struct{}{}
+		}
+	}
+	return req.positions, req.err
+}
+
+// withdraw 将还在队列中等待的请求移出队列，已经被 leader 取走或者被指定为下一个 leader 的请求不能撤回
+func (gc *groupCommitter) withdraw(req *commitRequest) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if req.lead {
+		return false
+	}
+	for i, r := range gc.queue {
+		if r == req {
+			gc.queue = append(gc.queue[:i], gc.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// writeBatch 在持有 db.mu 时写入一批记录，并根据配置只持久化一次，ctx 是 leader 的请求的 ctx，用于跟踪
+func (db *DB) writeBatch(ctx context.Context, batch []*commitRequest) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var written bool
+	for _, req := range batch {
+		// 命名空间在写入之前被删除了，删除记录之后不能再有这个命名空间的记录
+		if db.hasDroppedNamespace(req.logRecords) {
+			req.err = ErrNamespaceDropped
+			continue
+		}
+		req.positions, req.err = db.writeLogRecords(req.logRecords)
+		if req.err == nil {
+			written = true
+		}
+	}
+	if !written {
+		return
+	}
+	if err := db.syncAfterWrite(ctx); err != nil {
+		// 持久化失败，这一批所有的写入都视为失败
+		for _, req := range batch {
+			if req.err == nil {
+				req.positions, req.err = nil, err
+			}
+		}
+	}
+	for _, req := range batch {
+		if req.err != nil {
+			continue
+		}
+		for i, logRecord := range req.logRecords {
+			db.notifyWatchers(logRecord, req.positions[i])
+		}
+	}
+	db.publishCommitted()
+}
@@ -0,0 +1,112 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/16 21:18
+// @Desc
+package kv_projects
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGroupCommitter_Commit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.并发提交，每条记录的位置互不相同
+	var mu sync.Mutex
+	positions := make(map[data.LogRecordPos]struct{})
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := utils.GetTestKey(g*1000 + i)
+				pos, err := db.groupCommit.commit(context.Background(), db, []*data.LogRecord{{Key: key, Value: key}})
+				assert.Nil(t, err)
+				mu.Lock()
+				positions[*pos[0]] = struct{}{}
+				mu.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 16*50, len(positions))
+	assert.False(t, db.groupCommit.leading)
+	assert.Equal(t, 0, len(db.groupCommit.queue))
+
+	// 2.根据返回的位置可以读到对应的记录
+	for pos := range positions {
+		p := pos
+		val, err := db.getValueByPosition(&p)
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+}
+
+func TestDB_Put_SyncWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-sync-writes")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := utils.GetTestKey(g*1000 + i)
+				assert.Nil(t, db.Put(key, key))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// 重启之后数据都能读到
+	err = db.activeFile.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	for g := 0; g < 16; g++ {
+		for i := 0; i < 50; i++ {
+			key := utils.GetTestKey(g*1000 + i)
+			val, err := db2.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, key, val)
+		}
+	}
+}
+
+func TestDB_Put_BytesPerSync(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bytes-per-sync")
+	opts.DirPath = dir
+	opts.BytesPerSync = 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(24)))
+		// 累计写入的字节数不会超过阈值太多
+		assert.Less(t, db.bytesWrite, opts.BytesPerSync)
+	}
+}
@@ -0,0 +1,122 @@
+// Package index
+// @Author NuyoahCh
+// @Date 2025/2/24 20:45
+// @Desc 布隆过滤器，用于快速判断 key 一定不存在
+package index
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// minBloomCapacity 每一层过滤器的最小容量
+const minBloomCapacity = 1024
+
+// BloomFilter 可扩容的布隆过滤器，并发安全
+// 写入的 key 数量超过当前层的容量时，追加一层容量翻倍、误判率减半的过滤器，
+// 查询时依次检查每一层，因此扩容不需要重新写入已有的 key，也不会出现漏判，总的误判率不超过配置值的两倍
+type BloomFilter struct {
+	fpRate float64
+	mu     sync.Mutex                    // 保护扩容
+	layers atomic.Pointer[[]*bloomLayer] // 查询和写入原子地读取，扩容时整体替换
+}
+
+// bloomLayer 布隆过滤器中的一层
+type bloomLayer struct {
+	bits     []atomic.Uint64
+	m        uint64 // 位的数量
+	k        int    // 哈希函数的数量
+	capacity int64  // 误判率达到目标值之前可以写入的 key 数量
+	count    atomic.Int64
+}
+
+// NewBloomFilter 新建布隆过滤器，capacity 为预计写入的 key 数量，fpRate 为目标误判率
+func NewBloomFilter(capacity int, fpRate float64) *BloomFilter {
+	bf := &BloomFilter{fpRate: fpRate}
+	layers := []*bloomLayer{newBloomLayer(int64(max(capacity, minBloomCapacity)), fpRate)}
+	bf.layers.Store(&layers)
+	return bf
+}
+
+// newBloomLayer 根据容量和误判率计算位的数量和哈希函数的数量
+func newBloomLayer(capacity int64, fpRate float64) *bloomLayer {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := int(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	return &bloomLayer{
+		bits:     make([]atomic.Uint64, m/64),
+		m:        m,
+		k:        max(k, 1),
+		capacity: capacity,
+	}
+}
+
+// Add 写入 key
+func (bf *BloomFilter) Add(key []byte) {
+	layers := *bf.layers.Load()
+	last := layers[len(layers)-1]
+	if last.count.Add(1) > last.capacity {
+		last = bf.grow(last)
+	}
+	last.add(xxhash.Sum64(key))
+}
+
+// MayContain key 是否可能存在，返回 false 时 key 一定不存在
+func (bf *BloomFilter) MayContain(key []byte) bool {
+	h := xxhash.Sum64(key)
+	for _, layer := range *bf.layers.Load() {
+		if layer.mayContain(h) {
+			return true
+		}
+	}
+	return false
+}
+
+// grow 当前层已满时追加新的一层，返回写入使用的层
+func (bf *BloomFilter) grow(full *bloomLayer) *bloomLayer {
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	layers := *bf.layers.Load()
+	last := layers[len(layers)-1]
+	// 其他写入者已经扩容
+	if last != full {
+		last.count.Add(1)
+		return last
+	}
+	fpRate := bf.fpRate * math.Pow(0.5, float64(len(layers)))
+	next := newBloomLayer(last.capacity*2, fpRate)
+	next.count.Add(1)
+	newLayers := append(append(make([]*bloomLayer, 0, len(layers)+1), layers...), next)
+	bf.layers.Store(&newLayers)
+	return next
+}
+
+// add 根据 key 的哈希值设置 k 个位，使用两个哈希值的线性组合模拟 k 个哈希函数
+func (l *bloomLayer) add(h uint64) {
+	h1, h2 := h, h>>33|1
+	for i := 0; i < l.k; i++ {
+		bit := (h1 + uint64(i)*h2) % l.m
+		word, mask := &l.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := word.Load()
+			if old&mask != 0 || word.CompareAndSwap(old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+// mayContain 哈希值对应的 k 个位是否都已经设置
+func (l *bloomLayer) mayContain(h uint64) bool {
+	h1, h2 := h, h>>33|1
+	for i := 0; i < l.k; i++ {
+		bit := (h1 + uint64(i)*h2) % l.m
+		if l.bits[bit/64].Load()&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+// Package index
+// @Author NuyoahCh
+// @Date 2025/2/24 20:45
+// @Desc
+package index
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"sync"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(1000, 0.01)
+
+	// 1.写入的 key 超过初始容量之后扩容，不会漏判
+	for i := 0; i < 100000; i++ {
+		bf.Add(utils.GetTestKey(i))
+	}
+	assert.True(t, len(*bf.layers.Load()) > 1)
+	for i := 0; i < 100000; i++ {
+		assert.True(t, bf.MayContain(utils.GetTestKey(i)))
+	}
+
+	// 2.误判率不超过配置值的两倍
+	var falsePositives int
+	for i := 100000; i < 200000; i++ {
+		if bf.MayContain(utils.GetTestKey(i)) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 2000, falsePositives)
+}
+
+func TestBloomFilter_Concurrent(t *testing.T) {
+	bf := NewBloomFilter(0, 0.01)
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 40000; i += 8 {
+				bf.Add(utils.GetTestKey(i))
+				assert.True(t, bf.MayContain(utils.GetTestKey(i)))
+			}
+		}(g)
+	}
+	wg.Wait()
+	for i := 0; i < 40000; i++ {
+		assert.True(t, bf.MayContain(utils.GetTestKey(i)))
+	}
+}
@@ -7,21 +7,31 @@ package index
 import (
 	"github.com/google/btree"
 	"kv-projects/data"
+	"sort"
 	"sync"
 )
 
 // BTree 索引，主要封装了 google 的 btree ku
 // https://github.com/google/btree
 type BTree struct {
-	tree *btree.BTree  // 实现库中的结构
-	lock *sync.RWMutex // 由于 Btree 库原生不支持安全并发，所以进行加锁
+	tree *btree.BTreeG[*Item] // 实现库中的结构
+	lock *sync.RWMutex        // 由于 Btree 库原生不支持安全并发，所以进行加锁
+	cmp  Comparator           // key 的比较器
 }
 
-// NewBTree 新建 BTree 索引结构
+// NewBTree 新建 BTree 索引结构，按照字节序比较 key
 func NewBTree() *BTree {
+	return NewBTreeWithComparator(nil)
+}
+
+// NewBTreeWithComparator 新建使用比较器 cmp 的 BTree 索引结构，cmp 为 nil 时按照字节序比较
+func NewBTreeWithComparator(cmp Comparator) *BTree {
+	cmp = orDefault(cmp)
 	return &BTree{
-		tree: btree.New(32),     // 树的结点创建是要程序员自行创建
+		// 树的结点创建是要程序员自行创建
+		tree: btree.NewG(32, func(a, b *Item) bool { return cmp.Compare(a.key, b.key) < 0 }),
 		lock: new(sync.RWMutex), // 创建读写锁
+		cmp:  cmp,
 	}
 }
 
@@ -37,21 +47,131 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) bool {
 // Get 根据 key 取出对应的索引位置信息
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
-	btreeItem := bt.tree.Get(it)
-	if btreeItem == nil {
+	bt.lock.RLock()
+	btreeItem, ok := bt.tree.Get(it)
+	bt.lock.RUnlock()
+	if !ok {
 		return nil
 	}
-	return btreeItem.(*Item).pos
+	return btreeItem.pos
 }
 
 // Delete 根据 key 删除对应的索引位置信息
 func (bt *BTree) Delete(key []byte) bool {
 	it := &Item{key: key}
 	bt.lock.Lock()
-	oldItem := bt.tree.Delete(it)
+	_, ok := bt.tree.Delete(it)
 	bt.lock.Unlock()
-	if oldItem == nil {
-		return false
+	return ok
+}
+
+// DeleteRange 删除 [start, end) 范围内所有 key 的索引位置信息，end 为 nil 表示没有上界
+func (bt *BTree) DeleteRange(start, end []byte) int {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	var items []*Item
+	bt.tree.AscendGreaterOrEqual(&Item{key: start}, func(it *Item) bool {
+		if end != nil && bt.cmp.Compare(it.key, end) >= 0 {
+			return false
+		}
+		items = append(items, it)
+		return true
+	})
+	for _, it := range items {
+		bt.tree.Delete(it)
 	}
-	return true
+	return len(items)
+}
+
+// Size 索引中的数据量
+func (bt *BTree) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return bt.tree.Len()
+}
+
+// Iterator 索引迭代器
+func (bt *BTree) Iterator(reverse bool) Iterator {
+	if bt.tree == nil {
+		return nil
+	}
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
+	return newBTreeIterator(bt.tree, reverse, bt.cmp)
+}
+
+// btreeIterator BTree 索引迭代器
+type btreeIterator struct {
+	currIndex int        // 当前遍历的下标位置
+	reverse   bool       // 是否是反向遍历
+	values    []*Item    // key+位置索引信息
+	cmp       Comparator // key 的比较器
+}
+
+// newBTreeIterator 新建 BTree 索引迭代器，迭代器持有创建时刻索引数据的快照
+func newBTreeIterator(tree *btree.BTreeG[*Item], reverse bool, cmp Comparator) *btreeIterator {
+	var idx int
+	values := make([]*Item, tree.Len())
+
+	// 将所有的数据存放到数组中
+	saveValues := func(it *Item) bool {
+		values[idx] = it
+		idx++
+		return true
+	}
+	if reverse {
+		tree.Descend(saveValues)
+	} else {
+		tree.Ascend(saveValues)
+	}
+
+	return &btreeIterator{
+		currIndex: 0,
+		reverse:   reverse,
+		values:    values,
+		cmp:       cmp,
+	}
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (bti *btreeIterator) Rewind() {
+	bti.currIndex = 0
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (bti *btreeIterator) Seek(key []byte) {
+	if bti.reverse {
+		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
+			return bti.cmp.Compare(bti.values[i].key, key) <= 0
+		})
+	} else {
+		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
+			return bti.cmp.Compare(bti.values[i].key, key) >= 0
+		})
+	}
+}
+
+// Next 跳转到下一个 key
+func (bti *btreeIterator) Next() {
+	bti.currIndex += 1
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (bti *btreeIterator) Valid() bool {
+	return bti.currIndex < len(bti.values)
+}
+
+// Key 当前遍历位置的 Key 数据
+func (bti *btreeIterator) Key() []byte {
+	return bti.values[bti.currIndex].key
+}
+
+// Value 当前遍历位置的 Value 数据
+func (bti *btreeIterator) Value() *data.LogRecordPos {
+	return bti.values[bti.currIndex].pos
+}
+
+// Close 关闭迭代器，释放相应资源
+func (bti *btreeIterator) Close() {
+	bti.values = nil
 }
@@ -65,6 +65,24 @@ func TestBTree_Delete(t *testing.T) {
 	// PASS
 }
 
+func TestBTree_DeleteRange(t *testing.T) {
+	bt := NewBTree()
+	for _, key := range []string{"a", "ab", "abc", "b", "c"} {
+		bt.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	// 1.删除 [ab, b) 范围内的 key
+	assert.Equal(t, 2, bt.DeleteRange([]byte("ab"), []byte("b")))
+	assert.Nil(t, bt.Get([]byte("abc")))
+	assert.NotNil(t, bt.Get([]byte("a")))
+	assert.NotNil(t, bt.Get([]byte("b")))
+
+	// 2.没有上界
+	assert.Equal(t, 2, bt.DeleteRange([]byte("b"), nil))
+	assert.Equal(t, 1, bt.Size())
+	assert.Equal(t, 0, bt.DeleteRange([]byte("b"), nil))
+}
+
 /*
 测试完毕
 === RUN   TestBTree_Put
@@ -76,3 +94,47 @@ func TestBTree_Delete(t *testing.T) {
 PASS
 ok      kv-projects/index       0.456s
 */
+
+func TestBTree_Iterator(t *testing.T) {
+	bt1 := NewBTree()
+	// 1.BTree 为空的情况
+	iter1 := bt1.Iterator(false)
+	assert.Equal(t, false, iter1.Valid())
+
+	// 2.BTree 有数据的情况
+	bt1.Put([]byte("ccde"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	iter2 := bt1.Iterator(false)
+	assert.Equal(t, true, iter2.Valid())
+	assert.NotNil(t, iter2.Key())
+	assert.NotNil(t, iter2.Value())
+	iter2.Next()
+	assert.Equal(t, false, iter2.Valid())
+
+	// 3.有多条数据
+	bt1.Put([]byte("acee"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	bt1.Put([]byte("eede"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	bt1.Put([]byte("bbcd"), &data.LogRecordPos{Fid: 1, Offset: 10})
+	iter3 := bt1.Iterator(false)
+	var keys []string
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		keys = append(keys, string(iter3.Key()))
+	}
+	assert.Equal(t, []string{"acee", "bbcd", "ccde", "eede"}, keys)
+
+	iter4 := bt1.Iterator(true)
+	keys = nil
+	for iter4.Rewind(); iter4.Valid(); iter4.Next() {
+		keys = append(keys, string(iter4.Key()))
+	}
+	assert.Equal(t, []string{"eede", "ccde", "bbcd", "acee"}, keys)
+
+	// 4.测试 seek
+	iter5 := bt1.Iterator(false)
+	iter5.Seek([]byte("cc"))
+	assert.Equal(t, []byte("ccde"), iter5.Key())
+
+	// 5.反向遍历的 seek
+	iter6 := bt1.Iterator(true)
+	iter6.Seek([]byte("cc"))
+	assert.Equal(t, []byte("bbcd"), iter6.Key())
+}
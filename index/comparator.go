@@ -0,0 +1,34 @@
+// Package index
+// @Author NuyoahCh
+// @Date 2025/3/9 20:10
+// @Desc key 的比较器，决定索引中 key 的顺序
+package index
+
+import "bytes"
+
+// Comparator key 的比较器，索引和迭代器按照比较器的顺序组织 key
+// 比较结果为 0 的两个 key 在索引中被视为同一个 key，因此大小写不敏感等比较器会让这些 key 相互覆盖
+type Comparator interface {
+	// Name 比较器的名称，记录在数据目录中，之后必须使用同名的比较器打开
+	Name() string
+
+	// Compare 比较两个 key，a < b 返回负数，a == b 返回 0，a > b 返回正数
+	Compare(a, b []byte) int
+}
+
+// BytewiseComparator 默认的比较器，按照字节序比较
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string { return "bytewise" }
+
+func (bytewiseComparator) Compare(a, b []byte) int { return bytes.Compare(a, b) }
+
+// orDefault 比较器为 nil 时使用默认的比较器
+func orDefault(cmp Comparator) Comparator {
+	if cmp == nil {
+		return BytewiseComparator
+	}
+	return cmp
+}
@@ -0,0 +1,62 @@
+// Package index
+// @Author NuyoahCh
+// @Date 2025/3/9 20:10
+// @Desc
+package index
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"testing"
+)
+
+// reverseComparator 和字节序相反的比较器
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string { return "reverse" }
+
+func (reverseComparator) Compare(a, b []byte) int { return bytes.Compare(b, a) }
+
+// collectKeys 按照迭代器的顺序取出所有的 key
+func collectKeys(iter Iterator) []string {
+	var keys []string
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Close()
+	return keys
+}
+
+func TestBTree_Comparator(t *testing.T) {
+	bt := NewBTreeWithComparator(reverseComparator{})
+	for _, key := range []string{"b", "a", "d", "c"} {
+		bt.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	// 1.迭代器按照比较器的顺序遍历
+	assert.Equal(t, []string{"d", "c", "b", "a"}, collectKeys(bt.Iterator(false)))
+	assert.Equal(t, []string{"a", "b", "c", "d"}, collectKeys(bt.Iterator(true)))
+
+	// 2.Seek 找到按照比较器的顺序第一个大于等于目标的 key
+	iter := bt.Iterator(false)
+	iter.Seek([]byte("bb"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("b"), iter.Key())
+	iter.Close()
+
+	// 3.范围删除按照比较器的顺序
+	bt.DeleteRange([]byte("c"), []byte("a"))
+	assert.Equal(t, []string{"d", "a"}, collectKeys(bt.Iterator(false)))
+}
+
+func TestShardedBTree_Comparator(t *testing.T) {
+	sbt := NewShardedBTreeWithComparator(4, reverseComparator{})
+	for _, key := range []string{"b", "a", "d", "c", "e"} {
+		sbt.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: 1})
+	}
+
+	// 归并各个分片时使用同一个比较器
+	assert.Equal(t, []string{"e", "d", "c", "b", "a"}, collectKeys(sbt.Iterator(false)))
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, collectKeys(sbt.Iterator(true)))
+}
@@ -5,10 +5,7 @@
 package index
 
 import (
-	"bytes"
 	"kv-projects/data"
-
-	"github.com/google/btree"
 )
 
 // Indexer 抽象索引接口，后续如果想要接入其他的数据结构，则直接实现这个接口即可
@@ -22,6 +19,15 @@ type Indexer interface {
 
 	// Delete 根据 key 删除对应的索引位置信息
 	Delete(key []byte) bool
+
+	// DeleteRange 删除 [start, end) 范围内所有 key 的索引位置信息，end 为 nil 表示没有上界，返回删除的数量
+	DeleteRange(start, end []byte) int
+
+	// Size 索引中的数据量
+	Size() int
+
+	// Iterator 索引迭代器
+	Iterator(reverse bool) Iterator
 }
 
 type IndexType = int8
@@ -32,28 +38,52 @@ const (
 
 	// ART 自适应基数树索引
 	ART
+
+	// ShardedBtree 按 key 哈希分片的 BTree 索引
+	ShardedBtree
 )
 
-// NewIndexer 根据类型初始化索引
-func NewIndexer(typ IndexType) Indexer {
+// NewIndexer 根据类型初始化索引，shards 只对分片索引生效，cmp 为 nil 时按照字节序比较
+func NewIndexer(typ IndexType, shards int, cmp Comparator) Indexer {
 	switch typ {
 	case Btree:
-		return NewBTree()
+		return NewBTreeWithComparator(cmp)
 	case ART:
 		// todo
 		return nil
+	case ShardedBtree:
+		return NewShardedBTreeWithComparator(shards, cmp)
 	default:
 		panic("unsupported index type")
 	}
 }
 
-// Item 由于 Btree 中自带的 Item 接口不符合预期，则自己创建
+// Item 索引中的一个 key 和它的位置信息，顺序由索引的比较器决定
 type Item struct {
 	key []byte             // 键值
 	pos *data.LogRecordPos // 位置信息
 }
 
-// Less 前者小于后者的判断，The result will be 0 if a == b, -1 if a < b, and +1 if a > b.
-func (ai *Item) Less(bi btree.Item) bool {
-	return bytes.Compare(ai.key, bi.(*Item).key) == -1
+// Iterator 通用索引迭代器
+type Iterator interface {
+	// Rewind 重新回到迭代器的起点，即第一个数据
+	Rewind()
+
+	// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+	Seek(key []byte)
+
+	// Next 跳转到下一个 key
+	Next()
+
+	// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+	Valid() bool
+
+	// Key 当前遍历位置的 Key 数据
+	Key() []byte
+
+	// Value 当前遍历位置的 Value 数据
+	Value() *data.LogRecordPos
+
+	// Close 关闭迭代器，释放相应资源
+	Close()
 }
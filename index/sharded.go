@@ -0,0 +1,200 @@
+// Package index
+// @Author NuyoahCh
+// @Date 2025/2/15 22:10
+// @Desc 按 key 哈希分片的 BTree 索引，降低多核下的锁竞争
+package index
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"kv-projects/data"
+)
+
+// ShardedBTree 分片 BTree 索引
+// key 按哈希值分布到 N 个相互独立的 BTree 上，每个分片有自己的读写锁，
+// 不同分片上的读写可以并行执行，有序遍历时通过多路归并得到全局有序的结果
+type ShardedBTree struct {
+	shards []*BTree
+	cmp    Comparator
+}
+
+// NewShardedBTree 新建分片 BTree 索引，按照字节序比较 key
+func NewShardedBTree(shards int) *ShardedBTree {
+	return NewShardedBTreeWithComparator(shards, nil)
+}
+
+// NewShardedBTreeWithComparator 新建使用比较器 cmp 的分片 BTree 索引，cmp 为 nil 时按照字节序比较
+// 分片按照 key 的字节计算哈希，比较结果为 0 的不同 key 可能在不同的分片上，因此这类比较器只能用于 BTree 索引，
+// 数据库打开和创建命名空间时会拒绝这样的配置
+func NewShardedBTreeWithComparator(shards int, cmp Comparator) *ShardedBTree {
+	if shards <= 0 {
+		panic("the number of index shards must be greater than 0")
+	}
+	cmp = orDefault(cmp)
+	st := &ShardedBTree{shards: make([]*BTree, shards), cmp: cmp}
+	for i := range st.shards {
+		st.shards[i] = NewBTreeWithComparator(cmp)
+	}
+	return st
+}
+
+// shardOf 计算 key 所在的分片
+func (st *ShardedBTree) shardOf(key []byte) *BTree {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return st.shards[h.Sum32()%uint32(len(st.shards))]
+}
+
+// Put 向索引中存储 key 对应的数据位置信息
+func (st *ShardedBTree) Put(key []byte, pos *data.LogRecordPos) bool {
+	return st.shardOf(key).Put(key, pos)
+}
+
+// Get 根据 key 取出对应的索引位置信息
+func (st *ShardedBTree) Get(key []byte) *data.LogRecordPos {
+	return st.shardOf(key).Get(key)
+}
+
+// Delete 根据 key 删除对应的索引位置信息
+func (st *ShardedBTree) Delete(key []byte) bool {
+	return st.shardOf(key).Delete(key)
+}
+
+// DeleteRange 删除 [start, end) 范围内所有 key 的索引位置信息，范围内的 key 分布在所有的分片上
+func (st *ShardedBTree) DeleteRange(start, end []byte) int {
+	var count int
+	for _, shard := range st.shards {
+		count += shard.DeleteRange(start, end)
+	}
+	return count
+}
+
+// Size 索引中的数据量
+func (st *ShardedBTree) Size() int {
+	var size int
+	for _, shard := range st.shards {
+		size += shard.Size()
+	}
+	return size
+}
+
+// Iterator 索引迭代器，对所有分片的迭代器做多路归并
+func (st *ShardedBTree) Iterator(reverse bool) Iterator {
+	iters := make([]Iterator, len(st.shards))
+	for i, shard := range st.shards {
+		iters[i] = shard.Iterator(reverse)
+	}
+	return NewMergeIterator(iters, reverse, st.cmp)
+}
+
+// mergeIterator 多路归并迭代器，将多个有序的迭代器合并成一个有序的迭代器
+// 各个迭代器中的 key 互不重复
+type mergeIterator struct {
+	iters   []Iterator
+	reverse bool
+	h       *iteratorHeap
+}
+
+// NewMergeIterator 新建多路归并迭代器，传入的迭代器需要有相同的遍历方向，并且 key 互不重复
+// 所有迭代器需要按照比较器 cmp 的顺序遍历，cmp 为 nil 时按照字节序比较
+func NewMergeIterator(iters []Iterator, reverse bool, cmp Comparator) Iterator {
+	mi := &mergeIterator{
+		iters:   iters,
+		reverse: reverse,
+		h:       &iteratorHeap{reverse: reverse, cmp: orDefault(cmp)},
+	}
+	mi.rebuild()
+	return mi
+}
+
+// rebuild 用所有有效的迭代器重建堆
+func (mi *mergeIterator) rebuild() {
+	mi.h.iters = mi.h.iters[:0]
+	for _, it := range mi.iters {
+		if it.Valid() {
+			mi.h.iters = append(mi.h.iters, it)
+		}
+	}
+	heap.Init(mi.h)
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (mi *mergeIterator) Rewind() {
+	for _, it := range mi.iters {
+		it.Rewind()
+	}
+	mi.rebuild()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (mi *mergeIterator) Seek(key []byte) {
+	for _, it := range mi.iters {
+		it.Seek(key)
+	}
+	mi.rebuild()
+}
+
+// Next 跳转到下一个 key
+func (mi *mergeIterator) Next() {
+	if !mi.Valid() {
+		return
+	}
+	top := mi.h.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(mi.h, 0)
+	} else {
+		heap.Pop(mi.h)
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (mi *mergeIterator) Valid() bool {
+	return mi.h.Len() > 0
+}
+
+// Key 当前遍历位置的 Key 数据
+func (mi *mergeIterator) Key() []byte {
+	return mi.h.iters[0].Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (mi *mergeIterator) Value() *data.LogRecordPos {
+	return mi.h.iters[0].Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (mi *mergeIterator) Close() {
+	for _, it := range mi.iters {
+		it.Close()
+	}
+	mi.h.iters = nil
+}
+
+// iteratorHeap 按照迭代器当前 key 排序的堆，堆顶是下一个要遍历的迭代器
+type iteratorHeap struct {
+	iters   []Iterator
+	reverse bool
+	cmp     Comparator
+}
+
+func (h *iteratorHeap) Len() int { return len(h.iters) }
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := h.cmp.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) { h.iters[i], h.iters[j] = h.iters[j], h.iters[i] }
+
+func (h *iteratorHeap) Push(x any) { h.iters = append(h.iters, x.(Iterator)) }
+
+func (h *iteratorHeap) Pop() any {
+	n := len(h.iters)
+	it := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return it
+}
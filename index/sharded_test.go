@@ -0,0 +1,103 @@
+// Package index
+// @Author NuyoahCh
+// @Date 2025/2/15 22:10
+// @Desc 分片索引测试类
+package index
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"sync"
+	"testing"
+)
+
+func TestShardedBTree_PutGetDelete(t *testing.T) {
+	st := NewShardedBTree(8)
+
+	res1 := st.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.True(t, res1)
+	res2 := st.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.True(t, res2)
+
+	pos := st.Get([]byte("a"))
+	assert.Equal(t, uint32(1), pos.Fid)
+	assert.Equal(t, int64(3), pos.Offset)
+	assert.Nil(t, st.Get([]byte("b")))
+	assert.Equal(t, 1, st.Size())
+
+	assert.True(t, st.Delete([]byte("a")))
+	assert.False(t, st.Delete([]byte("a")))
+	assert.Nil(t, st.Get([]byte("a")))
+	assert.Equal(t, 0, st.Size())
+}
+
+func TestShardedBTree_DeleteRange(t *testing.T) {
+	st := NewShardedBTree(8)
+	for i := 0; i < 100; i++ {
+		st.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	// 范围内的 key 分布在不同的分片上
+	assert.Equal(t, 50, st.DeleteRange([]byte("key-010"), []byte("key-060")))
+	assert.Equal(t, 50, st.Size())
+	assert.Nil(t, st.Get([]byte("key-010")))
+	assert.NotNil(t, st.Get([]byte("key-060")))
+}
+
+func TestShardedBTree_Iterator(t *testing.T) {
+	st := NewShardedBTree(8)
+
+	// 1.索引为空的情况
+	iter1 := st.Iterator(false)
+	assert.False(t, iter1.Valid())
+
+	// 2.多个分片上的数据全局有序
+	for i := 0; i < 100; i++ {
+		st.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter2 := st.Iterator(false)
+	var i int
+	for iter2.Rewind(); iter2.Valid(); iter2.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%03d", i)), iter2.Key())
+		assert.Equal(t, int64(i), iter2.Value().Offset)
+		i++
+	}
+	assert.Equal(t, 100, i)
+
+	// 3.反向遍历
+	iter3 := st.Iterator(true)
+	i = 99
+	for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%03d", i)), iter3.Key())
+		i--
+	}
+	assert.Equal(t, -1, i)
+
+	// 4.seek
+	iter4 := st.Iterator(false)
+	iter4.Seek([]byte("key-050"))
+	assert.Equal(t, []byte("key-050"), iter4.Key())
+	iter5 := st.Iterator(true)
+	iter5.Seek([]byte("key-0505"))
+	assert.Equal(t, []byte("key-050"), iter5.Key())
+	iter5.Close()
+}
+
+func TestShardedBTree_Concurrent(t *testing.T) {
+	st := NewShardedBTree(16)
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", g, i))
+				st.Put(key, &data.LogRecordPos{Fid: uint32(g), Offset: int64(i)})
+				assert.NotNil(t, st.Get(key))
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 8000, st.Size())
+}
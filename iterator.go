@@ -0,0 +1,96 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/15 22:40
+// @Desc 面向用户的数据迭代器
+package kv_projects
+
+import (
+	"bytes"
+	"kv-projects/index"
+)
+
+// Iterator 迭代器
+type Iterator struct {
+	indexIter index.Iterator // 索引迭代器
+	db        *DB
+	options   IteratorOptions
+	get       func(key []byte) ([]byte, error) // 位置失效之后根据 key 重新读取
+}
+
+// NewIterator 初始化迭代器，迭代器遍历的是创建时刻索引的快照
+// 设置了前缀时按照字节匹配，使用非字节序的比较器时需要扫描整个索引，见 IteratorOptions.Prefix
+func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
+	return db.newIterator(db.index, opts, db.Get)
+}
+
+// newIterator 初始化 idx 上的迭代器，get 用于在位置失效之后重新读取
+func (db *DB) newIterator(idx index.Indexer, opts IteratorOptions, get func(key []byte) ([]byte, error)) *Iterator {
+	indexIter := idx.Iterator(opts.Reverse)
+	it := &Iterator{
+		db:        db,
+		indexIter: indexIter,
+		options:   opts,
+		get:       get,
+	}
+	it.skipToNext()
+	return it
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (it *Iterator) Rewind() {
+	it.indexIter.Rewind()
+	it.skipToNext()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (it *Iterator) Seek(key []byte) {
+	it.indexIter.Seek(key)
+	it.skipToNext()
+}
+
+// Next 跳转到下一个 key
+func (it *Iterator) Next() {
+	it.indexIter.Next()
+	it.skipToNext()
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (it *Iterator) Valid() bool {
+	return it.indexIter.Valid()
+}
+
+// Key 当前遍历位置的 Key 数据
+func (it *Iterator) Key() []byte {
+	return it.indexIter.Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (it *Iterator) Value() ([]byte, error) {
+	value, err := it.db.getValueByPosition(it.indexIter.Value())
+	// 迭代器创建之后发生了合并，快照中的位置已经失效，根据 key 重新读取
+	if it.db.isFileRetired(err) {
+		return it.get(it.indexIter.Key())
+	}
+	return value, err
+}
+
+// Close 关闭迭代器，释放相应资源
+func (it *Iterator) Close() {
+	it.indexIter.Close()
+}
+
+// skipToNext 跳过不满足前缀条件的 key
+// 使用非字节序的比较器时前缀相同的 key 不是连续的，不能在第一个不匹配的 key 处停止，只能逐个比较
+func (it *Iterator) skipToNext() {
+	prefixLen := len(it.options.Prefix)
+	if prefixLen == 0 {
+		return
+	}
+
+	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		key := it.indexIter.Key()
+		if prefixLen <= len(key) && bytes.Equal(it.options.Prefix, key[:prefixLen]) {
+			break
+		}
+	}
+}
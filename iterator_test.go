@@ -0,0 +1,103 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/15 22:40
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_NewIterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	assert.NotNil(t, iterator)
+	assert.Equal(t, false, iterator.Valid())
+}
+
+func TestDB_Iterator_One_Value(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-2")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(10), utils.GetTestKey(10))
+	assert.Nil(t, err)
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	defer iterator.Close()
+	assert.NotNil(t, iterator)
+	assert.Equal(t, true, iterator.Valid())
+	assert.Equal(t, utils.GetTestKey(10), iterator.Key())
+	val, err := iterator.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+}
+
+func TestDB_Iterator_Multi_Values(t *testing.T) {
+	for _, indexType := range []IndexerType{BTree, ShardedBTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-3")
+		opts.DirPath = dir
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for _, key := range []string{"annde", "cnedc", "aeeue", "esnue", "bnede"} {
+			err = db.Put([]byte(key), utils.RandomValue(10))
+			assert.Nil(t, err)
+		}
+
+		// 正向迭代
+		iter1 := db.NewIterator(DefaultIteratorOptions)
+		var keys [][]byte
+		for iter1.Rewind(); iter1.Valid(); iter1.Next() {
+			keys = append(keys, iter1.Key())
+		}
+		assert.Equal(t, 5, len(keys))
+		for i := 1; i < len(keys); i++ {
+			assert.Equal(t, -1, bytes.Compare(keys[i-1], keys[i]))
+		}
+		iter1.Rewind()
+		for iter1.Seek([]byte("c")); iter1.Valid(); iter1.Next() {
+			assert.NotNil(t, iter1.Key())
+		}
+		iter1.Close()
+
+		// 反向迭代
+		iterOpts1 := DefaultIteratorOptions
+		iterOpts1.Reverse = true
+		iter2 := db.NewIterator(iterOpts1)
+		iter2.Seek([]byte("c"))
+		assert.Equal(t, []byte("bnede"), iter2.Key())
+		iter2.Close()
+
+		// 指定了 prefix
+		iterOpts2 := DefaultIteratorOptions
+		iterOpts2.Prefix = []byte("aee")
+		iter3 := db.NewIterator(iterOpts2)
+		keys = nil
+		for iter3.Rewind(); iter3.Valid(); iter3.Next() {
+			keys = append(keys, iter3.Key())
+		}
+		assert.Equal(t, [][]byte{[]byte("aeeue")}, keys)
+		iter3.Close()
+
+		destroyDB(db)
+	}
+}
@@ -0,0 +1,164 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/13 21:05
+// @Desc key 级别的分段悲观锁，用于读-改-写的临界区
+package kv_projects
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// keyLockStripes 分段锁的数量，不同的 key 可能落到同一个分段上
+const keyLockStripes = 256
+
+// keyLocks 按 key 哈希分段的锁，和 db.mu 相互独立
+// db.mu 只保护数据文件和索引的单次读写，keyLocks 保护跨越多次读写的临界区
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+// newKeyLocks 新建分段锁
+func newKeyLocks() *keyLocks {
+	return &keyLocks{}
+}
+
+// stripeOf 计算 key 所在的分段
+func (kl *keyLocks) stripeOf(key []byte) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % keyLockStripes)
+}
+
+// lockKey 对单个 key 加锁，返回解锁函数
+func (kl *keyLocks) lockKey(key []byte) func() {
+	mu := &kl.stripes[kl.stripeOf(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// lockKeyCtx 对单个 key 加锁，返回解锁函数，ctx 结束时放弃等待并返回 ctx 的错误
+// sync.Mutex 的等待不能被取消，由单独的协程等待，放弃之后协程拿到锁时立即释放
+func (kl *keyLocks) lockKeyCtx(ctx context.Context, key []byte) (func(), error) {
+	mu := &kl.stripes[kl.stripeOf(key)]
+	if mu.TryLock() {
+		return mu.Unlock, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return mu.Unlock, nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			mu.Unlock()
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// lockKeys 对多个 key 加锁，返回解锁函数
+// 分段按照序号从小到大的顺序加锁，所有调用方的加锁顺序一致，因此不会死锁
+func (kl *keyLocks) lockKeys(keys [][]byte) func() {
+	// 去重，多个 key 可能落到同一个分段上
+	seen := make(map[int]struct{}, len(keys))
+	stripes := make([]int, 0, len(keys))
+	for _, key := range keys {
+		s := kl.stripeOf(key)
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		stripes = append(stripes, s)
+	}
+	sort.Ints(stripes)
+
+	for _, s := range stripes {
+		kl.stripes[s].Lock()
+	}
+	return func() {
+		// 按照加锁的逆序解锁
+		for i := len(stripes) - 1; i >= 0; i-- {
+			kl.stripes[stripes[i]].Unlock()
+		}
+	}
+}
+
+// lockAll 按照序号从小到大对所有的分段加锁，用于合并等需要阻塞所有写入者的操作，返回解锁函数
+func (kl *keyLocks) lockAll() func() {
+	for i := range kl.stripes {
+		kl.stripes[i].Lock()
+	}
+	return func() {
+		for i := len(kl.stripes) - 1; i >= 0; i-- {
+			kl.stripes[i].Unlock()
+		}
+	}
+}
+
+// LockedKeys Update 回调中使用的句柄，只能读写加锁的 key
+type LockedKeys struct {
+	db   *DB
+	keys map[string]struct{}
+}
+
+// Get 读取加锁的 key 对应的数据
+func (lk *LockedKeys) Get(key []byte) ([]byte, error) {
+	if err := lk.check(key); err != nil {
+		return nil, err
+	}
+	return lk.db.Get(key)
+}
+
+// Put 写入加锁的 key 对应的数据
+func (lk *LockedKeys) Put(key []byte, value []byte) error {
+	if err := lk.check(key); err != nil {
+		return err
+	}
+	return lk.db.put(context.Background(), key, value)
+}
+
+// Delete 删除加锁的 key 对应的数据
+func (lk *LockedKeys) Delete(key []byte) error {
+	if err := lk.check(key); err != nil {
+		return err
+	}
+	return lk.db.delete(context.Background(), key)
+}
+
+// check 校验 key 是否在加锁的范围内
+func (lk *LockedKeys) check(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if _, ok := lk.keys[string(key)]; !ok {
+		return ErrKeyNotLocked
+	}
+	return nil
+}
+
+// Update 对给定的 key 加悲观锁，然后执行回调，回调结束后释放锁
+// 回调期间其他对这些 key 的写操作（Put、Delete、Update）都会被阻塞，适用于热点 key 的读-改-写
+// 回调中只能通过 LockedKeys 操作加锁的 key，不能调用 db 上的写方法，否则会死锁
+func (db *DB) Update(keys [][]byte, fn func(lk *LockedKeys) error) error {
+	lk := &LockedKeys{db: db, keys: make(map[string]struct{}, len(keys))}
+	for _, key := range keys {
+		if len(key) == 0 {
+			return ErrKeyIsEmpty
+		}
+		lk.keys[string(key)] = struct{}{}
+	}
+
+	unlock := db.keyLocks.lockKeys(keys)
+	defer unlock()
+	return fn(lk)
+}
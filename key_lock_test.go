@@ -0,0 +1,101 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/13 21:05
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKeyLocks_LockKeys(t *testing.T) {
+	kl := newKeyLocks()
+
+	// 1.重复的 key 和落在同一分段的 key 不会重复加锁
+	unlock := kl.lockKeys([][]byte{[]byte("a"), []byte("a"), []byte("b")})
+	unlock()
+
+	// 2.加锁顺序不同的两组 key 并发加锁，不会死锁
+	keys1 := [][]byte{utils.GetTestKey(1), utils.GetTestKey(2), utils.GetTestKey(3)}
+	keys2 := [][]byte{utils.GetTestKey(3), utils.GetTestKey(2), utils.GetTestKey(1)}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			kl.lockKeys(keys1)()
+		}()
+		go func() {
+			defer wg.Done()
+			kl.lockKeys(keys2)()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDB_Update(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-update")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.并发对同一个 key 做读-改-写，结果不会丢失更新
+	key := []byte("counter")
+	incr := func(lk *LockedKeys) error {
+		val, err := lk.Get(key)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		n, _ := strconv.Atoi(string(val))
+		return lk.Put(key, []byte(strconv.Itoa(n+1)))
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, db.Update([][]byte{key}, incr))
+			}
+		}()
+	}
+	wg.Wait()
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "1000", string(val))
+
+	// 2.多个 key 在同一个临界区中修改
+	err = db.Update([][]byte{utils.GetTestKey(1), utils.GetTestKey(2)}, func(lk *LockedKeys) error {
+		if err := lk.Put(utils.GetTestKey(1), []byte("v1")); err != nil {
+			return err
+		}
+		if err := lk.Put(utils.GetTestKey(2), []byte("v2")); err != nil {
+			return err
+		}
+		return lk.Delete(utils.GetTestKey(1))
+	})
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 3.操作没有加锁的 key
+	err = db.Update([][]byte{utils.GetTestKey(1)}, func(lk *LockedKeys) error {
+		return lk.Put(utils.GetTestKey(2), []byte("v"))
+	})
+	assert.Equal(t, ErrKeyNotLocked, err)
+
+	// 4.key 为空
+	err = db.Update([][]byte{nil}, func(lk *LockedKeys) error { return nil })
+	assert.Equal(t, ErrKeyIsEmpty, err)
+}
@@ -0,0 +1,123 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/18 22:15
+// @Desc 合并数据文件，清理无效的数据
+package kv_projects
+
+import (
+	"kv-projects/data"
+	"kv-projects/index"
+	"os"
+	"sort"
+	"time"
+)
+
+// Merge 合并数据文件，将所有有效的数据重新写入到新的数据文件中，然后删除旧的数据文件
+//
+// 合并期间持有 db.mu，写入会被阻塞，读取不受影响。新文件的 id 都大于旧文件，
+// 合并中途崩溃时，重启后旧文件和已经写入的新文件依次回放，得到的索引仍然是正确的。
+// 新文件使用当前的格式版本和密钥，因此旧格式的文件和密钥轮换之前的文件在合并之后都会被升级。
+// 范围删除记录和被它删除的记录都不在索引中，合并之后一起被清理
+func (db *DB) Merge() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	// 获取所有的分段锁，保证没有写入者处于写入日志和更新索引之间，
+	// 否则写入者在合并之后更新的索引会指向已经被删除的文件
+	unlock := db.keyLocks.lockAll()
+	defer unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 数据库为空，直接返回
+	if db.activeFile == nil {
+		return nil
+	}
+
+	start := time.Now()
+	// 持久化当前活跃文件，并转换为旧的数据文件
+	if err := db.syncDataFile(db.activeFile); err != nil {
+		return err
+	}
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	// 订阅者读取到这个位置之后才没有遗漏被合并的记录
+	db.mergedSeq.Store(makeSeq(db.activeFile.FileId, db.activeFile.WriteOff))
+	// 记录所有需要合并的文件
+	var mergeFiles []*data.DataFile
+	for _, dataFile := range db.olderFiles {
+		mergeFiles = append(mergeFiles, dataFile)
+	}
+	sort.Slice(mergeFiles, func(i, j int) bool {
+		return mergeFiles[i].FileId < mergeFiles[j].FileId
+	})
+	// 打开新的活跃文件，合并的数据写到这里
+	if err := db.setActiveDataFile(); err != nil {
+		return err
+	}
+
+	// 遍历索引，将有效的数据重新写入。注册表最先写入，回放时命名空间在其中的数据之前被创建，
+	// 已经删除的命名空间没有索引，其中的数据不会被重写
+	indexes := []index.Indexer{db.registry, db.index}
+	for _, ns := range db.sortedNamespaces() {
+		indexes = append(indexes, ns.index)
+	}
+	for _, idx := range indexes {
+		if err := db.rewriteIndex(idx); err != nil {
+			return err
+		}
+	}
+	// 旧数据文件中大 value 在重写时可能会分离到值日志中
+	if err := db.syncActiveFiles(); err != nil {
+		return err
+	}
+	db.bytesWrite = 0
+
+	// 索引已经全部指向新的文件，移除旧的数据文件
+	mergeFids := make(map[uint32]struct{}, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		delete(db.olderFiles, dataFile.FileId)
+		mergeFids[dataFile.FileId] = struct{}{}
+	}
+	db.refreshDataFiles()
+	db.publishCommitted()
+	db.cache.purge(false, mergeFids)
+	// 合并期间没有写入，重新构建布隆过滤器，清理已经删除的 key
+	db.rebuildBloomFilter()
+	// 按照 id 从小到大删除，中途崩溃时剩下的都是较新的文件，不会让已经删除的 key 重新出现
+	for _, dataFile := range mergeFiles {
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(data.GetDataFileName(db.options.DirPath, dataFile.FileId)); err != nil {
+			return err
+		}
+	}
+	db.metrics.merge.observe(time.Since(start))
+	return nil
+}
+
+// rewriteIndex 将索引中的所有记录原样写入到活跃文件中，并更新索引，调用方需要持有 db.mu
+func (db *DB) rewriteIndex(idx index.Indexer) error {
+	iter := idx.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		oldPos := iter.Value()
+		dataFile := db.olderFiles[oldPos.Fid]
+		if dataFile == nil {
+			return ErrDataFileNotFound
+		}
+		logRecord, _, err := dataFile.ReadLogRecord(oldPos.Offset)
+		if err != nil {
+			return err
+		}
+		// 原样写入，已经压缩过的 value 不需要重新压缩
+		pos, err := db.writeLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		if ok := idx.Put(iter.Key(), pos); !ok {
+			return ErrIndexUpdateFailed
+		}
+	}
+	return nil
+}
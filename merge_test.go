@@ -0,0 +1,348 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/18 22:15
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/fio"
+	"kv-projects/utils"
+	"os"
+	"sync"
+	"testing"
+)
+
+// 没有任何数据的情况下进行 merge
+func TestDB_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-1")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+}
+
+// 有失效的数据，和被重复 Put 的数据
+func TestDB_Merge2(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-2")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 10000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 40000; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value in merge"))
+		assert.Nil(t, err)
+	}
+	oldFiles := len(db.olderFiles)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Less(t, len(db.olderFiles), oldFiles)
+
+	// 重启校验
+	err = db.activeFile.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 40000, db2.index.Size())
+	for i := 0; i < 10000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 40000; i < 50000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new value in merge"), val)
+	}
+}
+
+// merge 的过程中有新的读取
+func TestDB_Merge3(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-3")
+	opts.DirPath = dir
+	opts.DataFileSize = 1024 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 20000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	wg := new(sync.WaitGroup)
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i = (i + 7) % 20000 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				val, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, utils.GetTestKey(i), val)
+			}
+		}(r)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	close(stop)
+	wg.Wait()
+
+	// merge 之后的写入
+	err = db.Put(utils.GetTestKey(1), []byte("after merge"))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("after merge"), val)
+}
+
+// 轮换密钥之后 merge，所有的数据都使用新的密钥加密
+func TestDB_Merge_RotateEncryptionKey(t *testing.T) {
+	key1, key2 := bytes.Repeat([]byte("1"), 32), bytes.Repeat([]byte("2"), 32)
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-rotate")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.EncryptionKey = key1
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.activeFile.Close()
+	assert.Nil(t, err)
+
+	// 1.轮换密钥，旧的数据使用旧的密钥读取，新的数据写入到新的文件中
+	opts.EncryptionKey = key2
+	opts.PreviousEncryptionKeys = [][]byte{key1}
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	val, err := db2.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	assert.Equal(t, db2.fileOptions.KeyRing.CurrentId(), db2.activeFile.KeyId())
+	for i := 2000; i < 2100; i++ {
+		err := db2.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 2.merge 之后所有的文件都使用新的密钥
+	err = db2.Merge()
+	assert.Nil(t, err)
+	for _, dataFile := range *db2.dataFiles.Load() {
+		assert.Equal(t, db2.fileOptions.KeyRing.CurrentId(), dataFile.KeyId())
+	}
+	err = db2.activeFile.Close()
+	assert.Nil(t, err)
+
+	// 3.不再需要旧的密钥
+	opts.PreviousEncryptionKeys = nil
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 2100; i++ {
+		val, err := db3.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	err = db3.activeFile.Close()
+	assert.Nil(t, err)
+
+	// 4.使用错误的密钥打开
+	opts.EncryptionKey = bytes.Repeat([]byte("3"), 32)
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+}
+
+// 没有文件头的旧数据文件可以读取，merge 之后升级为当前的格式
+func TestDB_Merge_UpgradeLegacyFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-upgrade")
+	opts.DirPath = dir
+
+	// 直接写入没有文件头的旧数据文件
+	ioManager, err := fio.NewIOManager(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		enc, _ := data.EncodeLogRecord(&data.LogRecord{Key: utils.GetTestKey(i), Value: utils.GetTestKey(i)})
+		_, err := ioManager.Write(enc)
+		assert.Nil(t, err)
+	}
+	enc, _ := data.EncodeLogRecord(&data.LogRecord{Key: utils.GetTestKey(0), Type: data.LogRecordDeleted})
+	_, err = ioManager.Write(enc)
+	assert.Nil(t, err)
+	assert.Nil(t, ioManager.Close())
+
+	// 1.旧文件可以读取，新的数据写入到新的文件中
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), db.activeFile.FileId)
+	assert.Equal(t, data.FileVersionLegacy, db.olderFiles[0].Version())
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	err = db.Put(utils.GetTestKey(100), utils.GetTestKey(100))
+	assert.Nil(t, err)
+
+	// 2.merge 之后所有的文件都是当前的格式
+	err = db.Merge()
+	assert.Nil(t, err)
+	for _, dataFile := range *db.dataFiles.Load() {
+		assert.Equal(t, data.FileVersionCurrent, dataFile.Version())
+	}
+	err = db.activeFile.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, db2.index.Size())
+	for i := 1; i <= 100; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+func TestDB_Merge_ChangeChecksum(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-checksum")
+	opts.DirPath = dir
+
+	// 1.依次使用不同的校验算法写入数据，同一个目录下有不同算法的数据文件
+	checksums := []data.ChecksumType{data.ChecksumCRC32, data.ChecksumCRC32C, data.ChecksumXXHash64}
+	var db *DB
+	for i, checksum := range checksums {
+		opts.Checksum = checksum
+		db2, err := Open(opts)
+		assert.Nil(t, err)
+		for j := i * 100; j < (i+1)*100; j++ {
+			err := db2.Put(utils.GetTestKey(j), utils.GetTestKey(j))
+			assert.Nil(t, err)
+		}
+		err = db2.Delete(utils.GetTestKey(i * 100))
+		assert.Nil(t, err)
+		assert.Equal(t, checksum, db2.activeFile.Checksum())
+		if i < len(checksums)-1 {
+			assert.Nil(t, db2.activeFile.Close())
+		}
+		db = db2
+	}
+	defer destroyDB(db)
+	assert.Equal(t, 3, len(*db.dataFiles.Load()))
+	for i := 0; i < 300; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if i%100 == 0 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 2.merge 之后所有的文件都使用当前的算法
+	err := db.Merge()
+	assert.Nil(t, err)
+	for _, dataFile := range *db.dataFiles.Load() {
+		assert.Equal(t, data.ChecksumXXHash64, dataFile.Checksum())
+	}
+	assert.Nil(t, db.activeFile.Close())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 297, db2.index.Size())
+	val, err := db2.Get(utils.GetTestKey(299))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(299), val)
+	assert.Nil(t, db2.activeFile.Close())
+
+	// 3.不支持的校验算法
+	opts.Checksum = data.ChecksumXXHash64 + 1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+// 合并删除旧文件的过程中崩溃，剩下的旧文件中的删除记录对应的写入已经被删除了
+func TestDB_Merge_CrashWhileRemovingFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-crash")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.第一个文件中的写入，之后的文件中删除
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	kept, err := db.Namespace("kept")
+	assert.Nil(t, err)
+	assert.Nil(t, kept.Put([]byte("key"), []byte("value")))
+	_, err = db.Namespace("dropped")
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, db.Delete([]byte("key")))
+	assert.Nil(t, kept.Delete([]byte("key")))
+	assert.Nil(t, db.DropNamespace("dropped"))
+	assert.Greater(t, len(db.olderFiles), 1)
+
+	// 2.保存合并之前的数据文件
+	oldFiles := make(map[uint32][]byte)
+	for fid := range *db.dataFiles.Load() {
+		content, err := os.ReadFile(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		oldFiles[fid] = content
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 3.模拟只删除了第一个旧文件时崩溃
+	for fid, content := range oldFiles {
+		if fid != 0 {
+			assert.Nil(t, os.WriteFile(data.GetDataFileName(dir, fid), content, 0644))
+		}
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	kept, err = db.Namespace("kept")
+	assert.Nil(t, err)
+	_, err = kept.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.NotContains(t, db.Namespaces(), "dropped")
+	for i := 0; i < 100; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+}
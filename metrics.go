@@ -0,0 +1,199 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/10 20:30
+// @Desc 运行状态的指标，提供快照和 Prometheus 文本格式的输出
+package kv_projects
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"kv-projects/data"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 耗时分布的桶的上界，单位为秒
+var (
+	fsyncBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+	mergeBuckets = []float64{0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300}
+)
+
+// Metrics 数据库运行状态的快照，计数器从打开数据库开始累计
+type Metrics struct {
+	Gets              uint64     // 读取的 key 的数量
+	Puts              uint64     // 写入的记录数量，包括命名空间和二级索引中的记录
+	Deletes           uint64     // 删除的记录数量
+	RangeDeletes      uint64     // 范围删除的次数
+	BytesWritten      uint64     // 写入数据文件和值日志文件的字节数，包括合并和垃圾回收重写的数据
+	DataFileRotations uint64     // 活跃数据文件写满之后切换的次数
+	ValueLogRotations uint64     // 活跃值日志文件写满之后切换的次数
+	Fsync             Histogram  // 持久化的耗时
+	Merge             Histogram  // 合并的耗时，只包括成功的合并
+	IndexSize         int        // 默认命名空间的索引中 key 的数量
+	OpenFiles         int        // 打开的数据文件和值日志文件的数量
+	Cache             CacheStats // 日志记录缓存的统计
+}
+
+// Histogram 耗时的分布
+type Histogram struct {
+	Bounds []float64 // 每个桶的上界，单位为秒
+	Counts []uint64  // 耗时不超过对应上界的次数，和 Prometheus 一样是累计值
+	Count  uint64    // 总次数
+	Sum    float64   // 总耗时，单位为秒
+}
+
+// metrics 运行中累计的指标，都是原子变量，不需要持有 db.mu
+type metrics struct {
+	gets              atomic.Uint64
+	puts              atomic.Uint64
+	deletes           atomic.Uint64
+	rangeDeletes      atomic.Uint64
+	bytesWritten      atomic.Uint64
+	dataFileRotations atomic.Uint64
+	valueLogRotations atomic.Uint64
+	fsync             *histogram
+	merge             *histogram
+}
+
+// newMetrics 新建指标
+func newMetrics() *metrics {
+	return &metrics{
+		fsync: newHistogram(fsyncBuckets),
+		merge: newHistogram(mergeBuckets),
+	}
+}
+
+// recordWrites 统计写入的记录，批次的开始和提交记录以及分块写入的块不计入
+func (m *metrics) recordWrites(logRecords []*data.LogRecord) {
+	for _, logRecord := range logRecords {
+		switch logRecord.Type {
+		case data.LogRecordNormal, data.LogRecordChunkManifest:
+			m.puts.Add(1)
+		case data.LogRecordDeleted:
+			m.deletes.Add(1)
+		case data.LogRecordRangeDeleted:
+			m.rangeDeletes.Add(1)
+		}
+	}
+}
+
+// histogram 固定分桶的耗时分布
+type histogram struct {
+	bounds   []float64
+	counts   []atomic.Uint64 // 每个桶的次数，不是累计值，最后一个桶没有上界
+	sumNanos atomic.Uint64
+}
+
+// newHistogram 新建耗时分布
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// observe 记录一次耗时
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d.Seconds() > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sumNanos.Add(uint64(d))
+}
+
+// snapshot 耗时分布的快照，总次数由各个桶累加得到，和桶中的次数保持一致
+func (h *histogram) snapshot() Histogram {
+	snap := Histogram{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Sum:    time.Duration(h.sumNanos.Load()).Seconds(),
+	}
+	for i := range h.counts {
+		snap.Count += h.counts[i].Load()
+		if i < len(h.bounds) {
+			snap.Counts[i] = snap.Count
+		}
+	}
+	return snap
+}
+
+// syncDataFile 持久化数据文件或者值日志文件，并记录耗时
+func (db *DB) syncDataFile(dataFile *data.DataFile) error {
+	start := time.Now()
+	err := dataFile.Sync()
+	db.metrics.fsync.observe(time.Since(start))
+	return err
+}
+
+// Metrics 当前运行状态的快照
+func (db *DB) Metrics() Metrics {
+	m := db.metrics
+	return Metrics{
+		Gets:              m.gets.Load(),
+		Puts:              m.puts.Load(),
+		Deletes:           m.deletes.Load(),
+		RangeDeletes:      m.rangeDeletes.Load(),
+		BytesWritten:      m.bytesWritten.Load(),
+		DataFileRotations: m.dataFileRotations.Load(),
+		ValueLogRotations: m.valueLogRotations.Load(),
+		Fsync:             m.fsync.snapshot(),
+		Merge:             m.merge.snapshot(),
+		IndexSize:         db.index.Size(),
+		OpenFiles:         len(*db.dataFiles.Load()) + len(*db.valueLog.files.Load()),
+		Cache:             db.CacheStats(),
+	}
+}
+
+// MetricsHandler 以 Prometheus 文本格式输出指标的 HTTP 处理器，可以挂载到 /metrics
+func (db *DB) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = db.Metrics().WritePrometheus(w)
+	})
+}
+
+// WritePrometheus 以 Prometheus 文本格式写出指标
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	header("bitcask_operations_total", "counter", "Number of operations by type.")
+	fmt.Fprintf(bw, "bitcask_operations_total{op=\"get\"} %d\n", m.Gets)
+	fmt.Fprintf(bw, "bitcask_operations_total{op=\"put\"} %d\n", m.Puts)
+	fmt.Fprintf(bw, "bitcask_operations_total{op=\"delete\"} %d\n", m.Deletes)
+	fmt.Fprintf(bw, "bitcask_operations_total{op=\"delete_range\"} %d\n", m.RangeDeletes)
+	header("bitcask_written_bytes_total", "counter", "Bytes written to data and value log files.")
+	fmt.Fprintf(bw, "bitcask_written_bytes_total %d\n", m.BytesWritten)
+	header("bitcask_file_rotations_total", "counter", "Number of active file rotations by file kind.")
+	fmt.Fprintf(bw, "bitcask_file_rotations_total{kind=\"data\"} %d\n", m.DataFileRotations)
+	fmt.Fprintf(bw, "bitcask_file_rotations_total{kind=\"value_log\"} %d\n", m.ValueLogRotations)
+	header("bitcask_fsync_duration_seconds", "histogram", "Latency of fsync calls.")
+	writeHistogram(bw, "bitcask_fsync_duration_seconds", m.Fsync)
+	header("bitcask_merge_duration_seconds", "histogram", "Duration of completed merges.")
+	writeHistogram(bw, "bitcask_merge_duration_seconds", m.Merge)
+	header("bitcask_index_keys", "gauge", "Number of keys in the default index.")
+	fmt.Fprintf(bw, "bitcask_index_keys %d\n", m.IndexSize)
+	header("bitcask_open_files", "gauge", "Number of open data and value log files.")
+	fmt.Fprintf(bw, "bitcask_open_files %d\n", m.OpenFiles)
+	header("bitcask_cache_hits_total", "counter", "Record cache hits.")
+	fmt.Fprintf(bw, "bitcask_cache_hits_total %d\n", m.Cache.Hits)
+	header("bitcask_cache_misses_total", "counter", "Record cache misses.")
+	fmt.Fprintf(bw, "bitcask_cache_misses_total %d\n", m.Cache.Misses)
+	header("bitcask_cache_entries", "gauge", "Number of cached records.")
+	fmt.Fprintf(bw, "bitcask_cache_entries %d\n", m.Cache.Entries)
+	header("bitcask_cache_bytes", "gauge", "Bytes used by cached records.")
+	fmt.Fprintf(bw, "bitcask_cache_bytes %d\n", m.Cache.Bytes)
+	return bw.Flush()
+}
+
+// writeHistogram 写出耗时分布的各个桶以及总和和次数
+func writeHistogram(w io.Writer, name string, h Histogram) {
+	for i, bound := range h.Bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
@@ -0,0 +1,89 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/10 20:30
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDB_Metrics(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-metrics")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.ValueThreshold = 64
+	opts.SyncWrites = true
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.按照类型统计操作
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(i%2*100+10)))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		_, _ = db.Get(utils.GetTestKey(i))
+	}
+	db.MultiGet([][]byte{utils.GetTestKey(10), utils.GetTestKey(11)})
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(10), utils.GetTestKey(20)))
+
+	m := db.Metrics()
+	assert.Equal(t, uint64(200), m.Puts)
+	assert.Equal(t, uint64(10), m.Deletes)
+	assert.Equal(t, uint64(1), m.RangeDeletes)
+	assert.Equal(t, uint64(12), m.Gets)
+	assert.Greater(t, m.BytesWritten, uint64(200*10))
+	assert.Greater(t, m.DataFileRotations, uint64(0))
+	assert.Greater(t, m.ValueLogRotations, uint64(0))
+	assert.Equal(t, 180, m.IndexSize)
+	assert.Equal(t, int(m.DataFileRotations+m.ValueLogRotations)+2, m.OpenFiles)
+
+	// 2.每次写入都持久化，耗时分布的桶是累计值
+	assert.GreaterOrEqual(t, m.Fsync.Count, uint64(211))
+	for i := 1; i < len(m.Fsync.Counts); i++ {
+		assert.LessOrEqual(t, m.Fsync.Counts[i-1], m.Fsync.Counts[i])
+	}
+	assert.LessOrEqual(t, m.Fsync.Counts[len(m.Fsync.Counts)-1], m.Fsync.Count)
+
+	// 3.合并的耗时
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), db.Metrics().Merge.Count)
+
+	// 4.Prometheus 文本格式
+	recorder := httptest.NewRecorder()
+	db.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	assert.True(t, strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain"))
+	assert.Contains(t, body, "# TYPE bitcask_operations_total counter\n")
+	assert.Contains(t, body, "bitcask_operations_total{op=\"put\"} 200\n")
+	assert.Contains(t, body, "bitcask_index_keys 180\n")
+	assert.Contains(t, body, "# TYPE bitcask_fsync_duration_seconds histogram\n")
+	assert.Contains(t, body, "bitcask_merge_duration_seconds_count 1\n")
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.001, 0.01})
+	h.observe(500 * time.Microsecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Second)
+
+	snap := h.snapshot()
+	assert.Equal(t, []uint64{1, 2}, snap.Counts)
+	assert.Equal(t, uint64(3), snap.Count)
+	assert.InDelta(t, 1.0055, snap.Sum, 1e-9)
+
+	var sb strings.Builder
+	writeHistogram(&sb, "latency", snap)
+	assert.Equal(t, "latency_bucket{le=\"0.001\"} 1\nlatency_bucket{le=\"0.01\"} 2\n"+
+		"latency_bucket{le=\"+Inf\"} 3\nlatency_sum 1.0055\nlatency_count 3\n", sb.String())
+}
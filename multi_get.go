@@ -0,0 +1,113 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/8 19:30
+// @Desc 批量读取，按照数据文件和偏移排序之后读取，不同数据文件并行读取
+package kv_projects
+
+import (
+	"kv-projects/data"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// multiGetRead MultiGet 中一次需要读取数据文件的 key
+type multiGetRead struct {
+	i   int // key 在输入中的下标
+	pos *data.LogRecordPos
+}
+
+// MultiGet 批量读取多个 key，返回的 value 和错误和 keys 一一对应，不存在的 key 对应 ErrKeyNotFound
+// 先在持有这些 key 的分段锁时从索引中取出所有 key 的位置，得到一致的快照：
+// 写入者在持有分段锁时更新索引，Update 中对多个 key 的写入要么全部可见，要么全部不可见。
+// 之后释放锁，再按照 (Fid, Offset) 排序，同一个数据文件中顺序读取，不同的数据文件由多个协程并行读取，
+// 读取数据文件期间不阻塞写入。不能在 Update 的回调中调用，否则会死锁
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	db.metrics.gets.Add(uint64(len(keys)))
+	for {
+		values, errs, retired := db.multiGet(keys)
+		// 读取期间文件被合并，重新取出所有 key 的位置，不能只对这个 key 单独查找，否则会混入快照之后的写入
+		if !retired {
+			return values, errs
+		}
+	}
+}
+
+// multiGet 按照一致的快照批量读取，retired 表示读取期间有文件被合并
+func (db *DB) multiGet(keys [][]byte) ([][]byte, []error, bool) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	// 持有分段锁时从索引中取出所有 key 的位置
+	reads := make([]multiGetRead, 0, len(keys))
+	unlock := db.keyLocks.lockKeys(keys)
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrKeyIsEmpty
+			continue
+		}
+		var pos *data.LogRecordPos
+		if db.mayContain(key) {
+			pos = db.index.Get(key)
+		}
+		if pos == nil {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		reads = append(reads, multiGetRead{i: i, pos: pos})
+	}
+	unlock()
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].pos.Fid != reads[j].pos.Fid {
+			return reads[i].pos.Fid < reads[j].pos.Fid
+		}
+		return reads[i].pos.Offset < reads[j].pos.Offset
+	})
+
+	// 按照数据文件分组，每组由一个协程顺序读取
+	var groups [][]multiGetRead
+	for start := 0; start < len(reads); {
+		end := start + 1
+		for end < len(reads) && reads[end].pos.Fid == reads[start].pos.Fid {
+			end++
+		}
+		groups = append(groups, reads[start:end])
+		start = end
+	}
+	var retired atomic.Bool
+	read := func(group []multiGetRead) {
+		for _, r := range group {
+			values[r.i], errs[r.i] = db.getValueByPosition(r.pos)
+			if db.isFileRetired(errs[r.i]) {
+				retired.Store(true)
+				return
+			}
+		}
+	}
+	if len(groups) <= 1 {
+		for _, group := range groups {
+			read(group)
+		}
+		return values, errs, retired.Load()
+	}
+
+	workers := min(len(groups), runtime.GOMAXPROCS(0))
+	groupCh := make(chan []multiGetRead, len(groups))
+	for _, group := range groups {
+		groupCh <- group
+	}
+	close(groupCh)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range groupCh {
+				read(group)
+			}
+		}()
+	}
+	wg.Wait()
+	return values, errs, retired.Load()
+}
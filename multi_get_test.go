@@ -0,0 +1,136 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/8 19:30
+// @Desc
+package kv_projects
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_MultiGet(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-multi-get")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	opts.ValueThreshold = 96
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.数据库为空
+	values, errs := db.MultiGet(nil)
+	assert.Equal(t, 0, len(values))
+	assert.Equal(t, 0, len(errs))
+
+	// 2.写入的数据分布在多个数据文件和值日志中
+	expected := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		value := utils.RandomValue(i%2*100 + 10)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+		expected[i] = value
+	}
+	assert.Greater(t, len(db.olderFiles), 1)
+	for i := 0; i < 1000; i += 10 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+
+	// 3.结果和输入的顺序一致，每个 key 有各自的错误
+	var keys [][]byte
+	for i := 999; i >= 0; i -= 3 {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	keys = append(keys, nil, []byte("not-exist"))
+	values, errs = db.MultiGet(keys)
+	assert.Equal(t, len(keys), len(values))
+	for j, i := 0, 999; i >= 0; i, j = i-3, j+1 {
+		if i%10 == 0 {
+			assert.Equal(t, ErrKeyNotFound, errs[j])
+			continue
+		}
+		assert.Nil(t, errs[j])
+		assert.Equal(t, expected[i], values[j])
+	}
+	assert.Equal(t, ErrKeyIsEmpty, errs[len(keys)-2])
+	assert.Equal(t, ErrKeyNotFound, errs[len(keys)-1])
+
+	// 4.合并之后仍然可以读取
+	err = db.Merge()
+	assert.Nil(t, err)
+	values, errs = db.MultiGet(keys[:3])
+	for j := 0; j < 3; j++ {
+		assert.Nil(t, errs[j])
+		assert.Equal(t, expected[999-j*3], values[j])
+	}
+}
+
+func TestDB_MultiGet_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-multi-get-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 8 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入者在 Update 中把所有 key 更新为同一个版本，同时合并数据文件
+	var keys [][]byte
+	for i := 0; i < 16; i++ {
+		keys = append(keys, utils.GetTestKey(i))
+	}
+	write := func(version int) error {
+		return db.Update(keys, func(lk *LockedKeys) error {
+			for _, key := range keys {
+				if err := lk.Put(key, []byte(strconv.Itoa(version))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	assert.Nil(t, write(0))
+	stop := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for version := 1; ; version++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.Nil(t, write(version))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			assert.Nil(t, db.Merge())
+		}
+	}()
+
+	// 2.每次读到的所有 key 都是同一个版本
+	for n := 0; n < 500; n++ {
+		values, errs := db.MultiGet(keys)
+		for i := range keys {
+			assert.Nil(t, errs[i])
+			if !assert.Equal(t, values[0], values[i]) {
+				break
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
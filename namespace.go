@@ -0,0 +1,375 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/1 16:20
+// @Desc 命名空间，多个相互独立的 key 空间共享同一组数据文件
+package kv_projects
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"kv-projects/data"
+	"kv-projects/index"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// systemNamespace 命名空间注册表所在的命名空间
+// 注册表中 key 是命名空间的名称，value 是编码之后的 id 和配置，删除命名空间即写入注册表中的删除记录
+const systemNamespace uint32 = math.MaxUint32
+
+// internalNamespacePrefix 存储引擎内部使用的命名空间的名称前缀，例如二级索引，不能由用户新建和删除
+const internalNamespacePrefix = "\x00"
+
+// NamespaceOptions 命名空间的配置，只在新建命名空间时生效，之后记录在注册表中
+// 存储引擎还不支持 key 的过期，因此没有默认的过期时间
+type NamespaceOptions struct {
+	// 索引类型，只支持 BTree 和 ShardedBTree
+	IndexType IndexerType
+
+	// 分片索引的分片数量，只在索引类型为 ShardedBTree 时生效
+	IndexShards int
+}
+
+var DefaultNamespaceOptions = NamespaceOptions{
+	IndexType:   BTree,
+	IndexShards: 16,
+}
+
+// Namespace 命名空间
+// 每个命名空间有自己的内存索引，数据和默认命名空间一样追加写入到共享的数据文件中，记录中带有命名空间的 id。
+// 删除命名空间只需要写入一条删除记录并丢弃索引，数据在下一次合并时被清理；id 不会复用，
+// 因此之后新建的同名命名空间看不到之前的数据。订阅和监听只包含默认命名空间的写入
+type Namespace struct {
+	db       *DB
+	name     string
+	id       uint32
+	options  NamespaceOptions
+	index    index.Indexer
+	dropped  atomic.Bool
+	building bool // 二级索引还在构建，构建完成之前崩溃时索引不完整，访问时需要持有 db.mu
+}
+
+// Namespace 获取名称为 name 的命名空间，不存在时使用默认配置新建
+func (db *DB) Namespace(name string) (*Namespace, error) {
+	return db.NamespaceWithOptions(name, DefaultNamespaceOptions)
+}
+
+// NamespaceWithOptions 获取名称为 name 的命名空间，不存在时使用 opts 新建，已经存在时忽略 opts
+func (db *DB) NamespaceWithOptions(name string, opts NamespaceOptions) (*Namespace, error) {
+	if len(name) == 0 {
+		return nil, ErrNamespaceNameEmpty
+	}
+	if isInternalNamespace(name) {
+		return nil, ErrNamespaceNameReserved
+	}
+	if err := checkNamespaceOptions(opts, db.options.Comparator); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+	if ns := db.namespaces[name]; ns != nil {
+		return ns, nil
+	}
+	if db.maxNamespaceId+1 == systemNamespace {
+		return nil, ErrTooManyNamespaces
+	}
+
+	ns := newNamespace(db, name, db.maxNamespaceId+1, opts)
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:       []byte(name),
+		Value:     encodeNamespaceMeta(ns.id, opts),
+		Type:      data.LogRecordNormal,
+		Namespace: systemNamespace,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ok := db.registry.Put([]byte(name), pos); !ok {
+		return nil, ErrIndexUpdateFailed
+	}
+	db.addNamespace(ns)
+	return ns, nil
+}
+
+// DropNamespace 删除命名空间，之前获取的命名空间不能再读写，数据在下一次合并时被清理
+func (db *DB) DropNamespace(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	ns := db.namespaces[name]
+	if ns == nil || isInternalNamespace(name) {
+		return ErrNamespaceNotFound
+	}
+	return db.dropNamespace(ns)
+}
+
+// dropNamespace 写入注册表中的删除记录并移除命名空间，调用方需要持有 db.mu
+func (db *DB) dropNamespace(ns *Namespace) error {
+	_, err := db.appendLogRecord(&data.LogRecord{
+		Key:       []byte(ns.name),
+		Type:      data.LogRecordDeleted,
+		Namespace: systemNamespace,
+	})
+	if err != nil {
+		return err
+	}
+	if ok := db.registry.Delete([]byte(ns.name)); !ok {
+		return ErrIndexUpdateFailed
+	}
+	db.removeNamespace(ns)
+	return nil
+}
+
+// Namespaces 所有命名空间的名称，按照名称排序，不包括存储引擎内部使用的命名空间
+func (db *DB) Namespaces() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.namespaces))
+	for name := range db.namespaces {
+		if !isInternalNamespace(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isInternalNamespace 是否是存储引擎内部使用的命名空间
+func isInternalNamespace(name string) bool {
+	return strings.HasPrefix(name, internalNamespacePrefix)
+}
+
+// newNamespace 新建命名空间的实例
+// 用户的命名空间和默认命名空间使用相同的比较器，内部的命名空间按照字节序比较
+func newNamespace(db *DB, name string, id uint32, opts NamespaceOptions) *Namespace {
+	cmp := db.options.Comparator
+	if isInternalNamespace(name) {
+		cmp = index.BytewiseComparator
+	}
+	return &Namespace{
+		db:      db,
+		name:    name,
+		id:      id,
+		options: opts,
+		index:   index.NewIndexer(opts.IndexType, opts.IndexShards, cmp),
+	}
+}
+
+// addNamespace 注册命名空间，调用方需要持有 db.mu
+func (db *DB) addNamespace(ns *Namespace) {
+	db.namespaces[ns.name] = ns
+	db.namespaceIds[ns.id] = ns
+	db.maxNamespaceId = max(db.maxNamespaceId, ns.id)
+}
+
+// removeNamespace 移除命名空间，丢弃其索引，调用方需要持有 db.mu
+func (db *DB) removeNamespace(ns *Namespace) {
+	delete(db.namespaces, ns.name)
+	delete(db.namespaceIds, ns.id)
+	ns.dropped.Store(true)
+}
+
+// sortedNamespaces 按照 id 排序的所有命名空间，调用方需要持有 db.mu
+func (db *DB) sortedNamespaces() []*Namespace {
+	namespaces := make([]*Namespace, 0, len(db.namespaceIds))
+	for _, ns := range db.namespaceIds {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].id < namespaces[j].id })
+	return namespaces
+}
+
+// indexOf 命名空间的索引，命名空间已经被删除时返回 nil，调用方需要持有 db.mu
+func (db *DB) indexOf(namespace uint32) index.Indexer {
+	switch namespace {
+	case 0:
+		return db.index
+	case systemNamespace:
+		return db.registry
+	}
+	if ns := db.namespaceIds[namespace]; ns != nil {
+		return ns.index
+	}
+	return nil
+}
+
+// indexNamespaceRecord 加载索引时处理命名空间中的记录，已经删除的命名空间中的记录被忽略
+func (db *DB) indexNamespaceRecord(logRecord *data.LogRecord, pos *data.LogRecordPos) error {
+	if logRecord.Namespace == systemNamespace {
+		return db.indexRegistryRecord(logRecord, pos)
+	}
+	// 已经删除的命名空间中的记录也占用 id，避免在它们被合并清理之前复用
+	db.maxNamespaceId = max(db.maxNamespaceId, logRecord.Namespace)
+	ns := db.namespaceIds[logRecord.Namespace]
+	if ns == nil {
+		return nil
+	}
+	// 和默认命名空间一样，删除记录对应的写入可能已经在合并中被删除了
+	if logRecord.Type == data.LogRecordDeleted {
+		ns.index.Delete(logRecord.Key)
+		return nil
+	}
+	if ok := ns.index.Put(logRecord.Key, pos); !ok {
+		return ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// indexRegistryRecord 加载索引时处理注册表中的记录，新建或者删除命名空间
+func (db *DB) indexRegistryRecord(logRecord *data.LogRecord, pos *data.LogRecordPos) error {
+	name := string(logRecord.Key)
+	existing := db.namespaces[name]
+	if logRecord.Type == data.LogRecordDeleted {
+		if existing != nil {
+			db.removeNamespace(existing)
+		}
+		// 创建命名空间的记录可能已经在合并中被删除了
+		db.registry.Delete(logRecord.Key)
+		return nil
+	}
+
+	id, opts, building, err := decodeNamespaceMeta(logRecord.Value)
+	if err != nil {
+		return err
+	}
+	if ok := db.registry.Put(logRecord.Key, pos); !ok {
+		return ErrIndexUpdateFailed
+	}
+	// 合并会重写注册表，同一个命名空间的记录可能出现多次，二级索引构建完成时再次写入
+	if existing != nil && existing.id == id {
+		existing.building = building
+		return nil
+	}
+	if existing != nil {
+		db.removeNamespace(existing)
+	}
+	ns := newNamespace(db, name, id, opts)
+	ns.building = building
+	db.addNamespace(ns)
+	return nil
+}
+
+// Name 命名空间的名称
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// Put 写入 Key/Value 数据，key 不能为空
+func (ns *Namespace) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ns.dropped.Load() {
+		return ErrNamespaceDropped
+	}
+
+	unlock := ns.db.keyLocks.lockKey(key)
+	defer unlock()
+	logRecord := &data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal, Namespace: ns.id}
+	pos, err := ns.db.appendLogRecordWithLock(logRecord)
+	if err != nil {
+		return err
+	}
+	if ok := ns.index.Put(key, pos); !ok {
+		return ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// Get 根据 key 读取数据
+func (ns *Namespace) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	if ns.dropped.Load() {
+		return nil, ErrNamespaceDropped
+	}
+	ns.db.metrics.gets.Add(1)
+	return ns.db.getFromIndex(context.Background(), ns.index, key)
+}
+
+// Delete 根据 key 删除对应的数据
+func (ns *Namespace) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ns.dropped.Load() {
+		return ErrNamespaceDropped
+	}
+
+	unlock := ns.db.keyLocks.lockKey(key)
+	defer unlock()
+	if pos := ns.index.Get(key); pos == nil {
+		return nil
+	}
+	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted, Namespace: ns.id}
+	if _, err := ns.db.appendLogRecordWithLock(logRecord); err != nil {
+		return err
+	}
+	if ok := ns.index.Delete(key); !ok {
+		return ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// NewIterator 初始化命名空间的迭代器，迭代器遍历的是创建时刻索引的快照
+func (ns *Namespace) NewIterator(opts IteratorOptions) *Iterator {
+	return ns.db.newIterator(ns.index, opts, ns.Get)
+}
+
+// encodeNamespaceMeta 编码注册表中命名空间的 id 和配置
+//
+//	+-------------+-------------+---------------+-------------+
+//	|     id      | index type  |  index shards |    flags    |
+//	+-------------+-------------+---------------+-------------+
+//	  变长（最大5）     1字节        变长（最大10）    1字节（可选）
+//
+// flags 只在构建中的二级索引的记录中出现
+func encodeNamespaceMeta(id uint32, opts NamespaceOptions) []byte {
+	buf := binary.AppendUvarint(nil, uint64(id))
+	buf = append(buf, byte(opts.IndexType))
+	return binary.AppendUvarint(buf, uint64(opts.IndexShards))
+}
+
+// namespaceBuilding 命名空间是还在构建的二级索引
+const namespaceBuilding byte = 1
+
+// decodeNamespaceMeta 解码注册表中命名空间的 id 和配置，以及是否是还在构建的二级索引
+func decodeNamespaceMeta(buf []byte) (uint32, NamespaceOptions, bool, error) {
+	var opts NamespaceOptions
+	id, n := binary.Uvarint(buf)
+	if n <= 0 || id == 0 || id >= uint64(systemNamespace) || len(buf) == n {
+		return 0, opts, false, ErrNamespaceCorrupted
+	}
+	opts.IndexType = IndexerType(buf[n])
+	shards, m := binary.Uvarint(buf[n+1:])
+	if m <= 0 {
+		return 0, opts, false, ErrNamespaceCorrupted
+	}
+	opts.IndexShards = int(shards)
+	// 注册表中记录的配置在创建时已经检查过比较器，这里只检查数据是否完整
+	if checkNamespaceOptions(opts, nil) != nil {
+		return 0, opts, false, ErrNamespaceCorrupted
+	}
+	building := len(buf) > n+1+m && buf[n+1+m]&namespaceBuilding != 0
+	return uint32(id), opts, building, nil
+}
+
+// checkNamespaceOptions 检查命名空间的配置，cmp 为命名空间使用的比较器
+func checkNamespaceOptions(opts NamespaceOptions, cmp index.Comparator) error {
+	if opts.IndexType != BTree && opts.IndexType != ShardedBTree {
+		return errors.New("namespace index type must be BTree or ShardedBTree")
+	}
+	if opts.IndexType == ShardedBTree && opts.IndexShards <= 0 {
+		return errors.New("the number of index shards must be greater than 0")
+	}
+	return checkIndexComparator(opts.IndexType, cmp)
+}
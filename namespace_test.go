@@ -0,0 +1,303 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/1 16:20
+// @Desc
+package kv_projects
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Namespace(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.不同命名空间中相同的 key 相互独立
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	sessions, err := db.NamespaceWithOptions("sessions", NamespaceOptions{IndexType: ShardedBTree, IndexShards: 4})
+	assert.Nil(t, err)
+	err = db.Put([]byte("key"), []byte("default"))
+	assert.Nil(t, err)
+	err = users.Put([]byte("key"), []byte("users"))
+	assert.Nil(t, err)
+	err = sessions.Put([]byte("key"), []byte("sessions"))
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	val, err = users.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	val, err = sessions.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("sessions"), val)
+
+	// 2.删除只影响自己的命名空间
+	err = users.Delete([]byte("key"))
+	assert.Nil(t, err)
+	_, err = users.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+
+	// 3.再次获取得到同一个命名空间
+	again, err := db.Namespace("users")
+	assert.Nil(t, err)
+	assert.Equal(t, users, again)
+	assert.Equal(t, []string{"sessions", "users"}, db.Namespaces())
+
+	// 4.非法的参数
+	_, err = db.Namespace("")
+	assert.Equal(t, ErrNamespaceNameEmpty, err)
+	_, err = db.NamespaceWithOptions("art", NamespaceOptions{IndexType: ART})
+	assert.NotNil(t, err)
+	err = users.Put(nil, []byte("value"))
+	assert.Equal(t, ErrKeyIsEmpty, err)
+
+	// 5.重启之后恢复所有命名空间的索引和配置
+	for i := 0; i < 100; i++ {
+		err := users.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sessions", "users"}, db.Namespaces())
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	_, err = users.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = users.Get(utils.GetTestKey(99))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(99), val)
+	sessions, err = db.Namespace("sessions")
+	assert.Nil(t, err)
+	assert.Equal(t, ShardedBTree, sessions.options.IndexType)
+	val, err = sessions.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("sessions"), val)
+	_, err = db.Get(utils.GetTestKey(99))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestNamespace_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-iterator")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ns, err := db.Namespace("audit")
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		err := ns.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+		err = db.Put(utils.GetTestKey(i+100), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 1.只遍历命名空间中的 key
+	iter := ns.NewIterator(DefaultIteratorOptions)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, utils.GetTestKey(count), iter.Key())
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(count), val)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 20, count)
+
+	// 2.前缀和反向遍历
+	iter = ns.NewIterator(IteratorOptions{Prefix: []byte("bitcask-go-key-00000001"), Reverse: true})
+	iter.Rewind()
+	assert.True(t, iter.Valid())
+	assert.Equal(t, utils.GetTestKey(19), iter.Key())
+	iter.Close()
+
+	// 3.合并之后迭代器中的位置失效，根据 key 重新读取
+	iter = ns.NewIterator(DefaultIteratorOptions)
+	err = db.Merge()
+	assert.Nil(t, err)
+	iter.Rewind()
+	val, err := iter.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(0), val)
+	iter.Close()
+}
+
+func TestDB_DropNamespace(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-drop")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	sessions, err := db.Namespace("sessions")
+	assert.Nil(t, err)
+	users, err := db.Namespace("users")
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := sessions.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+		err = users.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 1.删除之后之前获取的命名空间不能再读写
+	err = db.DropNamespace("sessions")
+	assert.Nil(t, err)
+	err = sessions.Put([]byte("key"), []byte("value"))
+	assert.Equal(t, ErrNamespaceDropped, err)
+	_, err = sessions.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrNamespaceDropped, err)
+	err = db.DropNamespace("sessions")
+	assert.Equal(t, ErrNamespaceNotFound, err)
+	assert.Equal(t, []string{"users"}, db.Namespaces())
+
+	// 2.同名的命名空间使用新的 id，看不到之前的数据
+	recreated, err := db.Namespace("sessions")
+	assert.Nil(t, err)
+	assert.NotEqual(t, sessions.id, recreated.id)
+	_, err = recreated.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = recreated.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+
+	// 3.重启之后仍然是删除的状态
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	recreated, err = db.Namespace("sessions")
+	assert.Nil(t, err)
+	_, err = recreated.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := recreated.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// 4.合并时清理删除的命名空间中的数据
+	size := dirSize(t, dir)
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Less(t, dirSize(t, dir), size)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sessions", "users"}, db.Namespaces())
+	users, err = db.Namespace("users")
+	assert.Nil(t, err)
+	val, err = users.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+	recreated, err = db.Namespace("sessions")
+	assert.Nil(t, err)
+	val, err = recreated.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestNamespace_ValueLog(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-vlog")
+	opts.DirPath = dir
+	opts.ValueThreshold = 16
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.命名空间中的大 value 分离到值日志中，注册表的记录不分离
+	ns, err := db.Namespace("blobs")
+	assert.Nil(t, err)
+	for i := 0; i < 200; i++ {
+		err := ns.Put(utils.GetTestKey(i%50), utils.RandomValue(512))
+		assert.Nil(t, err)
+	}
+	err = ns.Put([]byte("key"), []byte("a value larger than the threshold"))
+	assert.Nil(t, err)
+
+	// 2.垃圾回收时根据命名空间的索引判断是否有效，并重新写入有效的 value
+	err = db.ValueLogGC(0.5)
+	assert.Nil(t, err)
+	val, err := ns.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a value larger than the threshold"), val)
+	for i := 0; i < 50; i++ {
+		_, err := ns.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 3.删除命名空间之后，其中的 value 都是无效的
+	err = db.DropNamespace("blobs")
+	assert.Nil(t, err)
+	err = db.ValueLogGC(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(*db.valueLog.files.Load()))
+
+	// 4.重启
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db.Namespaces()))
+}
+
+func TestNamespace_Subscribe(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-namespace-subscribe")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 订阅和监听只包含默认命名空间的写入
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := db.Watch(ctx, nil)
+	assert.Nil(t, err)
+	ns, err := db.Namespace("users")
+	assert.Nil(t, err)
+	err = ns.Put([]byte("user"), []byte("value"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("default"), []byte("value"))
+	assert.Nil(t, err)
+
+	event := <-events
+	assert.Equal(t, []byte("default"), event.Key)
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	event, err = sub.Next(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), event.Key)
+}
+
+// dirSize 目录中所有文件的总大小
+func dirSize(t *testing.T, dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		assert.Nil(t, err)
+		size += info.Size()
+	}
+	return size
+}
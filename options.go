@@ -4,7 +4,12 @@
 // @Desc 文件执行的选项
 package kv_projects
 
-import "os"
+import (
+	"kv-projects/data"
+	"kv-projects/index"
+	"os"
+	"time"
+)
 
 // Options 文件执行的选项
 type Options struct {
@@ -14,10 +19,73 @@ type Options struct {
 	// 数据文件的大小
 	DataFileSize int64
 
-	// 每次写数据是否持久化
+	// 每次写数据是否持久化，并发的写入会合并为一次持久化
 	SyncWrites bool
 
+	// 累计写到多少字节后进行持久化，只在 SyncWrites 为 false 时生效，0 表示不开启
+	BytesPerSync uint
+
+	// 索引类型
 	IndexType IndexerType
+
+	// 分片索引的分片数量，只在索引类型为 ShardedBTree 时生效
+	IndexShards int
+
+	// key 的比较器，决定索引和迭代器中 key 的顺序，为 nil 表示按照字节序比较
+	// 比较器的名称记录在数据目录中，之后必须使用同名的比较器打开。命名空间和范围删除同样使用这个顺序
+	// 不按照字节序比较时，不能使用分片索引和布隆过滤器
+	Comparator index.Comparator
+
+	// value 的压缩算法，为 nil 表示不压缩
+	// 内置的 flate 压缩总是可以用于解压，自定义的压缩算法需要一直配置，才能读取之前写入的数据
+	Compression data.Compressor
+
+	// value 的大小达到多少字节才进行压缩，压缩之后没有变小的 value 仍然存储原始数据
+	CompressionMinSize int
+
+	// 数据文件加密使用的 AES 密钥，长度为 16、24 或 32 字节，为空表示新写入的数据不加密
+	EncryptionKey []byte
+
+	// 轮换之前使用的密钥，只用于读取旧的数据文件，合并之后所有数据文件都会使用 EncryptionKey 重新加密
+	PreviousEncryptionKeys [][]byte
+
+	// 日志记录的校验算法，只对新建的数据文件生效，已有的数据文件使用文件头中记录的算法
+	// 修改之后当前的活跃文件不再写入，合并之后所有数据文件都会使用新的算法
+	Checksum data.ChecksumType
+
+	// value 的大小（压缩之后）超过多少字节时写入到单独的值日志中，数据文件中只存储指针，0 表示不开启
+	// 合并数据文件时不需要重写分离出去的 value，值日志的垃圾回收通过 ValueLogGC 单独进行
+	ValueThreshold int
+
+	// 日志记录缓存的总字节数，缓存的是解码（解密）之后的记录，0 表示不开启
+	BlockCacheSize int64
+
+	// 布隆过滤器的目标误判率，Get 不存在的 key 时不需要查询索引和读取数据文件，0 表示不开启
+	// 布隆过滤器按照 key 的字节计算哈希，只能和字节序的比较器一起使用
+	// 布隆过滤器在启动时根据索引构建，占用的内存约为每个 key 1.2 字节（误判率 1%）
+	BloomFilterFPRate float64
+
+	// 二级索引，key 是索引的名称，value 是从 value 中提取索引 key 的函数，只对默认命名空间生效
+	// 索引和数据在同一个批次中原子地写入；打开时缺少的索引根据已有的数据重新构建，不再配置的索引被删除
+	SecondaryIndexes map[string]IndexExtractor
+
+	// 跟踪 Get、Put、Delete 中索引查找、读取记录和持久化的耗时，为 nil 表示不跟踪
+	Tracer Tracer
+
+	// 慢操作的阈值，Get、Put、Delete 的耗时达到阈值时通过 SlowOpLogger 记录，0 表示不记录
+	SlowOpThreshold time.Duration
+
+	// 记录慢操作的回调，为 nil 时通过标准库的 log 输出
+	SlowOpLogger func(op SlowOp)
+}
+
+// IteratorOptions 索引迭代器配置项
+type IteratorOptions struct {
+	// 遍历前缀为指定值的 Key，默认为空
+	// 前缀按照字节匹配，使用非字节序的比较器时前缀相同的 key 不是连续的，迭代器会扫描整个索引
+	Prefix []byte
+	// 是否反向遍历，默认 false 是正向
+	Reverse bool
 }
 
 type IndexerType = int8
@@ -28,11 +96,33 @@ const (
 
 	// ART Adaptive Radix Tree 自适应基数树索引
 	ART
+
+	// ShardedBTree 按 key 哈希分片的 BTree 索引，适用于多核下的高并发写入
+	ShardedBTree
 )
 
 var DefaultOptions = Options{
-	DirPath:      os.TempDir(),
-	DataFileSize: 256 * 1024 * 1024, // 256MB
-	SyncWrites:   false,
-	IndexType:    BTree,
+	DirPath:            os.TempDir(),
+	DataFileSize:       256 * 1024 * 1024, // 256MB
+	SyncWrites:         false,
+	BytesPerSync:       0,
+	IndexType:          BTree,
+	IndexShards:        16,
+	Comparator:         nil,
+	Compression:        nil,
+	CompressionMinSize: 256,
+	EncryptionKey:      nil,
+	Checksum:           data.ChecksumCRC32,
+	ValueThreshold:     0,
+	BlockCacheSize:     0,
+	BloomFilterFPRate:  0,
+	SecondaryIndexes:   nil,
+	Tracer:             nil,
+	SlowOpThreshold:    0,
+	SlowOpLogger:       nil,
+}
+
+var DefaultIteratorOptions = IteratorOptions{
+	Prefix:  nil,
+	Reverse: false,
 }
@@ -0,0 +1,648 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/27 21:10
+// @Desc 主从复制，从节点从主节点接收数据文件中新写入的字节，回放之后提供只读的查询
+package kv_projects
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"kv-projects/data"
+	"kv-projects/fio"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	replicationMagic         = "KVRP"                 // 从节点连接之后首先发送的魔数
+	replicationVersion       = 1                      // 复制协议的版本
+	replicationFrameSize     = 1 << 20                // 一帧中最多包含的文件字节数
+	replicationDialTimeout   = 5 * time.Second        // 连接主节点的超时时间
+	replicationRetryInterval = 100 * time.Millisecond // 连接断开之后重新连接的间隔
+)
+
+// 主节点发送的帧的类型
+const (
+	frameFileBytes byte = 1 // 文件中从某个位置开始的字节
+	frameRoundEnd  byte = 2 // 一轮发送结束，之前的字节都是完整的记录，同时带上主节点当前所有的文件
+)
+
+// 复制的文件的类型，数据文件和值日志文件的 id 相互独立
+const (
+	fileKindData     byte = 0
+	fileKindValueLog byte = 1
+)
+
+// replicaFile 复制的一个文件
+type replicaFile struct {
+	kind byte
+	fid  uint32
+}
+
+// replicationFile 主节点一轮发送时的一个文件和发送到的位置
+type replicationFile struct {
+	replicaFile
+	dataFile *data.DataFile
+	size     int64
+}
+
+// ServeReplication 在 ln 上接受从节点的连接，并向每个从节点持续发送数据文件中新写入的字节
+// 从节点连接时带上本地每个文件的长度，主节点从这些位置开始发送，之后每次有新的写入提交时发送新写入的部分。
+// 阻塞直到 ln 被关闭，返回 Accept 的错误；数据库关闭之后所有从节点的连接会被断开
+func (db *DB) ServeReplication(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			_ = db.serveFollower(conn)
+		}()
+	}
+}
+
+// serveFollower 向一个从节点发送数据，直到连接断开或者数据库关闭
+func (db *DB) serveFollower(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	positions, err := readReplicationHandshake(reader)
+	if err != nil {
+		return err
+	}
+	// 握手之后从节点不再发送数据，读取结束说明连接已经断开
+	gone := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+		close(gone)
+	}()
+
+	writer := bufio.NewWriterSize(conn, 64*1024)
+	buf := make([]byte, replicationFrameSize)
+	for {
+		// 先获取通知的 channel 再获取快照，避免错过之间的提交
+		wait := db.notifier.wait()
+		files, err := db.replicationSnapshot()
+		if err != nil {
+			return err
+		}
+		if err := shipReplicationRound(writer, files, positions, buf); err != nil {
+			if db.isFileRetired(err) {
+				// 发送期间文件被合并或者回收，重新获取快照
+				continue
+			}
+			return err
+		}
+		select {
+		case <-wait:
+		case <-gone:
+			return nil
+		case <-db.done:
+			return ErrDBClosed
+		}
+	}
+}
+
+// replicationSnapshot 获取当前所有的文件和已经写入的长度，值日志文件在数据文件之前，同类文件按照 id 从小到大排列
+// 持有 db.mu 时没有写入，数据文件中的字节都是完整的记录，并且引用的值日志记录都已经写入
+func (db *DB) replicationSnapshot() ([]replicationFile, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	var files []replicationFile
+	for _, kind := range []byte{fileKindValueLog, fileKindData} {
+		dataFiles := *db.dataFiles.Load()
+		if kind == fileKindValueLog {
+			dataFiles = *db.valueLog.files.Load()
+		}
+		start := len(files)
+		for fid, dataFile := range dataFiles {
+			size, err := dataFile.IoManager.Size()
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, replicationFile{
+				replicaFile: replicaFile{kind: kind, fid: fid},
+				dataFile:    dataFile,
+				size:        size,
+			})
+		}
+		sort.Slice(files[start:], func(i, j int) bool { return files[start+i].fid < files[start+j].fid })
+	}
+	return files, nil
+}
+
+// shipReplicationRound 发送每个文件中从节点还没有的字节，最后发送一轮结束的帧
+func shipReplicationRound(writer *bufio.Writer, files []replicationFile, positions map[replicaFile]int64, buf []byte) error {
+	for _, file := range files {
+		pos := positions[file.replicaFile]
+		if pos > file.size {
+			return ErrReplicaDiverged
+		}
+		for pos < file.size {
+			n := min(file.size-pos, int64(len(buf)))
+			if _, err := file.dataFile.IoManager.Read(buf[:n], pos); err != nil {
+				return err
+			}
+			header := []byte{frameFileBytes, file.kind}
+			header = binary.AppendUvarint(header, uint64(file.fid))
+			header = binary.AppendVarint(header, pos)
+			header = binary.AppendUvarint(header, uint64(n))
+			if _, err := writer.Write(header); err != nil {
+				return err
+			}
+			if _, err := writer.Write(buf[:n]); err != nil {
+				return err
+			}
+			pos += n
+			positions[file.replicaFile] = pos
+		}
+	}
+
+	// 主节点已经删除的文件，从节点也需要删除
+	alive := make(map[replicaFile]struct{}, len(files))
+	frame := []byte{frameRoundEnd}
+	frame = binary.AppendUvarint(frame, uint64(len(files)))
+	for _, file := range files {
+		alive[file.replicaFile] = struct{}{}
+		frame = append(frame, file.kind)
+		frame = binary.AppendUvarint(frame, uint64(file.fid))
+	}
+	for file := range positions {
+		if _, ok := alive[file]; !ok {
+			delete(positions, file)
+		}
+	}
+	if _, err := writer.Write(frame); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// readReplicationHandshake 读取从节点的握手，得到从节点本地每个文件的长度
+func readReplicationHandshake(reader *bufio.Reader) (map[replicaFile]int64, error) {
+	magic := make([]byte, len(replicationMagic)+1)
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:len(replicationMagic)]) != replicationMagic || magic[len(replicationMagic)] != replicationVersion {
+		return nil, ErrInvalidReplication
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	positions := make(map[replicaFile]int64)
+	for i := uint64(0); i < count; i++ {
+		file, err := readReplicaFile(reader)
+		if err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		positions[file] = size
+	}
+	return positions, nil
+}
+
+// readReplicaFiles 读取文件的数量和每个文件的类型与 id
+func readReplicaFiles(reader *bufio.Reader) ([]replicaFile, error) {
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	var files []replicaFile
+	for i := uint64(0); i < count; i++ {
+		file, err := readReplicaFile(reader)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// readReplicaFile 读取文件的类型和 id
+func readReplicaFile(reader *bufio.Reader) (replicaFile, error) {
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return replicaFile{}, err
+	}
+	if kind != fileKindData && kind != fileKindValueLog {
+		return replicaFile{}, ErrInvalidReplication
+	}
+	fid, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return replicaFile{}, err
+	}
+	return replicaFile{kind: kind, fid: uint32(fid)}, nil
+}
+
+// Replica 只读的从节点，数据文件和值日志文件是主节点的逐字节副本
+// 从节点按照和启动时加载索引相同的方式回放收到的记录，因此序列号和主节点一致，可以通过 Seq 判断复制的进度。
+// 连接断开之后会自动重新连接，并从本地文件的末尾继续复制
+type Replica struct {
+	db      *DB
+	addr    string
+	indexed map[uint32]int64            // 每个数据文件已经回放到索引的位置，只在复制协程中访问
+	dirty   map[*data.DataFile]struct{} // 这一轮写入过的文件，一轮结束时持久化
+	mu      sync.Mutex                  // 保护 conn 和 err
+	conn    net.Conn
+	err     error
+	closed  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// OpenReplica 打开 options.DirPath 中的从节点，并开始从 leaderAddr 的主节点复制
+// options 中的加密密钥需要和主节点一致，否则无法读取主节点发送的加密文件
+func OpenReplica(options Options, leaderAddr string) (*Replica, error) {
+	db, err := open(options, true)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replica{
+		db:      db,
+		addr:    leaderAddr,
+		indexed: make(map[uint32]int64),
+		dirty:   make(map[*data.DataFile]struct{}),
+		closed:  make(chan struct{}),
+	}
+	// 打开时回放到了每个数据文件中最后一条完整的记录，崩溃时写了一半的记录在收到剩下的字节之后再回放，
+	// 之后收到的字节追加到文件的末尾
+	for fid, dataFile := range *db.dataFiles.Load() {
+		r.indexed[fid] = dataFile.WriteOff
+	}
+	for _, files := range []map[uint32]*data.DataFile{*db.dataFiles.Load(), *db.valueLog.files.Load()} {
+		for _, dataFile := range files {
+			if dataFile.WriteOff, err = dataFile.IoManager.Size(); err != nil {
+				_ = db.Close()
+				return nil, err
+			}
+		}
+	}
+
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// Get 根据 key 读取数据
+func (r *Replica) Get(key []byte) ([]byte, error) {
+	return r.db.Get(key)
+}
+
+// Seq 已经回放的位置，和主节点上相同位置的序列号一致
+func (r *Replica) Seq() uint64 {
+	return r.db.committed.Load()
+}
+
+// WaitForSeq 等待回放到序列号 seq，直到 ctx 结束或者从节点关闭
+func (r *Replica) WaitForSeq(ctx context.Context, seq uint64) error {
+	for {
+		wait := r.db.notifier.wait()
+		if r.Seq() >= seq {
+			return nil
+		}
+		if r.db.closed.Load() {
+			return ErrDBClosed
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Err 最近一次复制中断的原因，复制正常进行时为 nil
+func (r *Replica) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close 断开和主节点的连接并关闭从节点
+func (r *Replica) Close() error {
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+		r.mu.Unlock()
+		return nil
+	default:
+	}
+	close(r.closed)
+	if r.conn != nil {
+		_ = r.conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return r.db.Close()
+}
+
+// run 复制协程，连接断开之后等待一段时间重新连接
+func (r *Replica) run() {
+	defer r.wg.Done()
+	for {
+		err := r.replicate()
+		r.mu.Lock()
+		r.err, r.conn = err, nil
+		r.mu.Unlock()
+		select {
+		case <-r.closed:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// replicate 连接主节点，发送握手之后持续接收并回放，直到连接断开
+func (r *Replica) replicate() error {
+	conn, err := net.DialTimeout("tcp", r.addr, replicationDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+		r.mu.Unlock()
+		return ErrDBClosed
+	default:
+	}
+	r.conn = conn
+	r.mu.Unlock()
+
+	if _, err := conn.Write(r.handshake()); err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		frameType, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch frameType {
+		case frameFileBytes:
+			err = r.readFileBytes(reader)
+		case frameRoundEnd:
+			var files []replicaFile
+			if files, err = readReplicaFiles(reader); err == nil {
+				err = r.applyRound(files)
+			}
+		default:
+			err = ErrInvalidReplication
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handshake 编码握手，包括本地每个文件的长度
+func (r *Replica) handshake() []byte {
+	r.db.mu.RLock()
+	defer r.db.mu.RUnlock()
+	buf := append([]byte(replicationMagic), replicationVersion)
+	dataFiles, valueLogFiles := *r.db.dataFiles.Load(), *r.db.valueLog.files.Load()
+	buf = binary.AppendUvarint(buf, uint64(len(dataFiles)+len(valueLogFiles)))
+	for kind, files := range map[byte]map[uint32]*data.DataFile{fileKindData: dataFiles, fileKindValueLog: valueLogFiles} {
+		for fid, dataFile := range files {
+			buf = append(buf, kind)
+			buf = binary.AppendUvarint(buf, uint64(fid))
+			buf = binary.AppendVarint(buf, dataFile.WriteOff)
+		}
+	}
+	return buf
+}
+
+// readFileBytes 读取一帧文件中的字节并追加到本地的文件中
+func (r *Replica) readFileBytes(reader *bufio.Reader) error {
+	file, err := readReplicaFile(reader)
+	if err != nil {
+		return err
+	}
+	offset, err := binary.ReadVarint(reader)
+	if err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return err
+	}
+	if n > replicationFrameSize {
+		return ErrInvalidReplication
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return err
+	}
+	return r.appendFileBytes(file, offset, buf)
+}
+
+// appendFileBytes 将主节点文件中 offset 开始的字节追加到本地的文件中，本地没有的文件会被新建
+func (r *Replica) appendFileBytes(file replicaFile, offset int64, buf []byte) error {
+	db := r.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dataFile := r.localFiles(file.kind)[file.fid]
+	if dataFile == nil {
+		if offset != 0 {
+			return ErrReplicaDiverged
+		}
+		created, err := r.createFile(file, buf)
+		if err != nil {
+			return err
+		}
+		r.dirty[created] = struct{}{}
+		return nil
+	}
+	if offset != dataFile.WriteOff {
+		return ErrReplicaDiverged
+	}
+	if err := dataFile.Write(buf); err != nil {
+		return err
+	}
+	r.dirty[dataFile] = struct{}{}
+	return nil
+}
+
+// createFile 新建本地的文件，buf 从主节点文件的开头开始，包含完整的文件头，调用方需要持有 db.mu
+func (r *Replica) createFile(file replicaFile, buf []byte) (*data.DataFile, error) {
+	db := r.db
+	fileName := data.GetDataFileName(db.options.DirPath, file.fid)
+	if file.kind == fileKindValueLog {
+		fileName = data.GetValueLogFileName(db.options.DirPath, file.fid)
+	}
+	// 原样写入主节点的文件头，再按照已有的文件打开
+	ioManager, err := fio.NewIOManager(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ioManager.Write(buf); err != nil {
+		_ = ioManager.Close()
+		return nil, err
+	}
+	if err := ioManager.Close(); err != nil {
+		return nil, err
+	}
+
+	var dataFile *data.DataFile
+	if file.kind == fileKindValueLog {
+		dataFile, err = data.OpenValueLogFile(db.options.DirPath, file.fid, db.fileOptions)
+	} else {
+		dataFile, err = data.OpenDataFileWithOptions(db.options.DirPath, file.fid, db.fileOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dataFile.WriteOff = int64(len(buf))
+
+	active, olderFiles := &db.activeFile, db.olderFiles
+	if file.kind == fileKindValueLog {
+		active, olderFiles = &db.valueLog.activeFile, db.valueLog.olderFiles
+	}
+	// id 最大的文件是活跃文件
+	if *active == nil || file.fid > (*active).FileId {
+		if *active != nil {
+			olderFiles[(*active).FileId] = *active
+		}
+		*active = dataFile
+	} else {
+		olderFiles[file.fid] = dataFile
+	}
+	db.refreshDataFiles()
+	db.valueLog.refresh()
+	return dataFile, nil
+}
+
+// localFiles 本地所有指定类型的文件
+func (r *Replica) localFiles(kind byte) map[uint32]*data.DataFile {
+	if kind == fileKindValueLog {
+		return *r.db.valueLog.files.Load()
+	}
+	return *r.db.dataFiles.Load()
+}
+
+// applyRound 一轮接收结束，持久化写入的文件，回放新的记录，删除主节点已经删除的文件，然后发布回放的位置
+func (r *Replica) applyRound(files []replicaFile) error {
+	db := r.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for dataFile := range r.dirty {
+		if err := dataFile.Sync(); err != nil {
+			return err
+		}
+		delete(r.dirty, dataFile)
+	}
+
+	// 按照 id 从小到大回放，和启动时加载索引的顺序一致
+	dataFiles := *db.dataFiles.Load()
+	fids := make([]uint32, 0, len(dataFiles))
+	for fid := range dataFiles {
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	for _, fid := range fids {
+		dataFile := dataFiles[fid]
+		offset, ok := r.indexed[fid]
+		if !ok {
+			offset = dataFile.HeaderSize()
+		}
+		if offset >= dataFile.WriteOff {
+			continue
+		}
+		end, err := db.indexLogRecords(dataFile, offset)
+		if err != nil {
+			return err
+		}
+		r.indexed[fid] = end
+	}
+
+	if err := r.removeRetiredFiles(files); err != nil {
+		return err
+	}
+	db.publishCommitted()
+	return nil
+}
+
+// removeRetiredFiles 删除主节点已经合并或者回收的文件，调用方需要持有 db.mu
+// 主节点在删除文件之前已经写入了重写的记录，这一轮已经回放了这些记录，索引不会再指向被删除的文件
+func (r *Replica) removeRetiredFiles(files []replicaFile) error {
+	db := r.db
+	alive := make(map[replicaFile]struct{}, len(files))
+	for _, file := range files {
+		alive[file] = struct{}{}
+	}
+	retired := map[byte]map[uint32]struct{}{fileKindData: {}, fileKindValueLog: {}}
+	var retiredFiles []*data.DataFile
+	var fileNames []string
+	for kind, fids := range retired {
+		active, olderFiles := &db.activeFile, db.olderFiles
+		fileName := data.GetDataFileName
+		if kind == fileKindValueLog {
+			active, olderFiles = &db.valueLog.activeFile, db.valueLog.olderFiles
+			fileName = data.GetValueLogFileName
+		}
+		if *active != nil {
+			olderFiles[(*active).FileId] = *active
+			*active = nil
+		}
+		for fid, dataFile := range olderFiles {
+			if _, ok := alive[replicaFile{kind: kind, fid: fid}]; !ok {
+				delete(olderFiles, fid)
+				fids[fid] = struct{}{}
+				retiredFiles = append(retiredFiles, dataFile)
+				fileNames = append(fileNames, fileName(db.options.DirPath, fid))
+			}
+		}
+		// 剩下的文件中 id 最大的是活跃文件
+		for fid, dataFile := range olderFiles {
+			if *active == nil || fid > (*active).FileId {
+				*active = dataFile
+			}
+		}
+		if *active != nil {
+			delete(olderFiles, (*active).FileId)
+		}
+	}
+	db.refreshDataFiles()
+	db.valueLog.refresh()
+	if len(retiredFiles) == 0 {
+		return nil
+	}
+
+	db.cache.purge(false, retired[fileKindData])
+	db.cache.purge(true, retired[fileKindValueLog])
+	if len(retired[fileKindData]) > 0 {
+		for fid := range retired[fileKindData] {
+			delete(r.indexed, fid)
+		}
+		// 和合并之后一样，重新构建布隆过滤器，并记录之前的记录都已经被合并
+		db.rebuildBloomFilter()
+		minFid := ^uint32(0)
+		for fid := range *db.dataFiles.Load() {
+			minFid = min(minFid, fid)
+		}
+		db.mergedSeq.Store(makeSeq(minFid, 0))
+	}
+	for i, dataFile := range retiredFiles {
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(fileNames[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
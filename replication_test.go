@@ -0,0 +1,227 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/27 21:10
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// startLeader 在本地回环地址上启动主节点的复制服务
+func startLeader(t *testing.T, db *DB) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		_ = db.ServeReplication(ln)
+	}()
+	return ln
+}
+
+// waitReplica 等待从节点复制到主节点当前已经提交的位置
+func waitReplica(t *testing.T, r *Replica, leader *DB) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, r.WaitForSeq(ctx, leader.committed.Load()))
+}
+
+// listDataFiles 列出目录中所有的数据文件和值日志文件
+func listDataFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestReplica(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-leader")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	leader, err := Open(opts)
+	defer destroyDB(leader)
+	assert.Nil(t, err)
+	ln := startLeader(t, leader)
+	defer ln.Close()
+
+	// 1.从节点连接之后复制已有的数据
+	for i := 0; i < 300; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err := leader.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	replicaOpts := opts
+	replicaOpts.DirPath, _ = os.MkdirTemp("", "bitcask-go-replica")
+	defer os.RemoveAll(replicaOpts.DirPath)
+	replica, err := OpenReplica(replicaOpts, ln.Addr().String())
+	assert.Nil(t, err)
+	waitReplica(t, replica, leader)
+	for i := 0; i < 300; i++ {
+		val, err := replica.Get(utils.GetTestKey(i))
+		if i < 50 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+	}
+	assert.Equal(t, listDataFiles(t, dir), listDataFiles(t, replicaOpts.DirPath))
+
+	// 2.从节点是只读的
+	err = replica.db.Put([]byte("key"), []byte("value"))
+	assert.Equal(t, ErrReadOnly, err)
+	err = replica.db.Merge()
+	assert.Equal(t, ErrReadOnly, err)
+
+	// 3.持续复制新的写入，包括数据文件的切换
+	for i := 300; i < 600; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	waitReplica(t, replica, leader)
+	assert.Equal(t, leader.committed.Load(), replica.Seq())
+	for i := 300; i < 600; i++ {
+		val, err := replica.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 4.重新打开的从节点从本地文件的末尾继续复制
+	err = replica.Close()
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := leader.Put(utils.GetTestKey(i), []byte("updated"))
+		assert.Nil(t, err)
+	}
+	replica, err = OpenReplica(replicaOpts, ln.Addr().String())
+	assert.Nil(t, err)
+	defer replica.Close()
+	waitReplica(t, replica, leader)
+	for i := 0; i < 600; i++ {
+		val, err := replica.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 100 {
+			assert.Equal(t, []byte("updated"), val)
+		} else {
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+	}
+	assert.Equal(t, listDataFiles(t, dir), listDataFiles(t, replicaOpts.DirPath))
+	assert.Nil(t, replica.Err())
+}
+
+func TestReplica_PartialRecord(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-leader-partial")
+	opts.DirPath = dir
+	leader, err := Open(opts)
+	defer destroyDB(leader)
+	assert.Nil(t, err)
+	ln := startLeader(t, leader)
+	defer ln.Close()
+
+	// 1.从节点复制所有的数据
+	for i := 0; i < 100; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	replicaOpts := opts
+	replicaOpts.DirPath, _ = os.MkdirTemp("", "bitcask-go-replica-partial")
+	defer os.RemoveAll(replicaOpts.DirPath)
+	replica, err := OpenReplica(replicaOpts, ln.Addr().String())
+	assert.Nil(t, err)
+	waitReplica(t, replica, leader)
+	fileName := data.GetDataFileName(replicaOpts.DirPath, replica.db.activeFile.FileId)
+	assert.Nil(t, replica.Close())
+
+	// 2.模拟从节点追加最后一条记录时崩溃，文件末尾是写了一半的记录
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(fileName, info.Size()-3))
+
+	// 3.重新打开之后，收到剩下的字节时回放这条记录
+	replica, err = OpenReplica(replicaOpts, ln.Addr().String())
+	assert.Nil(t, err)
+	defer replica.Close()
+	waitReplica(t, replica, leader)
+	for i := 0; i < 100; i++ {
+		val, err := replica.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	assert.Nil(t, replica.Err())
+}
+
+func TestReplica_MergeAndValueLogGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-leader-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.ValueThreshold = 64
+	leader, err := Open(opts)
+	defer destroyDB(leader)
+	assert.Nil(t, err)
+	ln := startLeader(t, leader)
+	defer ln.Close()
+
+	replicaOpts := opts
+	replicaOpts.DirPath, _ = os.MkdirTemp("", "bitcask-go-replica-merge")
+	defer os.RemoveAll(replicaOpts.DirPath)
+	replica, err := OpenReplica(replicaOpts, ln.Addr().String())
+	assert.Nil(t, err)
+	defer replica.Close()
+
+	// 1.分离到值日志中的 value 和分块写入的 value 都会被复制
+	for i := 0; i < 200; i++ {
+		err := leader.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(128)
+		err := leader.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	large := utils.RandomValue(20 * 1024)
+	err = leader.PutReader([]byte("large"), bytes.NewReader(large), int64(len(large)))
+	assert.Nil(t, err)
+	waitReplica(t, replica, leader)
+	val, err := replica.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, val)
+
+	// 2.主节点合并和回收之后，从节点删除同样的文件，数据仍然正确
+	err = leader.Merge()
+	assert.Nil(t, err)
+	err = leader.ValueLogGC(0.5)
+	assert.Nil(t, err)
+	waitReplica(t, replica, leader)
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(listDataFiles(t, dir), listDataFiles(t, replicaOpts.DirPath))
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 200; i++ {
+		val, err := replica.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	val, err = replica.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, val)
+	assert.Nil(t, replica.Err())
+}
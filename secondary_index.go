@@ -0,0 +1,276 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/4 20:40
+// @Desc 二级索引，根据 value 中提取的索引 key 查找数据，索引记录和数据在同一个批次中原子地写入
+package kv_projects
+
+import (
+	"bytes"
+	"kv-projects/data"
+	"strings"
+)
+
+// IndexExtractor 从 value 中提取索引 key，同一个 value 可以有多个索引 key，也可以没有
+// 提取函数需要是确定的，相同的 value 总是返回相同的索引 key，否则之后无法删除对应的索引记录
+type IndexExtractor func(value []byte) [][]byte
+
+// indexNamespacePrefix 二级索引所在的内部命名空间的名称前缀
+const indexNamespacePrefix = internalNamespacePrefix + "index/"
+
+// secondaryIndex 二级索引，索引记录存储在内部的命名空间中，value 为空
+type secondaryIndex struct {
+	name    string
+	extract IndexExtractor
+	ns      *Namespace
+}
+
+// loadSecondaryIndexes 打开时加载配置的二级索引，只读的从节点不维护二级索引
+// 不再配置的索引之后的写入不会更新，已经和数据不一致，直接删除，再次配置时会重新构建
+func (db *DB) loadSecondaryIndexes() error {
+	db.secondaryIndexes = make(map[string]*secondaryIndex, len(db.options.SecondaryIndexes))
+	if db.readOnly {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for name, ns := range db.namespaces {
+		if !strings.HasPrefix(name, indexNamespacePrefix) {
+			continue
+		}
+		if _, ok := db.options.SecondaryIndexes[strings.TrimPrefix(name, indexNamespacePrefix)]; !ok {
+			if err := db.dropNamespace(ns); err != nil {
+				return err
+			}
+		}
+	}
+	for name, extract := range db.options.SecondaryIndexes {
+		ns := db.namespaces[indexNamespacePrefix+name]
+		// 上次构建中途崩溃，丢弃不完整的索引之后重新构建
+		if ns != nil && ns.building {
+			if err := db.dropNamespace(ns); err != nil {
+				return err
+			}
+			ns = nil
+		}
+		if ns == nil {
+			var err error
+			if ns, err = db.buildSecondaryIndex(name, extract); err != nil {
+				return err
+			}
+		}
+		db.secondaryIndexes[name] = &secondaryIndex{name: name, extract: extract, ns: ns}
+	}
+	return nil
+}
+
+// buildIndexBatchSize 构建二级索引时一个批次中最多写入的索引记录数量
+const buildIndexBatchSize = 1024
+
+// buildSecondaryIndex 根据默认命名空间中所有的数据构建二级索引，调用方需要持有 db.mu
+// 先在注册表中写入构建中的索引，再分批写入索引记录，最后再次写入注册表标记构建完成，
+// 中途崩溃时下次打开会丢弃构建中的索引并重新构建
+func (db *DB) buildSecondaryIndex(name string, extract IndexExtractor) (*Namespace, error) {
+	if db.maxNamespaceId+1 == systemNamespace {
+		return nil, ErrTooManyNamespaces
+	}
+	nsName := indexNamespacePrefix + name
+	id := db.maxNamespaceId + 1
+	meta := encodeNamespaceMeta(id, DefaultNamespaceOptions)
+	registryRecord := func(meta []byte) []*data.LogRecord {
+		return []*data.LogRecord{{Key: []byte(nsName), Value: meta, Type: data.LogRecordNormal, Namespace: systemNamespace}}
+	}
+	if err := db.writeIndexRecords(registryRecord(append(meta, namespaceBuilding))); err != nil {
+		return nil, err
+	}
+
+	var logRecords []*data.LogRecord
+	iter := db.index.Iterator(false)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		value, err := db.getValueByPosition(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		for indexKey := range indexKeysOf(extract, value, true) {
+			logRecords = append(logRecords, &data.LogRecord{
+				Key:       encodeIndexEntry([]byte(indexKey), iter.Key()),
+				Type:      data.LogRecordNormal,
+				Namespace: id,
+			})
+		}
+		if len(logRecords) >= buildIndexBatchSize {
+			if err := db.writeIndexRecords(logRecords); err != nil {
+				return nil, err
+			}
+			logRecords = nil
+		}
+	}
+	if len(logRecords) > 0 {
+		if err := db.writeIndexRecords(logRecords); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.writeIndexRecords(registryRecord(meta)); err != nil {
+		return nil, err
+	}
+	return db.namespaces[nsName], nil
+}
+
+// writeIndexRecords 写入一批记录，并和加载索引时一样更新内存索引，调用方需要持有 db.mu
+func (db *DB) writeIndexRecords(logRecords []*data.LogRecord) error {
+	positions, err := db.appendLogRecords(logRecords)
+	if err != nil {
+		return err
+	}
+	for i, logRecord := range logRecords {
+		if err := db.indexLogRecord(logRecord, positions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryIndex 查询二级索引 name 中索引 key 在 [from, to) 范围内的数据的 key
+// from 为 nil 表示从最小的索引 key 开始，to 为 nil 表示直到最大的索引 key。
+// 结果先按照索引 key、再按照数据的 key 排序，一条数据有多个索引 key 在范围内时会出现多次
+func (db *DB) QueryIndex(name string, from, to []byte) ([][]byte, error) {
+	si := db.secondaryIndexes[name]
+	if si == nil {
+		return nil, ErrIndexNotFound
+	}
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+
+	var keys [][]byte
+	iter := si.ns.index.Iterator(false)
+	defer iter.Close()
+	for iter.Seek(escapeIndexKey(from)); iter.Valid(); iter.Next() {
+		indexKey, key, ok := decodeIndexEntry(iter.Key())
+		if !ok {
+			return nil, ErrNamespaceCorrupted
+		}
+		if to != nil && bytes.Compare(indexKey, to) >= 0 {
+			break
+		}
+		keys = append(keys, bytes.Clone(key))
+	}
+	return keys, nil
+}
+
+// secondaryIndexRecords 计算 key 的 value 改变之后需要写入的索引记录，exists 为 false 表示 key 不存在
+// 只写入增加和删除的索引 key，前后都存在的索引 key 不需要重新写入
+func (db *DB) secondaryIndexRecords(key, oldValue []byte, oldExists bool, newValue []byte, newExists bool) []*data.LogRecord {
+	var logRecords []*data.LogRecord
+	for _, si := range db.secondaryIndexes {
+		oldKeys := indexKeysOf(si.extract, oldValue, oldExists)
+		newKeys := indexKeysOf(si.extract, newValue, newExists)
+		for indexKey := range oldKeys {
+			if _, ok := newKeys[indexKey]; !ok {
+				logRecords = append(logRecords, &data.LogRecord{
+					Key:       encodeIndexEntry([]byte(indexKey), key),
+					Type:      data.LogRecordDeleted,
+					Namespace: si.ns.id,
+				})
+			}
+		}
+		for indexKey := range newKeys {
+			if _, ok := oldKeys[indexKey]; !ok {
+				logRecords = append(logRecords, &data.LogRecord{
+					Key:       encodeIndexEntry([]byte(indexKey), key),
+					Type:      data.LogRecordNormal,
+					Namespace: si.ns.id,
+				})
+			}
+		}
+	}
+	return logRecords
+}
+
+// secondaryIndexRecordsOf 读取 key 当前的值，计算写入 newValue 之后需要写入的索引记录，调用方需要持有 key 对应的分段锁
+func (db *DB) secondaryIndexRecordsOf(key, newValue []byte, newExists bool) ([]*data.LogRecord, error) {
+	if len(db.secondaryIndexes) == 0 {
+		return nil, nil
+	}
+	oldValue, err := db.Get(key)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	return db.secondaryIndexRecords(key, oldValue, err == nil, newValue, newExists), nil
+}
+
+// applySecondaryIndexRecords 索引记录写入之后更新二级索引的内存索引
+func (db *DB) applySecondaryIndexRecords(logRecords []*data.LogRecord, positions []*data.LogRecordPos) error {
+	for i, logRecord := range logRecords {
+		for _, si := range db.secondaryIndexes {
+			if si.ns.id != logRecord.Namespace {
+				continue
+			}
+			var ok bool
+			if logRecord.Type == data.LogRecordDeleted {
+				ok = si.ns.index.Delete(logRecord.Key)
+			} else {
+				ok = si.ns.index.Put(logRecord.Key, positions[i])
+			}
+			if !ok {
+				return ErrIndexUpdateFailed
+			}
+		}
+	}
+	return nil
+}
+
+// indexKeysOf 从 value 中提取去重之后的索引 key，exists 为 false 表示没有 value
+func indexKeysOf(extract IndexExtractor, value []byte, exists bool) map[string]struct{} {
+	if !exists {
+		return nil
+	}
+	indexKeys := make(map[string]struct{})
+	for _, indexKey := range extract(value) {
+		indexKeys[string(indexKey)] = struct{}{}
+	}
+	return indexKeys
+}
+
+// encodeIndexEntry 编码二级索引中的记录的 key：转义之后的索引 key、分隔符 0x00 0x01、数据的 key
+// 索引 key 中的 0x00 转义为 0x00 0xFF，编码之后按照字节序比较时先比较索引 key，再比较数据的 key
+func encodeIndexEntry(indexKey, key []byte) []byte {
+	entry := escapeIndexKey(indexKey)
+	entry = append(entry, 0x00, 0x01)
+	return append(entry, key...)
+}
+
+// escapeIndexKey 转义索引 key 中的 0x00，小于索引 key 的所有记录都小于转义的结果
+func escapeIndexKey(indexKey []byte) []byte {
+	escaped := make([]byte, 0, len(indexKey)+len(indexKey)/8+2)
+	for _, b := range indexKey {
+		escaped = append(escaped, b)
+		if b == 0x00 {
+			escaped = append(escaped, 0xFF)
+		}
+	}
+	return escaped
+}
+
+// decodeIndexEntry 解码二级索引中的记录的 key，得到索引 key 和数据的 key
+func decodeIndexEntry(entry []byte) ([]byte, []byte, bool) {
+	indexKey := make([]byte, 0, len(entry))
+	for i := 0; i < len(entry)-1; i++ {
+		if entry[i] != 0x00 {
+			indexKey = append(indexKey, entry[i])
+			continue
+		}
+		switch entry[i+1] {
+		case 0xFF:
+			indexKey = append(indexKey, 0x00)
+			i++
+		case 0x01:
+			return indexKey, entry[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,211 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/4 20:40
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"os"
+	"strings"
+	"testing"
+)
+
+// cityIndex 测试使用的索引，value 的格式为 name|city1,city2
+func cityIndex(value []byte) [][]byte {
+	_, cities, ok := bytes.Cut(value, []byte("|"))
+	if !ok || len(cities) == 0 {
+		return nil
+	}
+	return bytes.Split(cities, []byte(","))
+}
+
+// queryKeys 查询二级索引，返回字符串形式的 key
+func queryKeys(t *testing.T, db *DB, from, to string) []string {
+	var fromKey, toKey []byte
+	if from != "" {
+		fromKey = []byte(from)
+	}
+	if to != "" {
+		toKey = []byte(to)
+	}
+	keys, err := db.QueryIndex("city", fromKey, toKey)
+	assert.Nil(t, err)
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, string(key))
+	}
+	return result
+}
+
+func TestDB_QueryIndex(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index")
+	opts.DirPath = dir
+	opts.SecondaryIndexes = map[string]IndexExtractor{"city": cityIndex}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入时更新二级索引
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("alice|beijing")))
+	assert.Nil(t, db.Put([]byte("user-2"), []byte("bob|shanghai,beijing")))
+	assert.Nil(t, db.Put([]byte("user-3"), []byte("carol|shenzhen")))
+	assert.Nil(t, db.Put([]byte("user-4"), []byte("dave")))
+	assert.Equal(t, []string{"user-1", "user-2", "user-2", "user-3"}, queryKeys(t, db, "", ""))
+	assert.Equal(t, []string{"user-1", "user-2"}, queryKeys(t, db, "beijing", "beijingz"))
+	assert.Equal(t, []string{"user-2", "user-3"}, queryKeys(t, db, "c", ""))
+	assert.Equal(t, []string{"user-1", "user-2"}, queryKeys(t, db, "", "shanghai"))
+
+	// 2.覆盖和删除时移除旧的索引
+	assert.Nil(t, db.Put([]byte("user-2"), []byte("bob|hangzhou")))
+	assert.Equal(t, []string{"user-1"}, queryKeys(t, db, "beijing", "beijingz"))
+	assert.Equal(t, []string{"user-2"}, queryKeys(t, db, "hangzhou", "hangzhouz"))
+	assert.Nil(t, db.Delete([]byte("user-1")))
+	assert.Equal(t, []string{}, queryKeys(t, db, "beijing", "beijingz"))
+
+	// 3.条件写入和 Update 同样维护二级索引
+	swapped, err := db.CompareAndSwap([]byte("user-3"), []byte("carol|shenzhen"), []byte("carol|beijing"))
+	assert.Nil(t, err)
+	assert.True(t, swapped)
+	err = db.Update([][]byte{[]byte("user-4")}, func(lk *LockedKeys) error {
+		return lk.Put([]byte("user-4"), []byte("dave|beijing"))
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user-3", "user-4"}, queryKeys(t, db, "beijing", "beijingz"))
+	assert.Equal(t, []string{"user-3", "user-4", "user-2"}, queryKeys(t, db, "", ""))
+
+	// 4.索引不存在，流式写入不能被索引，内部的命名空间不可见
+	_, err = db.QueryIndex("age", nil, nil)
+	assert.Equal(t, ErrIndexNotFound, err)
+	err = db.PutReader([]byte("user-5"), strings.NewReader("eve"), 3)
+	assert.Equal(t, ErrStreamIndexed, err)
+	assert.Equal(t, 0, len(db.Namespaces()))
+	_, err = db.Namespace(indexNamespacePrefix + "city")
+	assert.Equal(t, ErrNamespaceNameReserved, err)
+
+	// 5.重启和合并之后索引不变
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user-3", "user-4", "user-2"}, queryKeys(t, db, "", ""))
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user-3", "user-4"}, queryKeys(t, db, "beijing", "beijingz"))
+}
+
+func TestDB_QueryIndex_Rebuild(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-rebuild")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.没有配置索引时写入的数据
+	assert.Nil(t, db.Put([]byte("user-1"), []byte("alice|beijing")))
+	assert.Nil(t, db.Put([]byte("user-2"), []byte("bob|shanghai")))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 2.打开时根据已有的数据构建索引
+	opts.SecondaryIndexes = map[string]IndexExtractor{"city": cityIndex}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user-1", "user-2"}, queryKeys(t, db, "", ""))
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 3.不再配置索引时删除，期间的写入不会更新索引，再次配置时重新构建
+	opts.SecondaryIndexes = nil
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("user-3"), []byte("carol|shenzhen")))
+	assert.Nil(t, db.Delete([]byte("user-1")))
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.SecondaryIndexes = map[string]IndexExtractor{"city": cityIndex}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user-2", "user-3"}, queryKeys(t, db, "", ""))
+}
+
+func TestDB_QueryIndex_InterruptedBuild(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-secondary-index-interrupted")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入的数据超过一个批次
+	n := buildIndexBatchSize*2 + 10
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("user-%05d", i)), []byte("name|beijing")))
+	}
+
+	// 2.模拟构建中途崩溃：只写入了构建中的注册表记录和部分索引记录
+	db.mu.Lock()
+	nsName := indexNamespacePrefix + "city"
+	id := db.maxNamespaceId + 1
+	err = db.writeIndexRecords([]*data.LogRecord{
+		{
+			Key:       []byte(nsName),
+			Value:     append(encodeNamespaceMeta(id, DefaultNamespaceOptions), namespaceBuilding),
+			Type:      data.LogRecordNormal,
+			Namespace: systemNamespace,
+		},
+		{
+			Key:       encodeIndexEntry([]byte("beijing"), []byte("user-00000")),
+			Type:      data.LogRecordNormal,
+			Namespace: id,
+		},
+	})
+	db.mu.Unlock()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 3.打开时丢弃不完整的索引并重新构建
+	opts.SecondaryIndexes = map[string]IndexExtractor{"city": cityIndex}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(queryKeys(t, db, "", "")))
+	assert.False(t, db.namespaces[nsName].building)
+
+	// 4.构建完成之后重启不会再次构建
+	id = db.namespaces[nsName].id
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, id, db.namespaces[nsName].id)
+	assert.Equal(t, n, len(queryKeys(t, db, "", "")))
+}
+
+func TestEncodeIndexEntry(t *testing.T) {
+	// 索引 key 中包含 0x00 时仍然按照索引 key 排序
+	entries := [][]byte{
+		encodeIndexEntry([]byte("a"), []byte("z")),
+		encodeIndexEntry([]byte("a\x00"), []byte("a")),
+		encodeIndexEntry([]byte("a\x00b"), []byte("a")),
+		encodeIndexEntry([]byte("ab"), []byte("a")),
+	}
+	for i := 1; i < len(entries); i++ {
+		assert.Equal(t, -1, bytes.Compare(entries[i-1], entries[i]))
+	}
+	indexKey, key, ok := decodeIndexEntry(entries[2])
+	assert.True(t, ok)
+	assert.Equal(t, []byte("a\x00b"), indexKey)
+	assert.Equal(t, []byte("a"), key)
+	_, _, ok = decodeIndexEntry([]byte("a\x00"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,14 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc 分片相关的错误枚举
+package shard
+
+import "errors"
+
+var (
+	ErrInvalidShards       = errors.New("the number of shards must be greater than 0")
+	ErrInvalidVirtualNodes = errors.New("the number of virtual nodes must be greater than 0")
+	ErrManifestCorrupted   = errors.New("the shard manifest maybe corrupted")
+	ErrClosed              = errors.New("the sharded database is closed")
+)
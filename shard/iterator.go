@@ -0,0 +1,130 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc 跨分片的迭代器，多路归并各个分片的有序迭代器
+package shard
+
+import (
+	"container/heap"
+	bitcask "kv-projects"
+	"kv-projects/index"
+)
+
+// Iterator 跨分片的迭代器
+// 每个分片的迭代器是创建时刻索引的快照，同一个 key 只会在一个分片中，归并之后得到全局有序的结果
+type Iterator struct {
+	iters []*bitcask.Iterator
+	h     *iteratorHeap
+}
+
+// NewIterator 新建跨分片的迭代器
+func (db *DB) NewIterator(opts bitcask.IteratorOptions) (*Iterator, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	// 和分片中的索引使用相同的比较器归并
+	cmp := db.options.DBOptions.Comparator
+	if cmp == nil {
+		cmp = index.BytewiseComparator
+	}
+	it := &Iterator{h: &iteratorHeap{reverse: opts.Reverse, cmp: cmp}}
+	for _, name := range db.manifest.shards {
+		it.iters = append(it.iters, db.shards[name].NewIterator(opts))
+	}
+	it.rebuild()
+	return it, nil
+}
+
+// rebuild 用所有有效的迭代器重建堆
+func (it *Iterator) rebuild() {
+	it.h.iters = it.h.iters[:0]
+	for _, iter := range it.iters {
+		if iter.Valid() {
+			it.h.iters = append(it.h.iters, iter)
+		}
+	}
+	heap.Init(it.h)
+}
+
+// Rewind 重新回到迭代器的起点，即第一个数据
+func (it *Iterator) Rewind() {
+	for _, iter := range it.iters {
+		iter.Rewind()
+	}
+	it.rebuild()
+}
+
+// Seek 根据传入的 key 查找到第一个大于（或小于）等于的目标 key，根据从这个 key 开始遍历
+func (it *Iterator) Seek(key []byte) {
+	for _, iter := range it.iters {
+		iter.Seek(key)
+	}
+	it.rebuild()
+}
+
+// Next 跳转到下一个 key
+func (it *Iterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	top := it.h.iters[0]
+	top.Next()
+	if top.Valid() {
+		heap.Fix(it.h, 0)
+	} else {
+		heap.Pop(it.h)
+	}
+}
+
+// Valid 是否有效，即是否已经遍历完了所有的 key，用于退出遍历
+func (it *Iterator) Valid() bool {
+	return it.h.Len() > 0
+}
+
+// Key 当前遍历位置的 Key 数据
+func (it *Iterator) Key() []byte {
+	return it.h.iters[0].Key()
+}
+
+// Value 当前遍历位置的 Value 数据
+func (it *Iterator) Value() ([]byte, error) {
+	return it.h.iters[0].Value()
+}
+
+// Close 关闭迭代器，释放相应资源
+func (it *Iterator) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+	it.h.iters = nil
+}
+
+// iteratorHeap 按照迭代器当前 key 排序的堆，堆顶是下一个要遍历的迭代器
+type iteratorHeap struct {
+	iters   []*bitcask.Iterator
+	reverse bool
+	cmp     index.Comparator
+}
+
+func (h *iteratorHeap) Len() int { return len(h.iters) }
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	cmp := h.cmp.Compare(h.iters[i].Key(), h.iters[j].Key())
+	if h.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) { h.iters[i], h.iters[j] = h.iters[j], h.iters[i] }
+
+func (h *iteratorHeap) Push(x any) { h.iters = append(h.iters, x.(*bitcask.Iterator)) }
+
+func (h *iteratorHeap) Pop() any {
+	n := len(h.iters)
+	it := h.iters[n-1]
+	h.iters = h.iters[:n-1]
+	return it
+}
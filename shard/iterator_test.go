@@ -0,0 +1,80 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc
+package shard
+
+import (
+	"github.com/stretchr/testify/assert"
+	bitcask "kv-projects"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func TestDB_NewIterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-shard-iterator")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.没有数据
+	iter, err := db.NewIterator(bitcask.DefaultIteratorOptions)
+	assert.Nil(t, err)
+	assert.False(t, iter.Valid())
+	iter.Close()
+
+	// 2.跨分片有序遍历
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	iter, err = db.NewIterator(bitcask.DefaultIteratorOptions)
+	assert.Nil(t, err)
+	var count int
+	var prev []byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if prev != nil {
+			assert.True(t, string(prev) < string(iter.Key()))
+		}
+		prev = iter.Key()
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iter.Key(), val)
+		count++
+	}
+	assert.Equal(t, 500, count)
+
+	// 3.Seek
+	iter.Seek(utils.GetTestKey(250))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, utils.GetTestKey(250), iter.Key())
+	iter.Close()
+
+	// 4.反向遍历
+	iter, err = db.NewIterator(bitcask.IteratorOptions{Reverse: true})
+	assert.Nil(t, err)
+	prev = nil
+	count = 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if prev != nil {
+			assert.True(t, string(prev) > string(iter.Key()))
+		}
+		prev = iter.Key()
+		count++
+	}
+	assert.Equal(t, 500, count)
+	iter.Close()
+
+	// 5.指定前缀
+	iter, err = db.NewIterator(bitcask.IteratorOptions{Prefix: []byte("bitcask-go-key-00000000")})
+	assert.Nil(t, err)
+	count = 0
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 10, count)
+	iter.Close()
+}
@@ -0,0 +1,104 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc 分片清单，记录哈希环的参数、所有分片和正在进行的迁移
+package shard
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const manifestFileName = "MANIFEST"
+
+// manifest 分片清单
+// 哈希环完全由虚拟节点数量和分片的加入顺序决定，重新打开时按照清单重建出同样的环
+type manifest struct {
+	vnodes    int
+	shards    []string // 按加入顺序排列的分片名称
+	migrating string   // 正在迁入数据的分片，为空表示没有进行中的迁移
+}
+
+// readManifest 读取目录中的分片清单，清单不存在时返回 nil
+func readManifest(dirPath string) (*manifest, error) {
+	file, err := os.Open(filepath.Join(dirPath, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &manifest{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		field, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || value == "" {
+			return nil, ErrManifestCorrupted
+		}
+		switch field {
+		case "vnodes":
+			if m.vnodes, err = strconv.Atoi(value); err != nil || m.vnodes <= 0 {
+				return nil, ErrManifestCorrupted
+			}
+		case "shard":
+			m.shards = append(m.shards, value)
+		case "migrating":
+			m.migrating = value
+		default:
+			return nil, ErrManifestCorrupted
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if m.vnodes == 0 || len(m.shards) == 0 {
+		return nil, ErrManifestCorrupted
+	}
+	return m, nil
+}
+
+// writeManifest 写入分片清单，先写临时文件再重命名，崩溃时不会留下不完整的清单
+func writeManifest(dirPath string, m *manifest) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "vnodes %d\n", m.vnodes)
+	for _, name := range m.shards {
+		fmt.Fprintf(&sb, "shard %s\n", name)
+	}
+	if m.migrating != "" {
+		fmt.Fprintf(&sb, "migrating %s\n", m.migrating)
+	}
+
+	path := filepath.Join(dirPath, manifestFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(sb.String()); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// 持久化目录项，保证重命名在崩溃之后仍然有效
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,64 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc 带虚拟节点的一致性哈希环
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ring 一致性哈希环
+// 每个分片在环上有 vnodes 个虚拟节点，key 属于顺时针方向的第一个虚拟节点所在的分片。
+// 增加一个分片时只有落在新虚拟节点上的 key 需要迁移，约为全部 key 的 1/N
+type ring struct {
+	vnodes int
+	hashes []uint64          // 所有虚拟节点的哈希值，升序排列
+	owners map[uint64]string // 虚拟节点所在的分片
+}
+
+// newRing 新建空的哈希环
+func newRing(vnodes int) *ring {
+	return &ring{vnodes: vnodes, owners: make(map[uint64]string)}
+}
+
+// hashKey 计算 key 在环上的位置
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	// fnv 对只有末尾几个字节不同的输入区分度不够，再混合一次让虚拟节点分布更均匀
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// add 将分片的虚拟节点加入到环上
+func (r *ring) add(name string) {
+	for i := 0; i < r.vnodes; i++ {
+		hash := hashKey([]byte(name + "#" + strconv.Itoa(i)))
+		// 哈希冲突时保留先加入的分片，同样的加入顺序总是得到同样的环
+		if _, ok := r.owners[hash]; ok {
+			continue
+		}
+		r.owners[hash] = name
+		r.hashes = append(r.hashes, hash)
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// locate key 所在的分片，环为空时返回空字符串
+func (r *ring) locate(key []byte) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
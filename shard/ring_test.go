@@ -0,0 +1,54 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc
+package shard
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-projects/utils"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	// 1.空的环
+	r := newRing(128)
+	assert.Equal(t, "", r.locate([]byte("key")))
+
+	// 2.key 比较均匀地分布到各个分片上
+	names := []string{shardName(0), shardName(1), shardName(2), shardName(3)}
+	for _, name := range names {
+		r.add(name)
+	}
+	counts := make(map[string]int)
+	owners := make(map[int]string)
+	for i := 0; i < 10000; i++ {
+		owners[i] = r.locate(utils.GetTestKey(i))
+		counts[owners[i]]++
+	}
+	assert.Equal(t, 4, len(counts))
+	for _, name := range names {
+		assert.True(t, counts[name] > 1500, "shard %s owns %d keys", name, counts[name])
+	}
+
+	// 3.同样的加入顺序得到同样的环
+	r2 := newRing(128)
+	for _, name := range names {
+		r2.add(name)
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Equal(t, owners[i], r2.locate(utils.GetTestKey(i)))
+	}
+
+	// 4.增加分片之后只有归属新分片的 key 发生变化
+	r.add(shardName(4))
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		owner := r.locate(utils.GetTestKey(i))
+		if owner != owners[i] {
+			assert.Equal(t, shardName(4), owner)
+			moved++
+		}
+	}
+	assert.True(t, moved > 1000 && moved < 3000, "moved %d keys", moved)
+}
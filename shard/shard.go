@@ -0,0 +1,272 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc 按一致性哈希将 key 分布到多个存储引擎实例上，突破单个目录的容量限制
+package shard
+
+import (
+	"fmt"
+	bitcask "kv-projects"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Options 分片数据库的配置
+type Options struct {
+	// 数据目录，每个分片是其中的一个子目录
+	DirPath string
+
+	// 新建时的分片数量，已经存在的数据库以分片清单为准
+	Shards int
+
+	// 每个分片在哈希环上的虚拟节点数量，只在新建时生效，之后记录在分片清单中
+	VirtualNodes int
+
+	// 每个分片的存储引擎配置，DirPath 会被替换为分片的子目录
+	DBOptions bitcask.Options
+}
+
+var DefaultOptions = Options{
+	DirPath:      filepath.Join(os.TempDir(), "bitcask-go-shard"),
+	Shards:       4,
+	VirtualNodes: 128,
+	DBOptions:    bitcask.DefaultOptions,
+}
+
+// DB 分片数据库
+// 持有多个存储引擎实例，每个实例在自己的子目录中，key 按一致性哈希环路由到其中一个实例。
+// 增加分片时只迁移哈希环上归属发生变化的 key，跨分片的遍历通过多路归并各个分片的迭代器得到全局有序的结果。
+// 目前只支持本地的实例，存储引擎没有对外提供读写的网络服务
+type DB struct {
+	options  Options
+	mu       *sync.RWMutex // 读写持有读锁，增加分片和关闭持有写锁
+	manifest *manifest
+	ring     *ring
+	shards   map[string]*bitcask.DB
+	closed   bool
+}
+
+// Open 打开分片数据库，上次增加分片时没有完成的迁移会在打开时继续完成
+func Open(options Options) (*DB, error) {
+	if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	m, err := readManifest(options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		if options.Shards <= 0 {
+			return nil, ErrInvalidShards
+		}
+		if options.VirtualNodes <= 0 {
+			return nil, ErrInvalidVirtualNodes
+		}
+		m = &manifest{vnodes: options.VirtualNodes}
+		for i := 0; i < options.Shards; i++ {
+			m.shards = append(m.shards, shardName(i))
+		}
+		if err := writeManifest(options.DirPath, m); err != nil {
+			return nil, err
+		}
+	}
+
+	db := &DB{
+		options:  options,
+		mu:       new(sync.RWMutex),
+		manifest: m,
+		ring:     newRing(m.vnodes),
+		shards:   make(map[string]*bitcask.DB, len(m.shards)),
+	}
+	for _, name := range m.shards {
+		if err := db.openShard(name); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	if m.migrating != "" {
+		if err := db.finishMigration(); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// shardName 第 i 个分片的名称，也是分片的子目录
+func shardName(i int) string {
+	return fmt.Sprintf("shard-%03d", i)
+}
+
+// openShard 打开分片的存储引擎实例，并加入到哈希环上
+func (db *DB) openShard(name string) error {
+	opts := db.options.DBOptions
+	opts.DirPath = filepath.Join(db.options.DirPath, name)
+	shardDB, err := bitcask.Open(opts)
+	if err != nil {
+		return err
+	}
+	db.shards[name] = shardDB
+	db.ring.add(name)
+	return nil
+}
+
+// shardOf key 所在的分片，调用方需要持有 db.mu
+func (db *DB) shardOf(key []byte) *bitcask.DB {
+	return db.shards[db.ring.locate(key)]
+}
+
+// Put 写入 key/value
+func (db *DB) Put(key []byte, value []byte) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.shardOf(key).Put(key, value)
+}
+
+// Get 读取 key 对应的 value
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return db.shardOf(key).Get(key)
+}
+
+// Delete 删除 key
+func (db *DB) Delete(key []byte) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.shardOf(key).Delete(key)
+}
+
+// Shards 按加入顺序排列的所有分片名称
+func (db *DB) Shards() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]string(nil), db.manifest.shards...)
+}
+
+// AddShard 增加一个分片，并将哈希环上归属新分片的 key 从其他分片迁移过来，返回新分片的名称
+//
+// 迁移期间持有写锁，读写都会被阻塞。新分片先记录到分片清单中再开始迁移，
+// 迁移中途崩溃时，重新打开会按照清单重建出同样的哈希环并继续完成迁移
+func (db *DB) AddShard() (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return "", ErrClosed
+	}
+
+	name := shardName(len(db.manifest.shards))
+	m := &manifest{
+		vnodes:    db.manifest.vnodes,
+		shards:    append(append([]string(nil), db.manifest.shards...), name),
+		migrating: name,
+	}
+	if err := db.openShard(name); err != nil {
+		return "", err
+	}
+	if err := writeManifest(db.options.DirPath, m); err != nil {
+		// 清单没有更新，恢复原来的哈希环
+		_ = db.shards[name].Close()
+		delete(db.shards, name)
+		db.ring = newRing(db.manifest.vnodes)
+		for _, shard := range db.manifest.shards {
+			db.ring.add(shard)
+		}
+		return "", err
+	}
+	db.manifest = m
+	if err := db.finishMigration(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// finishMigration 将归属正在迁入的分片的 key 从其他分片迁移过去，完成之后从清单中清除迁移记录，调用方需要持有 db.mu 的写锁
+// 每个 key 先写入新分片再从原分片删除，中途崩溃之后重新执行是幂等的
+func (db *DB) finishMigration() error {
+	target := db.manifest.migrating
+	targetDB := db.shards[target]
+	if targetDB == nil {
+		return ErrManifestCorrupted
+	}
+	for name, shardDB := range db.shards {
+		if name == target {
+			continue
+		}
+		if err := db.migrateShard(shardDB, targetDB, target); err != nil {
+			return err
+		}
+	}
+	if err := targetDB.Sync(); err != nil {
+		return err
+	}
+
+	m := *db.manifest
+	m.migrating = ""
+	if err := writeManifest(db.options.DirPath, &m); err != nil {
+		return err
+	}
+	db.manifest = &m
+	return nil
+}
+
+// migrateShard 将 source 中归属 target 的 key 迁移到 targetDB 中
+func (db *DB) migrateShard(source, targetDB *bitcask.DB, target string) error {
+	iter := source.NewIterator(bitcask.DefaultIteratorOptions)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if db.ring.locate(key) != target {
+			continue
+		}
+		value, err := iter.Value()
+		if err == bitcask.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := targetDB.Put(key, value); err != nil {
+			return err
+		}
+	}
+	// 新分片中的数据持久化之后才能从原分片删除
+	if err := targetDB.Sync(); err != nil {
+		return err
+	}
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if key := iter.Key(); db.ring.locate(key) == target {
+			if err := source.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close 关闭所有分片
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	var firstErr error
+	for _, shardDB := range db.shards {
+		if err := shardDB.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,183 @@
+// Package shard
+// @Author NuyoahCh
+// @Date 2025/3/1 10:30
+// @Desc
+package shard
+
+import (
+	"github.com/stretchr/testify/assert"
+	bitcask "kv-projects"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+func destroyDB(db *DB) {
+	if db != nil {
+		_ = db.Close()
+		err := os.RemoveAll(db.options.DirPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// countKeys 分片中 key 的数量
+func countKeys(shardDB *bitcask.DB) int {
+	iter := shardDB.NewIterator(bitcask.DefaultIteratorOptions)
+	defer iter.Close()
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	return count
+}
+
+// assertOwned 每个 key 都只在哈希环上归属的分片中
+func assertOwned(t *testing.T, db *DB, count int) {
+	for i := 0; i < count; i++ {
+		key := utils.GetTestKey(i)
+		owner := db.ring.locate(key)
+		for name, shardDB := range db.shards {
+			_, err := shardDB.Get(key)
+			if name == owner {
+				assert.Nil(t, err)
+			} else {
+				assert.Equal(t, bitcask.ErrKeyNotFound, err)
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-shard-open")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"shard-000", "shard-001", "shard-002", "shard-003"}, db.Shards())
+
+	// 1.非法的配置
+	opts.DirPath = dir + "-invalid"
+	defer os.RemoveAll(opts.DirPath)
+	opts.Shards = 0
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidShards, err)
+	opts.Shards, opts.VirtualNodes = 4, 0
+	_, err = Open(opts)
+	assert.Equal(t, ErrInvalidVirtualNodes, err)
+}
+
+func TestDB_PutGetDelete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-shard-put")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入的 key 分布到所有分片上
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for _, shardDB := range db.shards {
+		assert.True(t, countKeys(shardDB) > 0)
+	}
+	assertOwned(t, db, 1000)
+
+	// 2.读取和删除
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(10), val)
+	err = db.Delete(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(10))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+	err = db.Put(nil, []byte("value"))
+	assert.Equal(t, bitcask.ErrKeyIsEmpty, err)
+
+	// 3.重新打开时以分片清单为准
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.Shards, opts.VirtualNodes = 8, 16
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(db.Shards()))
+	val, err = db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+
+	// 4.关闭之后
+	err = db.Close()
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(999))
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestDB_AddShard(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-shard-add")
+	opts.DirPath = dir
+	opts.Shards = 2
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 1.增加分片之后归属新分片的 key 被迁移过去
+	name, err := db.AddShard()
+	assert.Nil(t, err)
+	assert.Equal(t, "shard-002", name)
+	assert.True(t, countKeys(db.shards[name]) > 0)
+	assertOwned(t, db, 1000)
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	// 2.重新打开之后路由不变
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"shard-000", "shard-001", "shard-002"}, db.Shards())
+	assertOwned(t, db, 1000)
+}
+
+func TestDB_AddShard_Resume(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-shard-resume")
+	opts.DirPath = dir
+	opts.Shards = 2
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 1.模拟新分片已经记录到清单中，迁移还没有完成时崩溃
+	err = writeManifest(dir, &manifest{
+		vnodes:    opts.VirtualNodes,
+		shards:    []string{"shard-000", "shard-001", "shard-002"},
+		migrating: "shard-002",
+	})
+	assert.Nil(t, err)
+
+	// 2.重新打开时完成迁移，并清除迁移记录
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assertOwned(t, db, 1000)
+	m, err := readManifest(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "", m.migrating)
+}
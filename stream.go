@@ -0,0 +1,263 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/22 20:35
+// @Desc 大 value 的流式读写，value 按块写入到值日志中，不需要一次性加载到内存
+package kv_projects
+
+import (
+	"bytes"
+	"io"
+	"kv-projects/data"
+	"math/rand/v2"
+)
+
+// streamChunkSize 分块写入时每个块的最大长度
+const streamChunkSize = 1 << 20
+
+// PutReader 从 reader 中读取 size 个字节作为 key 的 value，按块写入到值日志中，内存中最多只有一个块
+// 所有的块写入并持久化之后才写入清单并更新索引，中途失败或者崩溃时 key 之前的 value 不受影响，
+// 已经写入的块不会被引用，在值日志的垃圾回收时清理。
+// 读取 reader 和写入块时不持有分段锁，不会阻塞其他写入、合并和值日志的垃圾回收，只在写入清单和更新索引时持有。
+// 块所在的值日志文件在清单写入之前不会被回收，并发写入同一个 key 时最后写入清单的为准
+func (db *DB) PutReader(key []byte, reader io.Reader, size int64) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if size < 0 {
+		return ErrInvalidValueSize
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	// 流式写入的 value 不会完整地加载到内存中，无法提取索引 key
+	if len(db.secondaryIndexes) > 0 {
+		return ErrStreamIndexed
+	}
+
+	pinned := make(map[uint32]struct{})
+	defer db.unpinChunks(pinned)
+
+	manifest := &data.ChunkManifest{Id: rand.Uint64(), Size: size}
+	buf := make([]byte, min(int64(db.chunkSize()), size))
+	for remain := size; remain > 0; {
+		n := min(int64(len(buf)), remain)
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			// reader 中的数据少于 size
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		vp, err := db.writeChunk(&data.LogRecord{Key: key, Value: buf[:n], Type: data.LogRecordChunk}, pinned)
+		if err != nil {
+			return err
+		}
+		manifest.Chunks = append(manifest.Chunks, vp)
+		remain -= n
+	}
+	// 清单写入之前持久化所有的块，保证持久化的清单引用的块一定存在
+	if err := db.syncValueLog(); err != nil {
+		return err
+	}
+
+	unlock := db.keyLocks.lockKey(key)
+	defer unlock()
+	logRecord := &data.LogRecord{
+		Key:   key,
+		Value: data.EncodeChunkManifest(manifest),
+		Type:  data.LogRecordChunkManifest,
+	}
+	pos, err := db.appendLogRecordWithLock(logRecord)
+	if err != nil {
+		return err
+	}
+	db.addToBloomFilter(key)
+	if ok := db.index.Put(key, pos); !ok {
+		return ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// GetReader 根据 key 流式地读取 value，分块写入的 value 每次只读取一个块，其他的 value 直接返回完整的数据
+// 读取期间值日志的垃圾回收移动了块的位置时会继续读取新的位置，key 被覆盖或者删除之后的垃圾回收会导致读取返回 ErrValueChanged
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	logRecord, err := db.getLogRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type == data.LogRecordChunkManifest {
+		manifest, err := data.DecodeChunkManifest(logRecord.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &chunkReader{db: db, key: key, manifest: manifest}, nil
+	}
+	value, err := db.valueOfLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(value)), nil
+}
+
+// getLogRecord 根据 key 读取数据文件中的记录，和 Get 一样在合并之后重新读取索引
+func (db *DB) getLogRecord(key []byte) (*data.LogRecord, error) {
+	if !db.mayContain(key) {
+		return nil, ErrKeyNotFound
+	}
+	for {
+		logRecordPos := db.index.Get(key)
+		if logRecordPos == nil {
+			return nil, ErrKeyNotFound
+		}
+		logRecord, err := db.readLogRecordByPosition(logRecordPos)
+		if db.isFileRetired(err) && db.index.Get(key) != logRecordPos {
+			continue
+		}
+		return logRecord, err
+	}
+}
+
+// chunkSize 分块写入时每个块的长度，不超过数据文件大小的一半
+func (db *DB) chunkSize() int {
+	return int(max(min(streamChunkSize, db.options.DataFileSize/2), 1))
+}
+
+// writeChunk 加锁后写入一个块到值日志中，块所在的文件记录到 pinned 中，在 unpinChunks 之前不会被回收
+func (db *DB) writeChunk(logRecord *data.LogRecord, pinned map[uint32]struct{}) (*data.ValuePointer, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+	vp, err := db.appendValueLog(logRecord)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := pinned[vp.Fid]; !ok {
+		pinned[vp.Fid] = struct{}{}
+		db.valueLog.pinned[vp.Fid]++
+	}
+	return vp, nil
+}
+
+// unpinChunks 分块写入结束，块所在的文件可以被回收
+func (db *DB) unpinChunks(pinned map[uint32]struct{}) {
+	if len(pinned) == 0 {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for fid := range pinned {
+		if db.valueLog.pinned[fid]--; db.valueLog.pinned[fid] == 0 {
+			delete(db.valueLog.pinned, fid)
+		}
+	}
+}
+
+// syncValueLog 加锁后持久化活跃的值日志文件
+func (db *DB) syncValueLog() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed.Load() {
+		return ErrDBClosed
+	}
+	return db.syncValueLogFile()
+}
+
+// readChunkedValue 根据编码之后的清单读取完整的 value
+func (db *DB) readChunkedValue(buf []byte) ([]byte, error) {
+	manifest, err := data.DecodeChunkManifest(buf)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, manifest.Size)
+	for _, vp := range manifest.Chunks {
+		logRecord, err := db.readValueLogRecord(vp)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, logRecord.Value...)
+	}
+	if int64(len(value)) != manifest.Size {
+		return nil, data.ErrInvalidChunkManifest
+	}
+	return value, nil
+}
+
+// chunkReader 分块写入的 value 的流式读取
+type chunkReader struct {
+	db       *DB
+	key      []byte
+	manifest *data.ChunkManifest
+	next     int    // 下一个需要读取的块
+	buf      []byte // 当前块中还没有被读取的数据
+	closed   bool
+}
+
+// Read 读取数据，当前块读取完之后再从值日志中读取下一个块
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.closed {
+		return 0, ErrReaderClosed
+	}
+	for len(cr.buf) == 0 {
+		if cr.next >= len(cr.manifest.Chunks) {
+			return 0, io.EOF
+		}
+		chunk, err := cr.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		cr.buf = chunk
+		cr.next++
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// Close 关闭读取，释放当前块的数据
+func (cr *chunkReader) Close() error {
+	cr.closed = true
+	cr.buf = nil
+	return nil
+}
+
+// readChunk 读取下一个块
+func (cr *chunkReader) readChunk() ([]byte, error) {
+	for {
+		vp := cr.manifest.Chunks[cr.next]
+		logRecord, err := cr.db.readValueLogRecord(vp)
+		if err == nil {
+			return logRecord.Value, nil
+		}
+		if !cr.db.isFileRetired(err) {
+			return nil, err
+		}
+
+		// 值日志的垃圾回收移动了块的位置，重新读取清单，id 相同说明仍然是同一个 value
+		logRecord, err = cr.db.getLogRecord(cr.key)
+		if err == ErrKeyNotFound {
+			return nil, ErrValueChanged
+		}
+		if err != nil {
+			return nil, err
+		}
+		if logRecord.Type != data.LogRecordChunkManifest {
+			return nil, ErrValueChanged
+		}
+		manifest, err := data.DecodeChunkManifest(logRecord.Value)
+		if err != nil {
+			return nil, err
+		}
+		if manifest.Id != cr.manifest.Id {
+			return nil, ErrValueChanged
+		}
+		if *manifest.Chunks[cr.next] == *vp {
+			return nil, ErrDataFileNotFound
+		}
+		cr.manifest = manifest
+	}
+}
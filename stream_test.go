@@ -0,0 +1,181 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/22 20:35
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+// streamValue 生成指定长度的测试数据
+func streamValue(n int, seed byte) []byte {
+	value := make([]byte, n)
+	for i := range value {
+		value[i] = byte(i%251) + seed
+	}
+	return value
+}
+
+func TestDB_PutReader(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.分块写入，流式读取和一次性读取的结果一致
+	value := streamValue(3*streamChunkSize+100, 0)
+	err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	readValue, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, readValue)
+	assert.Nil(t, reader.Close())
+	_, err = reader.Read(make([]byte, 1))
+	assert.Equal(t, ErrReaderClosed, err)
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val1)
+
+	// 2.空的 value，普通写入的 value 也可以流式读取
+	err = db.PutReader(utils.GetTestKey(2), bytes.NewReader(nil), 0)
+	assert.Nil(t, err)
+	val2, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(val2))
+	err = db.Put(utils.GetTestKey(3), []byte("small"))
+	assert.Nil(t, err)
+	reader3, err := db.GetReader(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	val3, err := io.ReadAll(reader3)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), val3)
+	_, err = db.GetReader(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 3.写入中途失败，之前的 value 不受影响
+	short := streamValue(2*streamChunkSize, 1)
+	err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(short), int64(len(short)+1))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	val1, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val1)
+	err = db.PutReader(utils.GetTestKey(1), bytes.NewReader(short), -1)
+	assert.Equal(t, ErrInvalidValueSize, err)
+
+	// 4.重启之后可以读取，没有写入清单的块不可见
+	closeFiles(t, db)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	reader, err = db2.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	readValue, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, readValue)
+	assert.Equal(t, 3, db2.index.Size())
+
+	// 5.合并之后仍然可以读取，没有被引用的块在垃圾回收之后被清理
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.ValueLogGC(0.5)
+	assert.Nil(t, err)
+	val1, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val1)
+	closeFiles(t, db2)
+}
+
+func TestDB_GetReader_ValueLogGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-gc")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 16
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 第一个块和一个之后会被删除的 value 在同一个值日志文件中
+	err = db.Put(utils.GetTestKey(1), streamValue(20*1024, 0))
+	assert.Nil(t, err)
+	value := streamValue(3*db.chunkSize(), 1)
+	err = db.PutReader(utils.GetTestKey(2), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	// 1.读取期间垃圾回收移动了块的位置，继续读取新的位置
+	reader, err := db.GetReader(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	oldFiles := len(*db.valueLog.files.Load())
+	err = db.ValueLogGC(0.3)
+	assert.Nil(t, err)
+	_, err = os.Stat(dir + "/000000000.vlog")
+	assert.True(t, os.IsNotExist(err))
+	readValue, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, readValue)
+	assert.True(t, oldFiles > 1)
+
+	// 2.读取期间 value 被覆盖，旧的块被回收之后无法继续读取
+	reader2, err := db.GetReader(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("new"))
+	assert.Nil(t, err)
+	err = db.ValueLogGC(1)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader2)
+	assert.Equal(t, ErrValueChanged, err)
+	val2, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), val2)
+}
+
+func TestDB_PutReader_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-concurrent")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * streamChunkSize
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入了一部分块之后 reader 阻塞
+	value := streamValue(8*streamChunkSize, 2)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PutReader(utils.GetTestKey(1), pr, int64(len(value)))
+	}()
+	_, err = pw.Write(value[:5*streamChunkSize])
+	assert.Nil(t, err)
+
+	// 2.阻塞期间同一个 key 的写入、合并和值日志的垃圾回收都不需要等待，已经写入的块不会被回收
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("inline")))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.ValueLogGC(0.01))
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("inline"), val)
+
+	// 3.写入完成之后清单覆盖之前的 value
+	_, err = pw.Write(value[5*streamChunkSize:])
+	assert.Nil(t, err)
+	assert.Nil(t, <-done)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, db.ValueLogGC(0.01))
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+}
@@ -0,0 +1,293 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/25 21:30
+// @Desc 变更数据捕获，按照写入的顺序订阅所有已经提交的日志记录
+package kv_projects
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"kv-projects/data"
+	"sort"
+	"sync"
+)
+
+// ChangeEvent 一次已经提交的写入
+// 范围删除的事件中 Key 是范围的起点，Value 是范围的终点（不包含），为 nil 表示没有上界
+type ChangeEvent struct {
+	Seq   uint64             // 序列号，即记录在数据文件中的位置，严格递增
+	Key   []byte             // key
+	Value []byte             // value，删除时为 nil；分离到值日志中的 value 在被覆盖并回收之后也为 nil；分块写入的 value 为 nil，需要通过 GetReader 读取
+	Type  data.LogRecordType // LogRecordNormal、LogRecordDeleted 或者 LogRecordRangeDeleted
+}
+
+// makeSeq 根据记录的位置生成序列号，高 32 位是文件 id，低 32 位是文件中的偏移
+func makeSeq(fid uint32, offset int64) uint64 {
+	return uint64(fid)<<32 | uint64(offset)
+}
+
+// splitSeq 根据序列号得到记录的位置
+func splitSeq(seq uint64) (uint32, int64) {
+	return uint32(seq >> 32), int64(seq & 0xffffffff)
+}
+
+// commitNotifier 通知等待的订阅者有新的写入提交，没有等待者时通知没有额外的开销
+type commitNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait 获取下一次提交时会被关闭的 channel
+func (n *commitNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// broadcast 唤醒所有等待的订阅者
+func (n *commitNotifier) broadcast() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// publishCommitted 发布当前已经写入的位置并唤醒订阅者，调用方需要持有 db.mu
+func (db *DB) publishCommitted() {
+	if db.activeFile != nil {
+		db.committed.Store(makeSeq(db.activeFile.FileId, db.activeFile.WriteOff))
+	}
+	db.notifier.broadcast()
+}
+
+// Subscription 变更数据的订阅，先回放数据文件中从指定序列号开始的记录，然后等待新的写入
+// 订阅直接从数据文件中读取，不在内存中缓存事件，消费慢的订阅者只是落后于写入，不会占用更多的内存。
+// 合并会重写所有有效的数据，这些数据会作为新的事件再次发送，因此消费者需要能够处理重复的事件。
+// 批次中的记录和回放时一样，读取到数量一致的提交记录之后才作为事件返回，被放弃的批次中的记录没有事件。
+// Subscription 不是并发安全的
+type Subscription struct {
+	db      *DB
+	cursor  uint64 // 下一条需要读取的记录的位置
+	aligned bool   // cursor 是否已经对齐到记录的起始位置
+	closed  bool
+
+	batching   bool           // 是否读取到了批次的开始记录
+	batchStart uint64         // 批次的开始记录的位置
+	batchSize  int            // 批次中已经读取到的记录数量，包括其他命名空间中的记录
+	pending    []*ChangeEvent // 批次中默认命名空间的记录对应的事件
+	ready      []*ChangeEvent // 已经提交的批次中还没有返回的事件
+}
+
+// Subscribe 订阅序列号大于等于 fromSeq 的所有写入，fromSeq 为 0 表示从最早的记录开始
+// 使用 Cursor 保存订阅的进度，之后通过 Subscribe(cursor) 继续订阅
+func (db *DB) Subscribe(fromSeq uint64) (*Subscription, error) {
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+	return &Subscription{db: db, cursor: fromSeq}, nil
+}
+
+// Cursor 订阅的进度，即下一条需要读取的记录的序列号
+// 已经提交的批次中还有没有返回的事件时，从其中的第一个事件继续；批次还没有读取到提交记录时，从批次的开始记录继续
+func (s *Subscription) Cursor() uint64 {
+	if len(s.ready) > 0 {
+		return s.ready[0].Seq
+	}
+	if s.batching {
+		return s.batchStart
+	}
+	return s.cursor
+}
+
+// resetBatch 清空读取到一半的批次
+func (s *Subscription) resetBatch() {
+	s.batching, s.batchSize, s.pending = false, 0, nil
+}
+
+// Close 关闭订阅
+func (s *Subscription) Close() {
+	s.closed = true
+}
+
+// Next 读取下一个事件，没有新的写入时阻塞等待，直到有新的写入提交、ctx 结束或者数据库关闭
+// 订阅的进度所在的数据文件已经被合并，并且合并时还没有读取完，返回 ErrSeqCompacted，
+// 这期间的删除可能已经丢失，订阅会从合并之后的文件继续，消费者可以选择通过 Subscribe(0) 重新同步
+func (s *Subscription) Next(ctx context.Context) (*ChangeEvent, error) {
+	for {
+		if s.closed {
+			return nil, ErrSubscriptionClosed
+		}
+		if s.db.closed.Load() {
+			return nil, ErrDBClosed
+		}
+		// 先获取通知的 channel 再读取，避免错过读取之后、等待之前的提交
+		wait := s.db.notifier.wait()
+		event, err := s.readNext()
+		if err != nil || event != nil {
+			return event, err
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// readNext 读取已经提交的下一条记录，没有新的记录时返回 nil
+func (s *Subscription) readNext() (*ChangeEvent, error) {
+	if len(s.ready) > 0 {
+		event := s.ready[0]
+		s.ready = s.ready[1:]
+		return event, nil
+	}
+	committed := s.db.committed.Load()
+	for s.cursor < committed {
+		fid, offset := splitSeq(s.cursor)
+		dataFiles := *s.db.dataFiles.Load()
+		dataFile := dataFiles[fid]
+		if dataFile == nil {
+			// 文件已经被合并，或者 cursor 在两个文件之间
+			compacted := s.cursor != 0 && s.cursor < s.db.mergedSeq.Load()
+			if !s.seekNextFile(dataFiles, fid) {
+				return nil, nil
+			}
+			if compacted {
+				s.resetBatch()
+				return nil, ErrSeqCompacted
+			}
+			continue
+		}
+		if offset < dataFile.HeaderSize() {
+			offset = dataFile.HeaderSize()
+			s.cursor, s.aligned = makeSeq(fid, offset), true
+		}
+		if !s.aligned {
+			if err := s.align(dataFile, offset); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			// 读取完一个旧的数据文件，继续读取下一个
+			if !s.seekNextFile(dataFiles, fid) {
+				return nil, nil
+			}
+			continue
+		}
+		if s.db.isFileRetired(err) {
+			if s.db.closed.Load() {
+				return nil, ErrDBClosed
+			}
+			// 读取期间文件被合并，重新从快照中查找
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		seq := makeSeq(fid, offset)
+		s.cursor = makeSeq(fid, offset+size)
+		switch logRecord.Type {
+		case data.LogRecordBatchBegin:
+			s.resetBatch()
+			s.batching, s.batchStart = true, seq
+			continue
+		case data.LogRecordBatchCommit:
+			// 没有开始记录的提交记录来自已经被合并清理的批次，或者订阅从批次的中间开始，其中的记录已经作为普通记录返回了
+			count, n := binary.Uvarint(logRecord.Value)
+			ok := s.batching && n > 0 && count == uint64(s.batchSize)
+			pending := s.pending
+			s.resetBatch()
+			if ok && len(pending) > 0 {
+				s.ready = pending[1:]
+				return pending[0], nil
+			}
+			continue
+		}
+		if s.batching {
+			s.batchSize++
+		}
+		// 订阅只包含默认命名空间的写入
+		if logRecord.Namespace != 0 {
+			continue
+		}
+		event, err := s.db.newChangeEvent(seq, logRecord)
+		if err != nil {
+			return nil, err
+		}
+		if s.batching {
+			s.pending = append(s.pending, event)
+			continue
+		}
+		return event, nil
+	}
+	return nil, nil
+}
+
+// align 从文件头开始遍历，将 cursor 对齐到第一条位置大于等于 offset 的记录
+func (s *Subscription) align(dataFile *data.DataFile, offset int64) error {
+	pos := dataFile.HeaderSize()
+	for pos < offset {
+		_, size, err := dataFile.ReadLogRecord(pos)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pos += size
+	}
+	s.cursor, s.aligned = makeSeq(dataFile.FileId, pos), true
+	return nil
+}
+
+// seekNextFile 将 cursor 移动到 id 大于 fid 的第一个文件的开头，没有这样的文件时返回 false
+func (s *Subscription) seekNextFile(dataFiles map[uint32]*data.DataFile, fid uint32) bool {
+	var fids []uint32
+	for id := range dataFiles {
+		if id > fid {
+			fids = append(fids, id)
+		}
+	}
+	if len(fids) == 0 {
+		return false
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	s.cursor, s.aligned = makeSeq(fids[0], 0), true
+	return true
+}
+
+// newChangeEvent 根据数据文件中的记录构造事件
+func (db *DB) newChangeEvent(seq uint64, logRecord *data.LogRecord) (*ChangeEvent, error) {
+	event := &ChangeEvent{Seq: seq, Key: logRecord.Key, Type: data.LogRecordNormal}
+	if logRecord.Type == data.LogRecordDeleted {
+		event.Type = data.LogRecordDeleted
+		return event, nil
+	}
+	if logRecord.Type == data.LogRecordRangeDeleted {
+		event.Type, event.Value = data.LogRecordRangeDeleted, rangeEnd(logRecord.Value)
+		return event, nil
+	}
+	// 分块写入的 value 可能很大，不放到事件中
+	if logRecord.Type == data.LogRecordChunkManifest {
+		return event, nil
+	}
+	value, err := db.valueOfLogRecord(logRecord)
+	// 值日志中的 value 已经被回收
+	if err == ErrDataFileNotFound {
+		return event, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	event.Value = value
+	return event, nil
+}
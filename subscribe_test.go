@@ -0,0 +1,225 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/25 21:30
+// @Desc
+package kv_projects
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"os"
+	"testing"
+	"time"
+)
+
+// nextEvent 读取下一个事件，最多等待一秒
+func nextEvent(sub *Subscription) (*ChangeEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return sub.Next(ctx)
+}
+
+func TestDB_Subscribe(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.空的数据库，没有事件
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, err = sub.Next(ctx)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// 2.回放多个数据文件中的写入，序列号严格递增
+	for i := 0; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.True(t, len(db.olderFiles) > 1)
+	var events []*ChangeEvent
+	for i := 0; i < 201; i++ {
+		event, err := nextEvent(sub)
+		assert.Nil(t, err)
+		if i > 0 {
+			assert.True(t, event.Seq > events[i-1].Seq)
+		}
+		events = append(events, event)
+	}
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, utils.GetTestKey(i), events[i].Key)
+		assert.Equal(t, utils.GetTestKey(i), events[i].Value)
+		assert.Equal(t, data.LogRecordNormal, events[i].Type)
+	}
+	assert.Equal(t, utils.GetTestKey(0), events[200].Key)
+	assert.Equal(t, data.LogRecordDeleted, events[200].Type)
+	assert.Nil(t, events[200].Value)
+
+	// 3.等待新的写入
+	done := make(chan *ChangeEvent)
+	go func() {
+		event, err := nextEvent(sub)
+		assert.Nil(t, err)
+		done <- event
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = db.Put([]byte("tail"), []byte("value"))
+	assert.Nil(t, err)
+	event := <-done
+	assert.Equal(t, []byte("tail"), event.Key)
+	assert.Equal(t, []byte("value"), event.Value)
+
+	// 4.根据游标或者序列号继续订阅
+	sub2, err := db.Subscribe(events[100].Seq + 1)
+	assert.Nil(t, err)
+	event, err = nextEvent(sub2)
+	assert.Nil(t, err)
+	assert.Equal(t, events[101].Seq, event.Seq)
+	sub3, err := db.Subscribe(sub2.Cursor())
+	assert.Nil(t, err)
+	event, err = nextEvent(sub3)
+	assert.Nil(t, err)
+	assert.Equal(t, events[102].Seq, event.Seq)
+
+	// 5.关闭之后无法读取
+	sub3.Close()
+	_, err = sub3.Next(context.Background())
+	assert.Equal(t, ErrSubscriptionClosed, err)
+	go func() {
+		_, err := sub.Next(context.Background())
+		assert.Equal(t, ErrDBClosed, err)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Close())
+	<-done
+	_, err = db.Subscribe(0)
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_Subscribe_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	// 落后的订阅者只读取了一条记录，另一个订阅者读取了所有的记录
+	behind, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	_, err = nextEvent(behind)
+	assert.Nil(t, err)
+	caughtUp, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	for i := 0; i < 150; i++ {
+		_, err := nextEvent(caughtUp)
+		assert.Nil(t, err)
+	}
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 1.落后的订阅者得到 ErrSeqCompacted，然后从合并之后的文件继续
+	_, err = nextEvent(behind)
+	assert.Equal(t, ErrSeqCompacted, err)
+	for i := 50; i < 100; i++ {
+		event, err := nextEvent(behind)
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), event.Key)
+	}
+
+	// 2.读取完所有记录的订阅者收到重写的记录
+	for i := 50; i < 100; i++ {
+		event, err := nextEvent(caughtUp)
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), event.Value)
+	}
+
+	// 3.重启之后从最早的记录开始订阅，以及游标所在的文件已经被合并
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	sub, err := db2.Subscribe(0)
+	assert.Nil(t, err)
+	event, err := nextEvent(sub)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(50), event.Key)
+	sub2, err := db2.Subscribe(1)
+	assert.Nil(t, err)
+	_, err = nextEvent(sub2)
+	assert.Equal(t, ErrSeqCompacted, err)
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_Subscribe_Batch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-subscribe-batch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.提交的批次、写入期间失败被放弃的批次、崩溃时没有提交的批次
+	_, err = db.appendLogRecordsWithLock([]*data.LogRecord{
+		{Key: []byte("batch-1"), Value: []byte("value")},
+		{Key: []byte("batch-2"), Value: []byte("value")},
+	})
+	assert.Nil(t, err)
+	db.mu.Lock()
+	_, err = db.writeLogRecord(&data.LogRecord{Type: data.LogRecordBatchBegin})
+	assert.Nil(t, err)
+	_, err = db.writeLogRecord(&data.LogRecord{Key: []byte("aborted"), Value: []byte("value")})
+	assert.Nil(t, err)
+	assert.Nil(t, db.abortBatch())
+	_, err = db.writeLogRecord(&data.LogRecord{Type: data.LogRecordBatchBegin})
+	assert.Nil(t, err)
+	_, err = db.writeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: []byte("value")})
+	assert.Nil(t, err)
+	db.mu.Unlock()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+
+	// 2.只有提交的批次中的记录有事件
+	sub, err := db.Subscribe(0)
+	assert.Nil(t, err)
+	var keys []string
+	var cursors []uint64
+	for {
+		event, err := sub.readNext()
+		assert.Nil(t, err)
+		if event == nil {
+			break
+		}
+		keys = append(keys, string(event.Key))
+		cursors = append(cursors, sub.Cursor())
+	}
+	assert.Equal(t, []string{"batch-1", "batch-2", "after"}, keys)
+
+	// 3.从批次中间的游标继续订阅，不会遗漏批次中的事件
+	resumed, err := db.Subscribe(cursors[0])
+	assert.Nil(t, err)
+	event, err := resumed.readNext()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("batch-2"), event.Key)
+}
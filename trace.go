@@ -0,0 +1,69 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/11 20:15
+// @Desc 操作的跟踪和慢操作日志
+package kv_projects
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// 跟踪的阶段名称，Get、Put、Delete 本身的名称是 "bitcask." 加上操作的名称
+const (
+	SpanIndexLookup = "bitcask.index_lookup" // 在索引中查找 key 的位置
+	SpanDiskRead    = "bitcask.disk_read"    // 根据位置读取记录，包括命中缓存的读取
+	SpanFsync       = "bitcask.fsync"        // 组提交的 leader 持久化这一批写入
+)
+
+// Tracer 跟踪操作中各个阶段的耗时，可以适配 OpenTelemetry 等跟踪系统
+// 阶段嵌套在传入的 ctx 对应的阶段中，组提交中的持久化只出现在 leader 的操作中
+type Tracer interface {
+	// Start 开始一个名称为 name 的阶段，返回的 ctx 用于其中的子阶段，end 在阶段结束时调用，err 为阶段的错误
+	Start(ctx context.Context, name string) (newCtx context.Context, end func(err error))
+}
+
+// SlowOp 一次耗时超过阈值的操作
+type SlowOp struct {
+	Op      string        // 操作的名称，get、put 或 delete
+	Key     []byte        // 操作的 key，只在回调期间有效
+	Elapsed time.Duration // 操作的耗时，包括等待锁和组提交的时间
+	Err     error         // 操作返回的错误
+}
+
+// endNoop 没有开启跟踪和慢操作日志时的结束函数
+func endNoop(error) {}
+
+// startSpan 开始一个阶段，没有配置 Tracer 时不做任何操作
+func (db *DB) startSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	if db.options.Tracer == nil {
+		return ctx, endNoop
+	}
+	return db.options.Tracer.Start(ctx, name)
+}
+
+// startOp 开始一次操作，返回的结束函数结束阶段，并在耗时达到阈值时记录慢操作
+func (db *DB) startOp(ctx context.Context, op string, key []byte) (context.Context, func(err error)) {
+	threshold := db.options.SlowOpThreshold
+	if db.options.Tracer == nil && threshold <= 0 {
+		return ctx, endNoop
+	}
+	ctx, endSpan := db.startSpan(ctx, "bitcask."+op)
+	start := time.Now()
+	return ctx, func(err error) {
+		endSpan(err)
+		if elapsed := time.Since(start); threshold > 0 && elapsed >= threshold {
+			db.logSlowOp(SlowOp{Op: op, Key: key, Elapsed: elapsed, Err: err})
+		}
+	}
+}
+
+// logSlowOp 记录慢操作，没有配置 SlowOpLogger 时通过标准库的 log 输出
+func (db *DB) logSlowOp(op SlowOp) {
+	if db.options.SlowOpLogger != nil {
+		db.options.SlowOpLogger(op)
+		return
+	}
+	log.Printf("bitcask: slow %s key=%q elapsed=%s err=%v", op.Op, op.Key, op.Elapsed, op.Err)
+}
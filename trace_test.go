@@ -0,0 +1,133 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/3/11 20:15
+// @Desc
+package kv_projects
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordTracer 记录所有阶段的名称和父阶段
+type recordTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+type spanKey struct{}
+
+func (rt *recordTracer) Start(ctx context.Context, name string) (context.Context, func(err error)) {
+	parent, _ := ctx.Value(spanKey{}).(string)
+	rt.mu.Lock()
+	rt.spans = append(rt.spans, parent+">"+name)
+	rt.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, name), func(error) {}
+}
+
+func (rt *recordTracer) take() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	spans := rt.spans
+	rt.spans = nil
+	return spans
+}
+
+func TestDB_Tracer(t *testing.T) {
+	tracer := &recordTracer{}
+	var slowOps []SlowOp
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-tracer")
+	opts.DirPath = dir
+	opts.SyncWrites = true
+	opts.Tracer = tracer
+	opts.SlowOpThreshold = time.Nanosecond
+	opts.SlowOpLogger = func(op SlowOp) {
+		slowOps = append(slowOps, op)
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.写入的持久化嵌套在写入中
+	err = db.Put([]byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{">bitcask.put", "bitcask.put>" + SpanFsync}, tracer.take())
+
+	// 2.读取的索引查找和读取记录嵌套在读取中
+	_, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{">bitcask.get", "bitcask.get>" + SpanIndexLookup, "bitcask.get>" + SpanDiskRead}, tracer.take())
+
+	// 3.耗时超过阈值的操作被记录
+	err = db.Delete([]byte("key"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 4, len(slowOps))
+	assert.Equal(t, "delete", slowOps[2].Op)
+	assert.Equal(t, []byte("key"), slowOps[2].Key)
+	assert.Equal(t, ErrKeyNotFound, slowOps[3].Err)
+}
+
+func TestDB_PutCtx(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-ctx")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.已经结束的 ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = db.PutCtx(ctx, []byte("key"), []byte("value"))
+	assert.Equal(t, context.Canceled, err)
+	_, err = db.GetCtx(ctx, []byte("key"))
+	assert.Equal(t, context.Canceled, err)
+
+	// 2.等待分段锁时超时，之后锁仍然可以被获取
+	locked, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_ = db.Update([][]byte{[]byte("key")}, func(lk *LockedKeys) error {
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = db.PutCtx(ctx, []byte("key"), []byte("value"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	err = db.DeleteCtx(ctx, []byte("key"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	close(release)
+	err = db.PutCtx(context.Background(), []byte("key"), []byte("value"))
+	assert.Nil(t, err)
+	val, err := db.GetCtx(context.Background(), []byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	// 3.在组提交中等待时超时，请求被移出队列
+	gc := db.groupCommit
+	gc.mu.Lock()
+	gc.leading = true
+	gc.mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = gc.commit(ctx, db, []*data.LogRecord{{Key: []byte("key"), Value: []byte("new")}})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	gc.mu.Lock()
+	assert.Equal(t, 0, len(gc.queue))
+	gc.leading = false
+	gc.mu.Unlock()
+	val, err = db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
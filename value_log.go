@@ -0,0 +1,411 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/21 21:10
+// @Desc 键值分离，大 value 写入到单独的值日志中，数据文件中只存储指针
+package kv_projects
+
+import (
+	"io"
+	"kv-projects/data"
+	"kv-projects/index"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// valueLog 值日志，和数据文件一样追加写入，文件 id 和数据文件相互独立
+// 写入和垃圾回收都在持有 db.mu 时进行，读路径使用只读快照，不需要获取 db.mu
+type valueLog struct {
+	activeFile *data.DataFile            // 当前的活跃值日志文件
+	olderFiles map[uint32]*data.DataFile // 旧的值日志文件，只能用于读
+	files      atomic.Pointer[map[uint32]*data.DataFile]
+	pinned     map[uint32]int // 正在进行的分块写入写过块的文件，清单写入之前不能被回收
+}
+
+// newValueLog 新建值日志
+func newValueLog() *valueLog {
+	vl := &valueLog{olderFiles: make(map[uint32]*data.DataFile), pinned: make(map[uint32]int)}
+	vl.refresh()
+	return vl
+}
+
+// refresh 重新发布值日志文件的只读快照，访问之前必须持有 db.mu
+func (vl *valueLog) refresh() {
+	files := make(map[uint32]*data.DataFile, len(vl.olderFiles)+1)
+	for fid, dataFile := range vl.olderFiles {
+		files[fid] = dataFile
+	}
+	if vl.activeFile != nil {
+		files[vl.activeFile.FileId] = vl.activeFile
+	}
+	vl.files.Store(&files)
+}
+
+// syncValueLogFile 持久化活跃的值日志文件，调用方需要持有 db.mu
+func (db *DB) syncValueLogFile() error {
+	if db.valueLog.activeFile == nil {
+		return nil
+	}
+	return db.syncDataFile(db.valueLog.activeFile)
+}
+
+// rotateValueLog 当前活跃的值日志文件转换为旧的文件，并打开新的活跃文件，访问之前必须持有 db.mu
+func (db *DB) rotateValueLog() error {
+	vl := db.valueLog
+	var fileId uint32 = 0
+	if vl.activeFile != nil {
+		if err := db.syncDataFile(vl.activeFile); err != nil {
+			return err
+		}
+		db.metrics.valueLogRotations.Add(1)
+		vl.olderFiles[vl.activeFile.FileId] = vl.activeFile
+		fileId = vl.activeFile.FileId + 1
+	}
+	dataFile, err := data.OpenValueLogFile(db.options.DirPath, fileId, db.fileOptions)
+	if err != nil {
+		return err
+	}
+	vl.activeFile = dataFile
+	vl.refresh()
+	return nil
+}
+
+// loadValueLogFiles 从磁盘中加载值日志文件，id 最大的是活跃文件
+func (db *DB) loadValueLogFiles() error {
+	fileIds, err := db.scanFileIds(data.ValueLogFileNameSuffix)
+	if err != nil {
+		return err
+	}
+	vl := db.valueLog
+	for i, fid := range fileIds {
+		dataFile, err := data.OpenValueLogFile(db.options.DirPath, uint32(fid), db.fileOptions)
+		if err != nil {
+			return err
+		}
+		// 值日志中的记录不需要加载到索引，直接找到文件末尾，回收时根据它统计文件中数据的总量
+		if dataFile.WriteOff, err = dataFile.IoManager.Size(); err != nil {
+			return err
+		}
+		if i == len(fileIds)-1 {
+			vl.activeFile = dataFile
+		} else {
+			vl.olderFiles[uint32(fid)] = dataFile
+		}
+	}
+	vl.refresh()
+
+	// 和数据文件一样，活跃文件和当前配置不一致时，新的数据写入到新的文件中
+	if !db.readOnly && vl.activeFile != nil && !vl.activeFile.MatchesOptions(db.fileOptions) {
+		return db.rotateValueLog()
+	}
+	return nil
+}
+
+// shouldSeparateValue 日志记录的 value 是否需要写入到值日志中
+func (db *DB) shouldSeparateValue(logRecord *data.LogRecord) bool {
+	// 注册表的记录在加载值日志之前解码，不能分离
+	return db.options.ValueThreshold > 0 && logRecord.Type == data.LogRecordNormal &&
+		logRecord.Namespace != systemNamespace && len(logRecord.Value) > db.options.ValueThreshold
+}
+
+// writeValueLog 将日志记录写入到值日志中，返回需要写入到数据文件中的指针记录，调用方需要持有 db.mu
+func (db *DB) writeValueLog(logRecord *data.LogRecord) (*data.LogRecord, error) {
+	vp, err := db.appendValueLog(logRecord)
+	if err != nil {
+		return nil, err
+	}
+	return &data.LogRecord{
+		Key:       logRecord.Key,
+		Value:     data.EncodeValuePointer(vp),
+		Type:      data.LogRecordValuePointer,
+		Namespace: logRecord.Namespace,
+	}, nil
+}
+
+// appendValueLog 追加写入一条记录到活跃的值日志文件中，返回其位置，调用方需要持有 db.mu
+func (db *DB) appendValueLog(logRecord *data.LogRecord) (*data.ValuePointer, error) {
+	vl := db.valueLog
+	if vl.activeFile == nil {
+		if err := db.rotateValueLog(); err != nil {
+			return nil, err
+		}
+	}
+	encRecord, size := vl.activeFile.EncodeLogRecord(logRecord)
+	// 值日志文件的大小阈值和数据文件相同
+	if vl.activeFile.WriteOff+size > db.options.DataFileSize {
+		if err := db.rotateValueLog(); err != nil {
+			return nil, err
+		}
+		encRecord, size = vl.activeFile.EncodeLogRecord(logRecord)
+	}
+	writeOff := vl.activeFile.WriteOff
+	if err := vl.activeFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	db.bytesWrite += uint(size)
+	db.metrics.bytesWritten.Add(uint64(size))
+	return &data.ValuePointer{Fid: vl.activeFile.FileId, Offset: writeOff, Size: size}, nil
+}
+
+// readValueLog 根据编码之后的指针从值日志中读取 value
+func (db *DB) readValueLog(pointer []byte) ([]byte, error) {
+	vp, err := data.DecodeValuePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	logRecord, err := db.readValueLogRecord(vp)
+	if err != nil {
+		return nil, err
+	}
+	return db.decompressValue(logRecord)
+}
+
+// readValueLogRecord 根据指针从值日志中读取记录
+func (db *DB) readValueLogRecord(vp *data.ValuePointer) (*data.LogRecord, error) {
+	// 值日志文件在垃圾回收之后被删除时，和数据文件一样返回 ErrDataFileNotFound，由调用方重新读取索引
+	dataFile := (*db.valueLog.files.Load())[vp.Fid]
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	key := cacheKey{valueLog: true, fid: vp.Fid, offset: vp.Offset}
+	if logRecord, ok := db.cache.get(key); ok {
+		return logRecord, nil
+	}
+	logRecord, _, err := dataFile.ReadLogRecord(vp.Offset)
+	if err != nil {
+		return nil, err
+	}
+	// 分块写入的 value 通常是顺序读取一次，不缓存，避免淘汰其他的热点记录
+	if logRecord.Type != data.LogRecordChunk {
+		db.cache.put(key, logRecord)
+	}
+	return logRecord, nil
+}
+
+// ValueLogGC 值日志的垃圾回收，和数据文件的合并相互独立
+// 无效数据的比例达到 discardRatio 的值日志文件会被回收：其中有效的 value 重新写入到活跃的值日志中，
+// 并在数据文件中追加新的指针记录，然后删除旧的文件。回收期间所有的写入都会被阻塞，读取不受影响
+func (db *DB) ValueLogGC(discardRatio float64) error {
+	if discardRatio <= 0 || discardRatio > 1 {
+		return ErrInvalidDiscardRatio
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	// 获取所有的分段锁，保证没有写入者处于写入日志和更新索引之间，正在进行的分块写入的块所在的文件不回收
+	unlock := db.keyLocks.lockAll()
+	defer unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	vl := db.valueLog
+	var files []*data.DataFile
+	for _, dataFile := range *vl.files.Load() {
+		files = append(files, dataFile)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileId < files[j].FileId
+	})
+
+	// 统计每个文件中有效数据的比例，找到需要回收的文件
+	var gcFiles []*data.DataFile
+	var liveKeys []valueLogKey
+	gcFids := make(map[uint32]struct{})
+	seen := make(map[valueLogKey]struct{})
+	for _, dataFile := range files {
+		total := dataFile.WriteOff - dataFile.HeaderSize()
+		if total == 0 || vl.pinned[dataFile.FileId] > 0 {
+			continue
+		}
+		keys, liveSize, err := db.scanValueLogFile(dataFile)
+		if err != nil {
+			return err
+		}
+		if float64(total-liveSize)/float64(total) < discardRatio {
+			continue
+		}
+		gcFiles = append(gcFiles, dataFile)
+		gcFids[dataFile.FileId] = struct{}{}
+		for _, key := range keys {
+			// 分块写入的 value 的多个块可能在不同的文件中
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				liveKeys = append(liveKeys, key)
+			}
+		}
+	}
+	if len(gcFiles) == 0 {
+		return nil
+	}
+	// 活跃文件也需要回收时，先打开新的活跃文件，有效的 value 写到这里
+	if gcFiles[len(gcFiles)-1] == vl.activeFile {
+		if err := db.rotateValueLog(); err != nil {
+			return err
+		}
+	}
+
+	// 重新写入有效的 value，新的值日志和指针记录都在旧的之后，重启回放时以新的为准
+	for _, key := range liveKeys {
+		if err := db.rewriteValueLog(key.namespace, []byte(key.key), gcFids); err != nil {
+			return err
+		}
+	}
+	if err := db.syncActiveFiles(); err != nil {
+		return err
+	}
+	db.bytesWrite = 0
+
+	// 索引已经全部指向新的位置，移除旧的值日志文件
+	for _, dataFile := range gcFiles {
+		delete(vl.olderFiles, dataFile.FileId)
+	}
+	vl.refresh()
+	db.publishCommitted()
+	db.cache.purge(true, gcFids)
+	for _, dataFile := range gcFiles {
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(data.GetValueLogFileName(db.options.DirPath, dataFile.FileId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteValueLog 将命名空间中的 key 在回收的文件中的 value 重新写入，并追加新的指针记录或清单，调用方需要持有 db.mu
+func (db *DB) rewriteValueLog(namespace uint32, key []byte, gcFids map[uint32]struct{}) error {
+	idx := db.indexOf(namespace)
+	logRecord, err := db.currentLogRecord(idx, key)
+	if err != nil {
+		return err
+	}
+
+	var newRecord *data.LogRecord
+	switch logRecord.Type {
+	case data.LogRecordValuePointer:
+		vp, err := data.DecodeValuePointer(logRecord.Value)
+		if err != nil {
+			return err
+		}
+		valueRecord, err := db.readValueLogRecord(vp)
+		if err != nil {
+			return err
+		}
+		// 原样写入，已经压缩过的 value 不需要重新压缩
+		newRecord = &data.LogRecord{
+			Key:       key,
+			Value:     valueRecord.Value,
+			Type:      data.LogRecordNormal,
+			Codec:     valueRecord.Codec,
+			Namespace: namespace,
+		}
+	case data.LogRecordChunkManifest:
+		manifest, err := data.DecodeChunkManifest(logRecord.Value)
+		if err != nil {
+			return err
+		}
+		// 只移动在回收的文件中的块，清单的 id 保持不变，正在读取的流可以继续读取
+		for i, vp := range manifest.Chunks {
+			if _, ok := gcFids[vp.Fid]; !ok {
+				continue
+			}
+			chunkRecord, err := db.readValueLogRecord(vp)
+			if err != nil {
+				return err
+			}
+			if manifest.Chunks[i], err = db.appendValueLog(chunkRecord); err != nil {
+				return err
+			}
+		}
+		newRecord = &data.LogRecord{
+			Key:   key,
+			Value: data.EncodeChunkManifest(manifest),
+			Type:  data.LogRecordChunkManifest,
+		}
+	default:
+		return nil
+	}
+
+	pos, err := db.writeLogRecord(newRecord)
+	if err != nil {
+		return err
+	}
+	if ok := idx.Put(key, pos); !ok {
+		return ErrIndexUpdateFailed
+	}
+	return nil
+}
+
+// valueLogKey 值日志中记录所属的命名空间和 key
+type valueLogKey struct {
+	namespace uint32
+	key       string
+}
+
+// scanValueLogFile 遍历值日志文件，找到索引仍然引用的记录，返回这些记录的 key 及其占用的总长度，调用方需要持有 db.mu
+func (db *DB) scanValueLogFile(dataFile *data.DataFile) ([]valueLogKey, int64, error) {
+	var keys []valueLogKey
+	var liveSize int64
+	offset := dataFile.HeaderSize()
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, 0, err
+		}
+		live, err := db.isValueLogRecordLive(logRecord.Namespace, logRecord.Key, dataFile.FileId, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		if live {
+			keys = append(keys, valueLogKey{namespace: logRecord.Namespace, key: string(logRecord.Key)})
+			liveSize += size
+		}
+		offset += size
+	}
+	return keys, liveSize, nil
+}
+
+// isValueLogRecordLive 值日志中的记录是否仍然被命名空间中 key 当前的指针或者清单引用，已经删除的命名空间中的记录都是无效的
+func (db *DB) isValueLogRecordLive(namespace uint32, key []byte, fid uint32, offset int64) (bool, error) {
+	idx := db.indexOf(namespace)
+	if idx == nil || idx.Get(key) == nil {
+		return false, nil
+	}
+	logRecord, err := db.currentLogRecord(idx, key)
+	if err != nil {
+		return false, err
+	}
+	switch logRecord.Type {
+	case data.LogRecordValuePointer:
+		vp, err := data.DecodeValuePointer(logRecord.Value)
+		if err != nil {
+			return false, err
+		}
+		return vp.Fid == fid && vp.Offset == offset, nil
+	case data.LogRecordChunkManifest:
+		manifest, err := data.DecodeChunkManifest(logRecord.Value)
+		if err != nil {
+			return false, err
+		}
+		for _, vp := range manifest.Chunks {
+			if vp.Fid == fid && vp.Offset == offset {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// currentLogRecord 读取索引中 key 当前指向的数据文件中的记录，调用方需要持有 db.mu
+func (db *DB) currentLogRecord(idx index.Indexer, key []byte) (*data.LogRecord, error) {
+	pos := idx.Get(key)
+	if pos == nil {
+		return nil, ErrKeyNotFound
+	}
+	return db.readLogRecordByPosition(pos)
+}
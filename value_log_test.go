@@ -0,0 +1,211 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/21 21:10
+// @Desc
+package kv_projects
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"os"
+	"testing"
+)
+
+// closeFiles 关闭活跃的数据文件和值日志文件，用于重启测试
+func closeFiles(t *testing.T, db *DB) {
+	assert.Nil(t, db.activeFile.Close())
+	if db.valueLog.activeFile != nil {
+		assert.Nil(t, db.valueLog.activeFile.Close())
+	}
+}
+
+func TestDB_ValueLog(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog")
+	opts.DirPath = dir
+	opts.ValueThreshold = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.大 value 写入到值日志中，小 value 仍然写入到数据文件
+	bigValue := bytes.Repeat([]byte("big-value-"), 100)
+	err = db.Put(utils.GetTestKey(1), bigValue)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), []byte("small"))
+	assert.Nil(t, err)
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, val1)
+	val2, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), val2)
+
+	content, err := os.ReadFile(data.GetDataFileName(dir, db.activeFile.FileId))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(content, bigValue))
+	assert.True(t, bytes.Contains(content, []byte("small")))
+	vlogContent, err := os.ReadFile(data.GetValueLogFileName(dir, db.valueLog.activeFile.FileId))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(vlogContent, bigValue))
+
+	// 2.迭代器透明地读取
+	iter := db.NewIterator(DefaultIteratorOptions)
+	iter.Seek(utils.GetTestKey(1))
+	assert.True(t, iter.Valid())
+	itVal, err := iter.Value()
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, itVal)
+	iter.Close()
+
+	// 3.重启之后关闭键值分离，之前分离的 value 仍然可以读取
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	closeFiles(t, db)
+	opts.ValueThreshold = 0
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	val1, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, bigValue, val1)
+	_, err = db2.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	closeFiles(t, db2)
+}
+
+func TestDB_ValueLog_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog-merge")
+	opts.DirPath = dir
+	opts.ValueThreshold = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), bytes.Repeat(utils.GetTestKey(i), 20))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		err := db.Put(utils.GetTestKey(i), bytes.Repeat(utils.GetTestKey(i+1), 20))
+		assert.Nil(t, err)
+	}
+
+	// 合并数据文件不会重写值日志
+	vlogSize := db.valueLog.activeFile.WriteOff
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, vlogSize, db.valueLog.activeFile.WriteOff)
+	assert.Equal(t, 1, len(*db.valueLog.files.Load()))
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 50 {
+			assert.Equal(t, bytes.Repeat(utils.GetTestKey(i+1), 20), val)
+		} else {
+			assert.Equal(t, bytes.Repeat(utils.GetTestKey(i), 20), val)
+		}
+	}
+}
+
+func TestDB_ValueLogGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog-gc")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.ValueThreshold = 64
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.非法的参数，空的数据库
+	assert.Equal(t, ErrInvalidDiscardRatio, db.ValueLogGC(0))
+	assert.Equal(t, ErrInvalidDiscardRatio, db.ValueLogGC(1.5))
+	assert.Nil(t, db.ValueLogGC(0.5))
+
+	// 2.写入多个值日志文件，然后覆盖和删除大部分数据
+	value := func(i, version int) []byte {
+		return bytes.Repeat(append(utils.GetTestKey(i), byte(version)), 20)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), value(i, 0))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 800; i++ {
+		if i%2 == 0 {
+			err = db.Delete(utils.GetTestKey(i))
+		} else {
+			err = db.Put(utils.GetTestKey(i), []byte("inline"))
+		}
+		assert.Nil(t, err)
+	}
+	oldFiles := len(*db.valueLog.files.Load())
+	assert.True(t, oldFiles > 2)
+
+	// 3.回收之后文件数量减少，所有的数据仍然可以读取
+	err = db.ValueLogGC(0.5)
+	assert.Nil(t, err)
+	assert.True(t, len(*db.valueLog.files.Load()) < oldFiles)
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 800 && i%2 == 0:
+				assert.Equal(t, ErrKeyNotFound, err)
+			case i < 800:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("inline"), val)
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, value(i, 0), val)
+			}
+		}
+	}
+	check(db)
+
+	// 4.重启之后数据仍然正确，旧的值日志文件已经被删除
+	closeFiles(t, db)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	assert.Nil(t, db2.ValueLogGC(1))
+	check(db2)
+	closeFiles(t, db2)
+}
+
+func TestDB_ValueLogGC_Reopen(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog-gc-reopen")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.ValueThreshold = 64
+	db, err := Open(opts)
+	assert.Nil(t, err)
+
+	// 1.写入多个值日志文件，然后覆盖所有的数据
+	value := bytes.Repeat([]byte("v"), 200)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("inline")))
+	}
+	oldFiles := len(*db.valueLog.files.Load())
+	assert.Greater(t, oldFiles, 2)
+
+	// 2.重启之后回收，启动时加载的旧文件同样可以被回收
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, oldFiles, len(*db2.valueLog.files.Load()))
+	assert.Nil(t, db2.ValueLogGC(0.5))
+	assert.Less(t, len(*db2.valueLog.files.Load()), oldFiles)
+	for i := 0; i < 1000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("inline"), val)
+	}
+}
@@ -0,0 +1,339 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/26 20:50
+// @Desc 监听 key 前缀的变更，通过前缀树分发写入事件
+package kv_projects
+
+import (
+	"bytes"
+	"context"
+	"kv-projects/data"
+	"sync"
+	"sync/atomic"
+)
+
+// watchBufferSize 每个监听者缓冲的事件数量，缓冲满了之后从数据文件中补齐
+const watchBufferSize = 128
+
+// watcher 一个前缀的监听者
+type watcher struct {
+	prefix   []byte
+	buf      chan *ChangeEvent // 写路径非阻塞地写入
+	overflow chan struct{}     // 缓冲满了之后通知监听协程补齐
+
+	mu         sync.Mutex
+	overflowed bool   // 缓冲是否满过，满过之后写路径不再写入，直到补齐
+	resumeSeq  uint64 // 第一个没有写入缓冲的事件的序列号
+}
+
+// trieNode 前缀树的节点
+type trieNode struct {
+	children map[byte]*trieNode
+	watchers map[*watcher]struct{}
+}
+
+// watchTrie 按照前缀组织所有的监听者，分发一个写入的开销只和 key 的长度以及匹配的监听者数量有关
+type watchTrie struct {
+	mu    sync.RWMutex
+	root  *trieNode
+	count atomic.Int64
+}
+
+// newWatchTrie 新建前缀树
+func newWatchTrie() *watchTrie {
+	return &watchTrie{root: &trieNode{}}
+}
+
+// add 添加监听者
+func (wt *watchTrie) add(w *watcher) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	node := wt.root
+	for _, b := range w.prefix {
+		if node.children == nil {
+			node.children = make(map[byte]*trieNode)
+		}
+		child, ok := node.children[b]
+		if !ok {
+			child = &trieNode{}
+			node.children[b] = child
+		}
+		node = child
+	}
+	if node.watchers == nil {
+		node.watchers = make(map[*watcher]struct{})
+	}
+	node.watchers[w] = struct{}{}
+	wt.count.Add(1)
+}
+
+// remove 移除监听者，并删除不再需要的节点
+func (wt *watchTrie) remove(w *watcher) {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	path := []*trieNode{wt.root}
+	node := wt.root
+	for _, b := range w.prefix {
+		if node = node.children[b]; node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+	if _, ok := node.watchers[w]; !ok {
+		return
+	}
+	delete(node.watchers, w)
+	wt.count.Add(-1)
+	// 从叶子节点向上删除空的节点
+	for i := len(path) - 1; i > 0; i-- {
+		if len(path[i].watchers) > 0 || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, w.prefix[i-1])
+	}
+}
+
+// match 遍历前缀匹配 key 的所有监听者
+func (wt *watchTrie) match(key []byte, fn func(w *watcher)) {
+	wt.mu.RLock()
+	defer wt.mu.RUnlock()
+	node := wt.root
+	for i := 0; ; i++ {
+		for w := range node.watchers {
+			fn(w)
+		}
+		if i == len(key) {
+			return
+		}
+		if node = node.children[key[i]]; node == nil {
+			return
+		}
+	}
+}
+
+// matchRange 遍历前缀和 [start, end) 范围有交集的所有监听者，end 为 nil 表示没有上界
+func (wt *watchTrie) matchRange(start, end []byte, fn func(w *watcher)) {
+	wt.mu.RLock()
+	defer wt.mu.RUnlock()
+	var walk func(node *trieNode, prefix []byte)
+	walk = func(node *trieNode, prefix []byte) {
+		// 前缀和范围没有交集时，更长的前缀也没有交集
+		if !rangeInPrefix(start, end, prefix) {
+			return
+		}
+		for w := range node.watchers {
+			fn(w)
+		}
+		for b, child := range node.children {
+			walk(child, append(prefix, b))
+		}
+	}
+	walk(wt.root, nil)
+}
+
+// notifyWatchers 将写入分发给前缀匹配的监听者，调用方需要持有 db.mu，保证事件按照序列号的顺序分发
+// 缓冲已满的监听者不会阻塞写入，而是记录位置，之后由监听协程从数据文件中补齐
+func (db *DB) notifyWatchers(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+	// 监听只包含默认命名空间的写入
+	if db.watchers.count.Load() == 0 || logRecord.Namespace != 0 {
+		return
+	}
+	var event *ChangeEvent
+	notify := func(w *watcher) {
+		if event == nil {
+			event = db.newWatchEvent(logRecord, pos)
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.overflowed {
+			return
+		}
+		select {
+		case w.buf <- event:
+		default:
+			w.overflowed, w.resumeSeq = true, event.Seq
+			select {
+			case w.overflow <- struct{}{}:
+			default:
+			}
+		}
+	}
+	// 范围删除分发给前缀和范围有交集的监听者，不按照字节序比较时无法判断是否有交集，分发给所有的监听者
+	if logRecord.Type == data.LogRecordRangeDeleted {
+		if db.bytewise() {
+			db.watchers.matchRange(logRecord.Key, rangeEnd(logRecord.Value), notify)
+		} else {
+			db.watchers.matchRange(nil, nil, notify)
+		}
+		return
+	}
+	db.watchers.match(logRecord.Key, notify)
+}
+
+// newWatchEvent 根据刚刚写入的记录构造事件，和订阅中的事件一致
+func (db *DB) newWatchEvent(logRecord *data.LogRecord, pos *data.LogRecordPos) *ChangeEvent {
+	event := &ChangeEvent{
+		Seq:  makeSeq(pos.Fid, pos.Offset),
+		Key:  bytes.Clone(logRecord.Key),
+		Type: data.LogRecordNormal,
+	}
+	switch logRecord.Type {
+	case data.LogRecordDeleted:
+		event.Type = data.LogRecordDeleted
+	case data.LogRecordRangeDeleted:
+		event.Type, event.Value = data.LogRecordRangeDeleted, bytes.Clone(rangeEnd(logRecord.Value))
+	case data.LogRecordNormal:
+		// 写入的记录可能已经被压缩，解压失败时和被回收的 value 一样为 nil
+		if value, err := db.decompressValue(logRecord); err == nil {
+			event.Value = bytes.Clone(value)
+		}
+	}
+	return event
+}
+
+// Watch 监听前缀为 prefix 的 key 的写入和删除，prefix 为空表示监听所有的 key
+// 返回的 channel 在 ctx 结束或者数据库关闭之后被关闭。事件按照序列号的顺序至少投递一次：
+// 消费慢时不会阻塞写入，缓冲满了之后从数据文件中补齐，补齐期间遇到合并可能会收到重复的事件。
+// 目前还不支持 key 的过期，因此不会产生过期事件
+func (db *DB) Watch(ctx context.Context, prefix []byte) (<-chan *ChangeEvent, error) {
+	if db.closed.Load() {
+		return nil, ErrDBClosed
+	}
+	w := &watcher{
+		prefix:   bytes.Clone(prefix),
+		buf:      make(chan *ChangeEvent, watchBufferSize),
+		overflow: make(chan struct{}, 1),
+	}
+	db.watchers.add(w)
+
+	out := make(chan *ChangeEvent)
+	go db.runWatcher(ctx, w, out)
+	return out, nil
+}
+
+// runWatcher 监听协程，将缓冲中的事件转发给调用方，缓冲满过之后从数据文件中补齐
+func (db *DB) runWatcher(ctx context.Context, w *watcher, out chan<- *ChangeEvent) {
+	defer close(out)
+	defer db.watchers.remove(w)
+
+	forward := func(event *ChangeEvent) bool {
+		select {
+		case out <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-db.done:
+			return false
+		}
+	}
+	for {
+		select {
+		case event := <-w.buf:
+			if !forward(event) {
+				return
+			}
+		case <-w.overflow:
+			// 先转发缓冲中的事件，它们都在没有写入缓冲的事件之前
+			for len(w.buf) > 0 {
+				if !forward(<-w.buf) {
+					return
+				}
+			}
+			if !db.catchUpWatcher(w, forward) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// catchUpWatcher 从数据文件中补齐没有写入缓冲的事件，补齐之后恢复从写路径接收事件
+func (db *DB) catchUpWatcher(w *watcher, forward func(event *ChangeEvent) bool) bool {
+	// resumeSeq 是事件的序列号，一定是记录的起始位置，不需要从文件头开始对齐
+	w.mu.Lock()
+	sub := &Subscription{db: db, cursor: w.resumeSeq, aligned: true}
+	w.mu.Unlock()
+
+	// 不加锁补齐到最新的位置，期间的写入仍然不会写入缓冲
+	for {
+		events, err := db.readWatchEvents(sub, w.prefix)
+		if err != nil {
+			return false
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if !forward(event) {
+				return false
+			}
+		}
+	}
+
+	// 持有 db.mu 时没有新的写入，读取剩余的所有事件之后恢复接收，保证不会遗漏。
+	// 不加锁补齐期间可能又写入了超过一次读取上限的事件，需要一直读取到没有新的事件
+	db.mu.Lock()
+	events, err := db.readAllWatchEvents(sub, w.prefix)
+	if err == nil {
+		w.mu.Lock()
+		w.overflowed = false
+		w.mu.Unlock()
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return false
+	}
+	for _, event := range events {
+		if !forward(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPrefix 事件是否影响前缀为 prefix 的 key
+func (e *ChangeEvent) matchPrefix(prefix []byte) bool {
+	if e.Type == data.LogRecordRangeDeleted {
+		return rangeInPrefix(e.Key, e.Value, prefix)
+	}
+	return bytes.HasPrefix(e.Key, prefix)
+}
+
+// readAllWatchEvents 从订阅中读取当前已经提交的所有前缀匹配的事件
+func (db *DB) readAllWatchEvents(sub *Subscription, prefix []byte) ([]*ChangeEvent, error) {
+	var events []*ChangeEvent
+	for {
+		batch, err := db.readWatchEvents(sub, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			return events, nil
+		}
+		events = append(events, batch...)
+	}
+}
+
+// readWatchEvents 从订阅中读取当前已经提交的前缀匹配的事件，一次最多读取 watchBufferSize 个
+func (db *DB) readWatchEvents(sub *Subscription, prefix []byte) ([]*ChangeEvent, error) {
+	var events []*ChangeEvent
+	for len(events) < watchBufferSize {
+		event, err := sub.readNext()
+		if err == ErrSeqCompacted {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if event == nil {
+			break
+		}
+		if event.matchPrefix(prefix) || (event.Type == data.LogRecordRangeDeleted && !db.bytewise()) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
@@ -0,0 +1,252 @@
+// Package kv_projects
+// @Author NuyoahCh
+// @Date 2025/2/26 20:50
+// @Desc
+package kv_projects
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-projects/data"
+	"kv-projects/utils"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nextWatchEvent 读取下一个事件，最多等待一秒，超时或者 channel 关闭时返回 false
+func nextWatchEvent(ch <-chan *ChangeEvent) (*ChangeEvent, bool) {
+	select {
+	case event, ok := <-ch:
+		return event, ok
+	case <-time.After(time.Second):
+		return nil, false
+	}
+}
+
+func TestWatchTrie(t *testing.T) {
+	wt := newWatchTrie()
+	all := &watcher{}
+	user := &watcher{prefix: []byte("user:")}
+	user1 := &watcher{prefix: []byte("user:1")}
+	wt.add(all)
+	wt.add(user)
+	wt.add(user1)
+	assert.Equal(t, int64(3), wt.count.Load())
+
+	match := func(key string) map[*watcher]bool {
+		matched := make(map[*watcher]bool)
+		wt.match([]byte(key), func(w *watcher) { matched[w] = true })
+		return matched
+	}
+
+	// 1.匹配所有前缀相同的监听者
+	assert.Equal(t, map[*watcher]bool{all: true, user: true, user1: true}, match("user:100"))
+	assert.Equal(t, map[*watcher]bool{all: true, user: true}, match("user:2"))
+	assert.Equal(t, map[*watcher]bool{all: true}, match("use"))
+	assert.Equal(t, map[*watcher]bool{all: true}, match("order:1"))
+
+	// 2.移除之后删除不再需要的节点
+	wt.remove(user1)
+	assert.Equal(t, map[*watcher]bool{all: true, user: true}, match("user:100"))
+	wt.remove(user)
+	assert.Equal(t, 0, len(wt.root.children))
+	wt.remove(all)
+	assert.Equal(t, int64(0), wt.count.Load())
+	assert.Equal(t, map[*watcher]bool{}, match("user:100"))
+}
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, []byte("config:"))
+	assert.Nil(t, err)
+
+	// 1.只收到前缀匹配的写入和删除
+	err = db.Put([]byte("other"), []byte("v"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("config:a"), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("config:a"), []byte("v2"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("config:a"))
+	assert.Nil(t, err)
+
+	event1, ok := nextWatchEvent(ch)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("config:a"), event1.Key)
+	assert.Equal(t, []byte("v1"), event1.Value)
+	assert.Equal(t, data.LogRecordNormal, event1.Type)
+	event2, ok := nextWatchEvent(ch)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("v2"), event2.Value)
+	assert.True(t, event2.Seq > event1.Seq)
+	event3, ok := nextWatchEvent(ch)
+	assert.True(t, ok)
+	assert.Equal(t, data.LogRecordDeleted, event3.Type)
+	assert.Nil(t, event3.Value)
+
+	// 2.序列号和订阅中的一致
+	sub, err := db.Subscribe(event2.Seq)
+	assert.Nil(t, err)
+	event, err := nextEvent(sub)
+	assert.Nil(t, err)
+	assert.Equal(t, event2, event)
+
+	// 3.条件写入也会通知
+	_, err = db.PutIfAbsent([]byte("config:b"), []byte("v3"))
+	assert.Nil(t, err)
+	event, ok = nextWatchEvent(ch)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("config:b"), event.Key)
+	assert.Equal(t, []byte("v3"), event.Value)
+
+	// 4.ctx 结束之后 channel 被关闭，监听者被移除
+	cancel()
+	_, ok = nextWatchEvent(ch)
+	assert.False(t, ok)
+	assert.Eventually(t, func() bool { return db.watchers.count.Load() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestDB_Watch_SlowConsumer(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-slow")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.Compression, _ = data.NewFlateCompressor(1)
+	opts.CompressionMinSize = 16
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, nil)
+	assert.Nil(t, err)
+
+	// 1.不消费时写入超过缓冲的数量，写入不会被阻塞
+	n := watchBufferSize * 5
+	values := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		values[i] = utils.RandomValue(64)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+
+	// 2.按照顺序收到所有的事件，解压之后的 value 正确
+	var last uint64
+	for i := 0; i < n; i++ {
+		event, ok := nextWatchEvent(ch)
+		assert.True(t, ok)
+		if !ok {
+			return
+		}
+		assert.Equal(t, utils.GetTestKey(i), event.Key)
+		assert.Equal(t, values[i], event.Value)
+		assert.True(t, event.Seq > last)
+		last = event.Seq
+	}
+
+	// 3.补齐之后恢复从写路径接收事件
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	event, ok := nextWatchEvent(ch)
+	assert.True(t, ok)
+	assert.Equal(t, data.LogRecordDeleted, event.Type)
+	assert.True(t, event.Seq > last)
+	w := firstWatcher(db)
+	w.mu.Lock()
+	assert.False(t, w.overflowed)
+	w.mu.Unlock()
+}
+
+func TestDB_Watch_Close(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-close")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	ch, err := db.Watch(context.Background(), nil)
+	assert.Nil(t, err)
+
+	// 1.关闭数据库之后 channel 被关闭
+	err = db.Close()
+	assert.Nil(t, err)
+	_, ok := nextWatchEvent(ch)
+	assert.False(t, ok)
+
+	// 2.关闭之后不能再监听
+	_, err = db.Watch(context.Background(), nil)
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_Watch_CatchUpConcurrentWrites(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-catch-up")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1.持有 db.mu 时读取剩余的所有事件，不受一次读取的上限限制
+	n := watchBufferSize * 3
+	for i := 0; i < n; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("value")))
+	}
+	events, err := db.readAllWatchEvents(&Subscription{db: db}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, n, len(events))
+
+	// 2.补齐期间并发写入大量的事件，所有的事件都至少收到一次
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := db.Watch(ctx, []byte("concurrent:"))
+	assert.Nil(t, err)
+	writers, perWriter := 8, watchBufferSize*4
+	wg := new(sync.WaitGroup)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				assert.Nil(t, db.Put([]byte(fmt.Sprintf("concurrent:%d:%d", w, i)), []byte("value")))
+			}
+		}(w)
+	}
+	seen := make(map[string]struct{})
+	for len(seen) < writers*perWriter {
+		event, ok := nextWatchEvent(ch)
+		if !assert.True(t, ok) {
+			break
+		}
+		seen[string(event.Key)] = struct{}{}
+		// 消费得比写入慢，让缓冲反复写满
+		if len(seen)%watchBufferSize == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, writers*perWriter, len(seen))
+}
+
+// firstWatcher 返回根节点上的任意一个监听者
+func firstWatcher(db *DB) *watcher {
+	db.watchers.mu.RLock()
+	defer db.watchers.mu.RUnlock()
+	for w := range db.watchers.root.watchers {
+		return w
+	}
+	return nil
+}